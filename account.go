@@ -4,10 +4,6 @@ import (
 	"encoding/json"
 	pc "github.com/padloc/padlock-cloud/padlockcloud"
 	"github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/coupon"
-	"github.com/stripe/stripe-go/customer"
-	"github.com/stripe/stripe-go/sub"
-	"math/rand"
 	"strconv"
 	"time"
 )
@@ -22,9 +18,26 @@ func planToMap(plan *stripe.Plan) map[string]interface{} {
 	return planMap
 }
 
-func ChoosePlan() string {
-	plan := AvailablePlans[rand.Intn(len(AvailablePlans))]
-	return plan.ID
+// Returns the available plan with the given id or `nil` if there is no such plan
+func FindPlan(id string) *stripe.Plan {
+	for _, plan := range AvailablePlans {
+		if plan.ID == id {
+			return plan
+		}
+	}
+	return nil
+}
+
+// Picks the plan a new account should be subscribed to, based on the active pricing experiment
+func ChoosePlan(acc *Account) string {
+	if e := ActivePricingExperiment(); e != nil {
+		if a := acc.AssignExperiment(e); a != nil {
+			if plan := FindPlan(a.Plan); plan != nil {
+				return acc.LocalizePlan(plan).ID
+			}
+		}
+	}
+	return PlansForCurrency(acc.Currency())[0].ID
 }
 
 type Promo struct {
@@ -35,6 +48,82 @@ type Promo struct {
 	RedeemWithin int            `json:"redeemWithin"`
 }
 
+// Returns the time after which the promo can no longer be redeemed. The redemption window starts
+// when the promo is first shown to the customer. Returns a zero time if the promo doesn't expire
+// or hasn't been shown yet
+func (p *Promo) Expires() time.Time {
+	if p.RedeemWithin <= 0 || p.Created.IsZero() {
+		return time.Time{}
+	}
+	return p.Created.AddDate(0, 0, p.RedeemWithin)
+}
+
+func (p *Promo) Expired() bool {
+	expires := p.Expires()
+	return !expires.IsZero() && expires.Before(time.Now())
+}
+
+// Offers the given promo to the account. If the same coupon is already on offer, the existing promo
+// is kept so its redemption window isn't restarted. Returns whether the promo was changed
+func (acc *Account) OfferPromo(promo *Promo) bool {
+	if p := acc.Promo; p != nil && p.Coupon != nil && promo.Coupon != nil && p.Coupon.ID == promo.Coupon.ID {
+		return false
+	}
+	acc.Promo = promo
+	return true
+}
+
+// Removes the account's promo if its redemption window has passed. Returns whether the promo was removed
+func (acc *Account) ClearExpiredPromo() bool {
+	if acc.Promo != nil && acc.Promo.Expired() {
+		acc.Promo = nil
+		return true
+	}
+	return false
+}
+
+// Checks whether the given coupon can be redeemed by the account, i.e. whether it belongs to the
+// promo offered to the account and the promo hasn't expired yet
+func (acc *Account) ValidateCoupon(coupon string) error {
+	if coupon == "" {
+		return nil
+	}
+
+	p := acc.Promo
+	if p == nil || p.Coupon == nil || p.Coupon.ID != coupon {
+		return &InvalidCoupon{}
+	}
+
+	if p.Expired() {
+		return &PromoExpired{}
+	}
+
+	return nil
+}
+
+// Whether the account has redeemed the given coupon, i.e. whether there is a discount for it on
+// the customer or their subscription
+func (acc *Account) RedeemedCoupon(coupon string) bool {
+	c := acc.Customer
+	if c == nil {
+		return false
+	}
+
+	if c.Discount != nil && c.Discount.Coupon != nil && c.Discount.Coupon.ID == coupon {
+		return true
+	}
+
+	if c.Subscriptions != nil {
+		for _, s := range c.Subscriptions.Data {
+			if s.Discount != nil && s.Discount.Coupon != nil && s.Discount.Coupon.ID == coupon {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 type Account struct {
 	Email           string
 	Created         time.Time
@@ -42,6 +131,19 @@ type Account struct {
 	TrackingID      string
 	Promo           *Promo
 	CustomerUpdated time.Time
+	Dunning         *Dunning
+	Plans           AccountPlans
+	Experiments     map[string]*ExperimentAssignment
+	Pause           *SubscriptionPause
+	Cancellation    *Cancellation
+	// Set if the account is scheduled for deletion
+	Deletion *PendingDeletion
+	// Id of the group the account owns or is a member of
+	GroupID string
+	// Currency explicitly chosen by the customer, if any
+	PreferredCurrency stripe.Currency
+	billing           BillingProvider
+	groupEntitlement  *Entitlement
 }
 
 func (acc *Account) Subscription() *stripe.Subscription {
@@ -75,11 +177,7 @@ func (acc *Account) SetCustomer(c *stripe.Customer) {
 }
 
 func (acc *Account) CreateCustomer() error {
-	params := &stripe.CustomerParams{
-		Email: &acc.Email,
-	}
-
-	if c, err := customer.New(params); err != nil {
+	if c, err := acc.billing.CreateCustomer(acc.Email); err != nil {
 		return err
 	} else {
 		acc.SetCustomer(c)
@@ -94,7 +192,7 @@ func (acc *Account) UpdateCustomer() error {
 			return err
 		}
 	} else if time.Since(acc.CustomerUpdated) > time.Hour*24 {
-		if c, err := customer.Get(acc.Customer.ID, nil); err != nil {
+		if c, err := acc.billing.GetCustomer(acc.Customer.ID); err != nil {
 			return err
 		} else {
 			acc.SetCustomer(c)
@@ -105,11 +203,11 @@ func (acc *Account) UpdateCustomer() error {
 }
 
 func (acc *Account) CreateSubscription() error {
-	plan := ChoosePlan()
+	plan := ChoosePlan(acc)
 
 	TrialFromPlan := true
 
-	if s, err := sub.New(&stripe.SubscriptionParams{
+	if s, err := acc.billing.CreateSubscription(&stripe.SubscriptionParams{
 		Customer:      &acc.Customer.ID,
 		Plan:          &plan,
 		TrialFromPlan: &TrialFromPlan,
@@ -135,7 +233,7 @@ func (acc *Account) SetPaymentSource(token string) error {
 	params.SetSource(token)
 
 	var err error
-	acc.Customer, err = customer.Update(acc.Customer.ID, params)
+	acc.Customer, err = acc.billing.UpdateCustomer(acc.Customer.ID, params)
 	return err
 }
 
@@ -144,19 +242,42 @@ func (acc *Account) HasActiveSubscription() bool {
 	return subStatus == "active"
 }
 
+// Whether the account has an active subscription purchased through an app store
+func (acc *Account) HasActivePlan() bool {
+	for _, p := range acc.Plans.All() {
+		if p.Active() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the status of the account's effective entitlement as a single status string, along
+// with the end of the stripe trial period. Accounts without an active entitlement are reported
+// using the underlying Stripe status (or "trial_expired" if there is no payment source)
 func (acc *Account) SubscriptionStatus() (string, int64) {
 	status := ""
 	hasPaymentSource := acc.GetPaymentSource() != nil
 	var trialEnd int64 = 0
 
-	if s := acc.Subscription(); s != nil {
-		status = string(s.Status)
+	s := acc.Subscription()
+	if s != nil {
 		trialEnd = s.TrialEnd
+	}
+
+	if ent := acc.Entitlement(); ent != nil {
+		return ent.Status(), trialEnd
+	}
+
+	if s != nil {
+		status = string(s.Status)
 	} else if hasPaymentSource {
 		status = "canceled"
 	}
 
-	if (status == "" || status == "past_due" || status == "unpaid") && !hasPaymentSource {
+	// A "trialing" subscription without an entitlement means that the trial has run out but Stripe
+	// hasn't caught up yet
+	if (status == "" || status == "trialing" || status == "past_due" || status == "unpaid") && !hasPaymentSource {
 		status = "trial_expired"
 	}
 
@@ -195,64 +316,107 @@ func (acc *Account) RemainingTrialDays() int {
 	return int(acc.RemainingTrialPeriod().Hours()/24) + 1
 }
 
+// Returns the customer's billing details, taken from the shipping information if provided or the
+// address associated with the payment source otherwise. Returns `nil` if there is no customer
+func (acc *Account) BillingInfo() map[string]string {
+	c := acc.Customer
+	if c == nil {
+		return nil
+	}
+
+	var card *stripe.Card
+	if len(c.Sources.Data) != 0 && c.Sources.Data[0].Card != nil {
+		card = c.Sources.Data[0].Card
+	}
+
+	billing := map[string]string{
+		"vat": customerVATID(c),
+	}
+
+	if c.Shipping != nil {
+		billing["name"] = c.Shipping.Name
+		billing["address1"] = c.Shipping.Address.Line1
+		billing["address2"] = c.Shipping.Address.Line2
+		billing["postalCode"] = c.Shipping.Address.PostalCode
+		billing["city"] = c.Shipping.Address.City
+		billing["country"] = c.Shipping.Address.Country
+	} else if card != nil {
+		billing["name"] = card.Name
+		billing["address1"] = card.AddressLine1
+		billing["address2"] = card.AddressLine2
+		billing["postalCode"] = card.AddressZip
+		billing["city"] = card.AddressCity
+		if card.AddressCountry != "" {
+			billing["country"] = card.AddressCountry
+		} else {
+			billing["country"] = card.Country
+		}
+	}
+
+	return billing
+}
+
 func (subAcc *Account) ToMap(acc *pc.Account) map[string]interface{} {
 	accMap := acc.ToMap()
 	accMap["trackingID"] = subAcc.TrackingID
 
 	subStatus, trialEnd := subAcc.SubscriptionStatus()
+	cancelAtPeriodEnd := false
+	if s := subAcc.Subscription(); s != nil {
+		cancelAtPeriodEnd = s.CancelAtPeriodEnd
+	}
 	accMap["subscription"] = map[string]interface{}{
-		"status":   subStatus,
-		"trialEnd": trialEnd,
+		"status":            subStatus,
+		"trialEnd":          trialEnd,
+		"cancelAtPeriodEnd": cancelAtPeriodEnd,
 	}
 
-	accMap["plan"] = planToMap(AvailablePlans[0])
+	if ent := subAcc.Entitlement(); ent != nil {
+		accMap["entitlement"] = ent.ToMap()
+	} else {
+		accMap["entitlement"] = nil
+	}
+
+	ents := make([]map[string]interface{}, 0)
+	for _, e := range subAcc.Entitlements() {
+		ents = append(ents, e.ToMap())
+	}
+	accMap["entitlements"] = ents
+
+	if s := subAcc.Subscription(); s != nil && s.Plan != nil {
+		accMap["plan"] = planToMap(s.Plan)
+	} else {
+		accMap["plan"] = planToMap(PlansForCurrency(subAcc.Currency())[0])
+	}
+	accMap["currency"] = subAcc.Currency()
 
 	if c := subAcc.Customer; c != nil {
-		var card *stripe.Card
 		if len(c.Sources.Data) != 0 && c.Sources.Data[0].Card != nil {
-			card = c.Sources.Data[0].Card
+			card := c.Sources.Data[0].Card
 			accMap["paymentSource"] = map[string]string{
 				"brand":    string(card.Brand),
 				"lastFour": card.Last4,
 			}
 		}
 
-		billing := map[string]string{
-			"vat": "",
-		}
-
-		if c.Shipping != nil {
-			billing["name"] = c.Shipping.Name
-			billing["address1"] = c.Shipping.Address.Line1
-			billing["address2"] = c.Shipping.Address.Line2
-			billing["postalCode"] = c.Shipping.Address.PostalCode
-			billing["city"] = c.Shipping.Address.City
-			billing["country"] = c.Shipping.Address.Country
-		} else if card != nil {
-			billing["name"] = card.Name
-			billing["address1"] = card.AddressLine1
-			billing["address2"] = card.AddressLine2
-			billing["postalCode"] = card.AddressZip
-			billing["city"] = card.AddressCity
-			if card.AddressCountry != "" {
-				billing["country"] = card.AddressCountry
-			} else {
-				billing["country"] = card.Country
-			}
-		}
-
-		accMap["billing"] = billing
+		accMap["billing"] = subAcc.BillingInfo()
 	}
 
+	accMap["pause"] = subAcc.Pause
+	accMap["cancellation"] = subAcc.Cancellation
+	accMap["deletion"] = subAcc.Deletion
+	accMap["groupID"] = subAcc.GroupID
 	accMap["promo"] = subAcc.Promo
+	accMap["dunning"] = subAcc.Dunning
 
 	return accMap
 }
 
-func NewAccount(email string) (*Account, error) {
+func NewAccount(email string, billing BillingProvider) (*Account, error) {
 	acc := &Account{
 		Email:   email,
 		Created: time.Now(),
+		billing: billing,
 	}
 
 	if err := acc.CreateCustomer(); err != nil {
@@ -262,8 +426,8 @@ func NewAccount(email string) (*Account, error) {
 	return acc, nil
 }
 
-func PromoFromCoupon(couponCode string) (*Promo, error) {
-	if coup, err := coupon.Get(couponCode, nil); err != nil {
+func PromoFromCoupon(billing BillingProvider, couponCode string) (*Promo, error) {
+	if coup, err := billing.GetCoupon(couponCode); err != nil {
 		return nil, err
 	} else {
 		redeemWithin, _ := strconv.Atoi(coup.Metadata["redeemWithin"])
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/client"
+)
+
+// Common interface for payment processors. All billing related calls made by `Account` and `Server`
+// go through this interface so that they can be swapped out (e.g. for testing)
+type BillingProvider interface {
+	// Creates a new customer with the given email address
+	CreateCustomer(email string) (*stripe.Customer, error)
+	// Retrieves the customer with the given id
+	GetCustomer(id string) (*stripe.Customer, error)
+	// Updates the customer with the given id
+	UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	// Deletes the customer with the given id
+	DeleteCustomer(id string) error
+	// Lists all customers matching the given parameters, most recently created first
+	ListCustomers(params *stripe.CustomerListParams) ([]*stripe.Customer, error)
+	// Creates a new subscription
+	CreateSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	// Updates the subscription with the given id
+	UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	// Cancels the subscription with the given id immediately
+	CancelSubscription(id string) (*stripe.Subscription, error)
+	// Pauses payment collection for the subscription with the given id until `resumesAt`
+	PauseSubscription(id string, resumesAt time.Time) (*stripe.Subscription, error)
+	// Resumes payment collection for a paused subscription
+	ResumeSubscription(id string) (*stripe.Subscription, error)
+	// Retrieves the invoice with the given id
+	GetInvoice(id string) (*stripe.Invoice, error)
+	// Lists all invoices matching the given parameters, most recently created first
+	ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error)
+	// Attempts to pay the invoice with the given id
+	PayInvoice(id string) (*stripe.Invoice, error)
+	// Previews the next invoice of a subscription, with any changes described by `params` applied
+	UpcomingInvoice(params *stripe.InvoiceParams) (*stripe.Invoice, error)
+	// Retrieves the coupon with the given code
+	GetCoupon(code string) (*stripe.Coupon, error)
+	// Creates a new coupon
+	CreateCoupon(params *stripe.CouponParams) (*stripe.Coupon, error)
+	// Lists all coupons
+	ListCoupons() ([]*stripe.Coupon, error)
+	// Deletes the coupon with the given code. Existing discounts are not affected
+	DeleteCoupon(code string) error
+	// Lists all plans
+	ListPlans() ([]*stripe.Plan, error)
+	// Adds a tax id (e.g. a VAT ID) to a customer
+	CreateTaxID(params *stripe.TaxIDParams) (*stripe.TaxID, error)
+	// Removes the tax id with the given id from a customer
+	DeleteTaxID(customerID string, id string) error
+	// Lists all active tax rates
+	ListTaxRates() ([]*stripe.TaxRate, error)
+	// Creates a new tax rate
+	CreateTaxRate(params *stripe.TaxRateParams) (*stripe.TaxRate, error)
+}
+
+// Stripe implementation of the `BillingProvider` interface
+type stripeBilling struct {
+	client *client.API
+}
+
+func NewStripeBilling(secretKey string) BillingProvider {
+	sc := &client.API{}
+	sc.Init(secretKey, nil)
+	return &stripeBilling{sc}
+}
+
+func (b *stripeBilling) CreateCustomer(email string) (*stripe.Customer, error) {
+	return b.client.Customers.New(&stripe.CustomerParams{
+		Email: &email,
+	})
+}
+
+func (b *stripeBilling) GetCustomer(id string) (*stripe.Customer, error) {
+	return b.client.Customers.Get(id, nil)
+}
+
+func (b *stripeBilling) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return b.client.Customers.Update(id, params)
+}
+
+func (b *stripeBilling) DeleteCustomer(id string) error {
+	_, err := b.client.Customers.Del(id, nil)
+	return err
+}
+
+func (b *stripeBilling) CreateSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return b.client.Subscriptions.New(params)
+}
+
+func (b *stripeBilling) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return b.client.Subscriptions.Update(id, params)
+}
+
+func (b *stripeBilling) CancelSubscription(id string) (*stripe.Subscription, error) {
+	return b.client.Subscriptions.Cancel(id, nil)
+}
+
+func (b *stripeBilling) PauseSubscription(id string, resumesAt time.Time) (*stripe.Subscription, error) {
+	// `pause_collection` isn't supported by this version of the Stripe client yet
+	params := &stripe.SubscriptionParams{}
+	params.AddExtra("pause_collection[behavior]", "void")
+	params.AddExtra("pause_collection[resumes_at]", strconv.FormatInt(resumesAt.Unix(), 10))
+	return b.client.Subscriptions.Update(id, params)
+}
+
+func (b *stripeBilling) ResumeSubscription(id string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	params.AddExtra("pause_collection", "")
+	return b.client.Subscriptions.Update(id, params)
+}
+
+func (b *stripeBilling) GetInvoice(id string) (*stripe.Invoice, error) {
+	return b.client.Invoices.Get(id, nil)
+}
+
+func (b *stripeBilling) ListCustomers(params *stripe.CustomerListParams) ([]*stripe.Customer, error) {
+	var customers []*stripe.Customer
+	i := b.client.Customers.List(params)
+	for i.Next() {
+		customers = append(customers, i.Customer())
+	}
+	return customers, i.Err()
+}
+
+func (b *stripeBilling) ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error) {
+	var invoices []*stripe.Invoice
+	i := b.client.Invoices.List(params)
+	for i.Next() {
+		invoices = append(invoices, i.Invoice())
+	}
+	return invoices, i.Err()
+}
+
+func (b *stripeBilling) PayInvoice(id string) (*stripe.Invoice, error) {
+	return b.client.Invoices.Pay(id, nil)
+}
+
+func (b *stripeBilling) UpcomingInvoice(params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	return b.client.Invoices.GetNext(params)
+}
+
+func (b *stripeBilling) GetCoupon(code string) (*stripe.Coupon, error) {
+	return b.client.Coupons.Get(code, nil)
+}
+
+func (b *stripeBilling) CreateCoupon(params *stripe.CouponParams) (*stripe.Coupon, error) {
+	return b.client.Coupons.New(params)
+}
+
+func (b *stripeBilling) ListCoupons() ([]*stripe.Coupon, error) {
+	var coupons []*stripe.Coupon
+	i := b.client.Coupons.List(nil)
+	for i.Next() {
+		coupons = append(coupons, i.Coupon())
+	}
+	return coupons, i.Err()
+}
+
+func (b *stripeBilling) DeleteCoupon(code string) error {
+	_, err := b.client.Coupons.Del(code, nil)
+	return err
+}
+
+func (b *stripeBilling) ListPlans() ([]*stripe.Plan, error) {
+	var plans []*stripe.Plan
+	i := b.client.Plans.List(nil)
+	for i.Next() {
+		plans = append(plans, i.Plan())
+	}
+	return plans, i.Err()
+}
+
+func (b *stripeBilling) CreateTaxID(params *stripe.TaxIDParams) (*stripe.TaxID, error) {
+	return b.client.TaxIDs.New(params)
+}
+
+func (b *stripeBilling) DeleteTaxID(customerID string, id string) error {
+	_, err := b.client.TaxIDs.Del(id, &stripe.TaxIDParams{
+		Customer: &customerID,
+	})
+	return err
+}
+
+func (b *stripeBilling) ListTaxRates() ([]*stripe.TaxRate, error) {
+	var rates []*stripe.TaxRate
+	active := true
+	i := b.client.TaxRates.List(&stripe.TaxRateListParams{
+		Active: &active,
+	})
+	for i.Next() {
+		rates = append(rates, i.TaxRate())
+	}
+	return rates, i.Err()
+}
+
+func (b *stripeBilling) CreateTaxRate(params *stripe.TaxRateParams) (*stripe.TaxRate, error) {
+	return b.client.TaxRates.New(params)
+}
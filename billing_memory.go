@@ -0,0 +1,870 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go"
+)
+
+// Test tokens recognized by `MemoryBilling`, modeled after Stripe's own test tokens
+const (
+	// Attaching a source with this token fails with a `card_declined` error
+	MemoryBillingDeclinedToken = "tok_chargeDeclined"
+	// Attaching a source with this token succeeds but all subsequent charges fail
+	MemoryBillingChargeFailToken = "tok_chargeCustomerFail"
+)
+
+// In-memory implementation of the `BillingProvider` interface. Mimics the subset of Stripe's
+// behaviour we rely on without making any network calls. Mainly useful for testing
+type MemoryBilling struct {
+	Plans         []*stripe.Plan
+	Coupons       map[string]*stripe.Coupon
+	customers     map[string]*stripe.Customer
+	subscriptions map[string]*stripe.Subscription
+	invoices      map[string]*stripe.Invoice
+	failCharges   map[string]bool
+	pausedUntil   map[string]int64
+	taxRates      []*stripe.TaxRate
+	counter       int
+	mutex         sync.Mutex
+}
+
+func NewMemoryBilling(plans []*stripe.Plan, coupons []*stripe.Coupon) *MemoryBilling {
+	b := &MemoryBilling{
+		Plans:         plans,
+		Coupons:       make(map[string]*stripe.Coupon),
+		customers:     make(map[string]*stripe.Customer),
+		subscriptions: make(map[string]*stripe.Subscription),
+		invoices:      make(map[string]*stripe.Invoice),
+		failCharges:   make(map[string]bool),
+		pausedUntil:   make(map[string]int64),
+	}
+	for _, c := range coupons {
+		b.Coupons[c.ID] = c
+	}
+	return b
+}
+
+func memoryBillingNotFound(kind string, id string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            fmt.Sprintf("No such %s: %s", kind, id),
+	}
+}
+
+func memoryBillingCardDeclined() error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeCard,
+		Code:           stripe.ErrorCodeCardDeclined,
+		HTTPStatusCode: http.StatusPaymentRequired,
+		Msg:            "Your card was declined.",
+	}
+}
+
+func periodEnd(start time.Time, plan *stripe.Plan) time.Time {
+	count := int(plan.IntervalCount)
+	if count == 0 {
+		count = 1
+	}
+	switch plan.Interval {
+	case stripe.PlanIntervalDay:
+		return start.AddDate(0, 0, count)
+	case stripe.PlanIntervalWeek:
+		return start.AddDate(0, 0, 7*count)
+	case stripe.PlanIntervalYear:
+		return start.AddDate(count, 0, 0)
+	default:
+		return start.AddDate(0, count, 0)
+	}
+}
+
+func (b *MemoryBilling) newID(prefix string) string {
+	b.counter = b.counter + 1
+	return fmt.Sprintf("%s_%d", prefix, b.counter)
+}
+
+// Returns a copy of the customer with an up-to-date list of subscriptions so that callers can't
+// accidentally modify the internal state
+func (b *MemoryBilling) customerView(c *stripe.Customer) *stripe.Customer {
+	cv := *c
+	cv.Sources = &stripe.SourceList{}
+	if c.DefaultSource != nil {
+		cv.Sources.Data = []*stripe.PaymentSource{c.DefaultSource}
+	}
+	cv.TaxIDs = &stripe.TaxIDList{}
+	if c.TaxIDs != nil {
+		cv.TaxIDs.Data = append(cv.TaxIDs.Data, c.TaxIDs.Data...)
+	}
+	cv.Subscriptions = &stripe.SubscriptionList{}
+	for _, s := range b.subscriptions {
+		if s.Customer.ID == c.ID && s.Status != stripe.SubscriptionStatusCanceled {
+			cv.Subscriptions.Data = append(cv.Subscriptions.Data, b.subscriptionView(s))
+		}
+	}
+	return &cv
+}
+
+func (b *MemoryBilling) subscriptionView(s *stripe.Subscription) *stripe.Subscription {
+	sv := *s
+	sv.Customer = &stripe.Customer{ID: s.Customer.ID}
+	return &sv
+}
+
+func (b *MemoryBilling) getPlan(id string) (*stripe.Plan, error) {
+	for _, p := range b.Plans {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return nil, memoryBillingNotFound("plan", id)
+}
+
+func (b *MemoryBilling) applyCoupon(s *stripe.Subscription, code *string) error {
+	if code == nil || *code == "" {
+		return nil
+	}
+	c, ok := b.Coupons[*code]
+	if !ok {
+		return memoryBillingNotFound("coupon", *code)
+	}
+	s.Discount = &stripe.Discount{
+		Coupon:       c,
+		Customer:     s.Customer.ID,
+		Start:        time.Now().Unix(),
+		Subscription: s.ID,
+	}
+	return nil
+}
+
+func (b *MemoryBilling) applyTaxRates(s *stripe.Subscription, params *stripe.SubscriptionParams) error {
+	if params.DefaultTaxRates == nil {
+		return nil
+	}
+
+	s.DefaultTaxRates = nil
+	for _, id := range params.DefaultTaxRates {
+		var rate *stripe.TaxRate
+		for _, r := range b.taxRates {
+			if r.ID == *id {
+				rate = r
+			}
+		}
+		if rate == nil {
+			return memoryBillingNotFound("tax_rate", *id)
+		}
+		s.DefaultTaxRates = append(s.DefaultTaxRates, rate)
+	}
+
+	return nil
+}
+
+// Returns the credit for the unused part of the current period of the given subscription
+func (b *MemoryBilling) unusedTime(s *stripe.Subscription, now time.Time) int64 {
+	period := s.CurrentPeriodEnd - s.CurrentPeriodStart
+	remaining := s.CurrentPeriodEnd - now.Unix()
+	if period <= 0 || remaining <= 0 {
+		return 0
+	}
+	return s.Plan.Amount * s.Quantity * remaining / period
+}
+
+// Creates an invoice for the current period of the given subscription and attempts to pay it.
+// `credit` is deducted from the total as a proration line item
+func (b *MemoryBilling) invoiceSubscription(s *stripe.Subscription, credit int64) {
+	inv := b.buildInvoice(s, credit)
+	inv.ID = b.newID("in")
+	inv.Number = inv.ID
+	b.invoices[inv.ID] = inv
+
+	b.chargeInvoice(inv)
+}
+
+func (b *MemoryBilling) buildInvoice(s *stripe.Subscription, credit int64) *stripe.Invoice {
+	amount := s.Plan.Amount * s.Quantity
+	if d := s.Discount; d != nil {
+		amount = amount - d.Coupon.AmountOff - int64(float64(amount)*d.Coupon.PercentOff/100)
+		if amount < 0 {
+			amount = 0
+		}
+	}
+
+	lines := []*stripe.InvoiceLine{{
+		ID:           b.newID("il"),
+		Amount:       amount,
+		Currency:     s.Plan.Currency,
+		Plan:         s.Plan,
+		Quantity:     s.Quantity,
+		Subscription: s.ID,
+		Period: &stripe.Period{
+			Start: s.CurrentPeriodStart,
+			End:   s.CurrentPeriodEnd,
+		},
+	}}
+
+	if credit > 0 {
+		lines = append(lines, &stripe.InvoiceLine{
+			ID:           b.newID("il"),
+			Amount:       -credit,
+			Currency:     s.Plan.Currency,
+			Proration:    true,
+			Subscription: s.ID,
+			Description:  "Unused time",
+		})
+		amount = amount - credit
+		if amount < 0 {
+			amount = 0
+		}
+	}
+
+	var tax int64
+	var taxAmounts []*stripe.InvoiceTaxAmount
+	for _, r := range s.DefaultTaxRates {
+		t := int64(math.Round(float64(amount) * r.Percentage / 100))
+		tax = tax + t
+		taxAmounts = append(taxAmounts, &stripe.InvoiceTaxAmount{
+			Amount:  t,
+			TaxRate: r,
+		})
+	}
+
+	inv := &stripe.Invoice{
+		Customer:        &stripe.Customer{ID: s.Customer.ID},
+		Subscription:    s.ID,
+		Created:         time.Now().Unix(),
+		Currency:        s.Plan.Currency,
+		PeriodStart:     s.CurrentPeriodStart,
+		PeriodEnd:       s.CurrentPeriodEnd,
+		Subtotal:        amount,
+		Tax:             tax,
+		TotalTaxAmounts: taxAmounts,
+		Total:           amount + tax,
+		AmountDue:       amount + tax,
+		Status:          stripe.InvoiceStatusOpen,
+		Lines: &stripe.InvoiceLineList{
+			Data: lines,
+		},
+	}
+
+	if c, ok := b.customers[s.Customer.ID]; ok {
+		inv.CustomerTaxExempt = c.TaxExempt
+		if c.TaxIDs != nil {
+			for _, id := range c.TaxIDs.Data {
+				inv.CustomerTaxIDs = append(inv.CustomerTaxIDs, &stripe.InvoiceCustomerTaxID{
+					Type:  id.Type,
+					Value: id.Value,
+				})
+			}
+		}
+	}
+
+	return inv
+}
+
+func (b *MemoryBilling) chargeInvoice(inv *stripe.Invoice) {
+	c := b.customers[inv.Customer.ID]
+	inv.Attempted = true
+	inv.AttemptCount = inv.AttemptCount + 1
+
+	s := b.subscriptions[inv.Subscription]
+
+	if c.DefaultSource == nil || b.failCharges[c.ID] {
+		if s != nil {
+			s.Status = stripe.SubscriptionStatusPastDue
+		}
+		return
+	}
+
+	inv.Paid = true
+	inv.Status = stripe.InvoiceStatusPaid
+	inv.AmountPaid = inv.AmountDue
+	inv.AmountRemaining = 0
+	if s != nil {
+		s.Status = stripe.SubscriptionStatusActive
+	}
+}
+
+func (b *MemoryBilling) CreateCustomer(email string) (*stripe.Customer, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c := &stripe.Customer{
+		ID:       b.newID("cus"),
+		Email:    email,
+		Created:  time.Now().Unix(),
+		Metadata: make(map[string]string),
+	}
+	b.customers[c.ID] = c
+
+	return b.customerView(c), nil
+}
+
+func (b *MemoryBilling) GetCustomer(id string) (*stripe.Customer, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, ok := b.customers[id]
+	if !ok {
+		return nil, memoryBillingNotFound("customer", id)
+	}
+
+	return b.customerView(c), nil
+}
+
+func (b *MemoryBilling) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, ok := b.customers[id]
+	if !ok {
+		return nil, memoryBillingNotFound("customer", id)
+	}
+
+	if params.Email != nil {
+		c.Email = *params.Email
+	}
+
+	if params.Source != nil && params.Source.Token != nil {
+		token := *params.Source.Token
+		if token == MemoryBillingDeclinedToken {
+			return nil, memoryBillingCardDeclined()
+		}
+		b.failCharges[c.ID] = token == MemoryBillingChargeFailToken
+		c.DefaultSource = &stripe.PaymentSource{
+			ID:   b.newID("card"),
+			Type: stripe.PaymentSourceTypeCard,
+			Card: &stripe.Card{
+				Brand:    stripe.CardBrandVisa,
+				Last4:    "4242",
+				Country:  "US",
+				ExpMonth: 12,
+				ExpYear:  uint16(time.Now().Year() + 2),
+			},
+		}
+		c.DefaultSource.Card.ID = c.DefaultSource.ID
+	}
+
+	if sh := params.Shipping; sh != nil {
+		c.Shipping = &stripe.CustomerShippingDetails{}
+		if sh.Name != nil {
+			c.Shipping.Name = *sh.Name
+		}
+		if a := sh.Address; a != nil {
+			c.Shipping.Address = stripe.Address{
+				Line1:      stripe.StringValue(a.Line1),
+				Line2:      stripe.StringValue(a.Line2),
+				PostalCode: stripe.StringValue(a.PostalCode),
+				City:       stripe.StringValue(a.City),
+				Country:    stripe.StringValue(a.Country),
+			}
+		}
+	}
+
+	if params.TaxExempt != nil {
+		c.TaxExempt = stripe.CustomerTaxExempt(*params.TaxExempt)
+	}
+
+	for k, v := range params.Metadata {
+		c.Metadata[k] = v
+	}
+
+	return b.customerView(c), nil
+}
+
+func (b *MemoryBilling) DeleteCustomer(id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.customers[id]; !ok {
+		return memoryBillingNotFound("customer", id)
+	}
+
+	for sid, s := range b.subscriptions {
+		if s.Customer.ID == id {
+			delete(b.subscriptions, sid)
+		}
+	}
+	delete(b.customers, id)
+
+	return nil
+}
+
+func (b *MemoryBilling) ListCustomers(params *stripe.CustomerListParams) ([]*stripe.Customer, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var customers []*stripe.Customer
+	for _, c := range b.customers {
+		if params != nil && params.Email != nil && *params.Email != c.Email {
+			continue
+		}
+		if params != nil && params.CreatedRange != nil {
+			if r := params.CreatedRange; r.GreaterThanOrEqual != 0 && c.Created < r.GreaterThanOrEqual ||
+				r.LesserThan != 0 && c.Created >= r.LesserThan {
+				continue
+			}
+		}
+		customers = append(customers, b.customerView(c))
+	}
+
+	sort.Slice(customers, func(i, j int) bool {
+		if customers[i].Created != customers[j].Created {
+			return customers[i].Created > customers[j].Created
+		}
+		return customers[i].ID > customers[j].ID
+	})
+
+	return customers, nil
+}
+
+func (b *MemoryBilling) CreateSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	cid := stripe.StringValue(params.Customer)
+	if _, ok := b.customers[cid]; !ok {
+		return nil, memoryBillingNotFound("customer", cid)
+	}
+
+	plan, err := b.getPlan(stripe.StringValue(params.Plan))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s := &stripe.Subscription{
+		ID:                 b.newID("sub"),
+		Customer:           &stripe.Customer{ID: cid},
+		Created:            now.Unix(),
+		StartDate:          now.Unix(),
+		Plan:               plan,
+		Quantity:           1,
+		Metadata:           make(map[string]string),
+		CurrentPeriodStart: now.Unix(),
+	}
+
+	if params.Quantity != nil {
+		s.Quantity = *params.Quantity
+	}
+
+	if err := b.applyCoupon(s, params.Coupon); err != nil {
+		return nil, err
+	}
+
+	if err := b.applyTaxRates(s, params); err != nil {
+		return nil, err
+	}
+
+	var trialEnd time.Time
+	if params.TrialEnd != nil {
+		trialEnd = time.Unix(*params.TrialEnd, 0)
+	} else if stripe.BoolValue(params.TrialFromPlan) && plan.TrialPeriodDays > 0 {
+		trialEnd = now.AddDate(0, 0, int(plan.TrialPeriodDays))
+	}
+
+	if !trialEnd.IsZero() && !stripe.BoolValue(params.TrialEndNow) {
+		s.Status = stripe.SubscriptionStatusTrialing
+		s.TrialStart = now.Unix()
+		s.TrialEnd = trialEnd.Unix()
+		s.CurrentPeriodEnd = trialEnd.Unix()
+	} else {
+		s.CurrentPeriodEnd = periodEnd(now, plan).Unix()
+		b.subscriptions[s.ID] = s
+		b.invoiceSubscription(s, 0)
+	}
+
+	b.subscriptions[s.ID] = s
+
+	return b.subscriptionView(s), nil
+}
+
+func (b *MemoryBilling) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, ok := b.subscriptions[id]
+	if !ok || s.Status == stripe.SubscriptionStatusCanceled {
+		return nil, memoryBillingNotFound("subscription", id)
+	}
+
+	now := time.Now()
+
+	planChanged := false
+	var credit int64
+	if params.Plan != nil && *params.Plan != s.Plan.ID {
+		if s.Status == stripe.SubscriptionStatusActive && stripe.BoolValue(params.Prorate) {
+			credit = b.unusedTime(s, now)
+		}
+		plan, err := b.getPlan(*params.Plan)
+		if err != nil {
+			return nil, err
+		}
+		s.Plan = plan
+		planChanged = true
+	}
+
+	if params.Quantity != nil {
+		s.Quantity = *params.Quantity
+	}
+
+	if err := b.applyCoupon(s, params.Coupon); err != nil {
+		return nil, err
+	}
+
+	if err := b.applyTaxRates(s, params); err != nil {
+		return nil, err
+	}
+
+	if params.CancelAtPeriodEnd != nil {
+		s.CancelAtPeriodEnd = *params.CancelAtPeriodEnd
+	}
+
+	for k, v := range params.Metadata {
+		s.Metadata[k] = v
+	}
+
+	if params.TrialEnd != nil {
+		s.Status = stripe.SubscriptionStatusTrialing
+		s.TrialEnd = *params.TrialEnd
+		s.CurrentPeriodEnd = *params.TrialEnd
+	} else if s.Status == stripe.SubscriptionStatusTrialing && stripe.BoolValue(params.TrialEndNow) || planChanged {
+		s.TrialEnd = now.Unix()
+		s.CurrentPeriodStart = now.Unix()
+		s.CurrentPeriodEnd = periodEnd(now, s.Plan).Unix()
+		b.invoiceSubscription(s, credit)
+	}
+
+	return b.subscriptionView(s), nil
+}
+
+func (b *MemoryBilling) CancelSubscription(id string) (*stripe.Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, ok := b.subscriptions[id]
+	if !ok {
+		return nil, memoryBillingNotFound("subscription", id)
+	}
+
+	s.Status = stripe.SubscriptionStatusCanceled
+	s.CanceledAt = time.Now().Unix()
+	s.EndedAt = s.CanceledAt
+
+	return b.subscriptionView(s), nil
+}
+
+func (b *MemoryBilling) PauseSubscription(id string, resumesAt time.Time) (*stripe.Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, ok := b.subscriptions[id]
+	if !ok || s.Status == stripe.SubscriptionStatusCanceled {
+		return nil, memoryBillingNotFound("subscription", id)
+	}
+
+	b.pausedUntil[id] = resumesAt.Unix()
+
+	return b.subscriptionView(s), nil
+}
+
+func (b *MemoryBilling) ResumeSubscription(id string) (*stripe.Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, ok := b.subscriptions[id]
+	if !ok || s.Status == stripe.SubscriptionStatusCanceled {
+		return nil, memoryBillingNotFound("subscription", id)
+	}
+
+	delete(b.pausedUntil, id)
+
+	return b.subscriptionView(s), nil
+}
+
+func (b *MemoryBilling) GetInvoice(id string) (*stripe.Invoice, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	inv, ok := b.invoices[id]
+	if !ok {
+		return nil, memoryBillingNotFound("invoice", id)
+	}
+
+	invCopy := *inv
+	return &invCopy, nil
+}
+
+func (b *MemoryBilling) ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var invoices []*stripe.Invoice
+	for _, inv := range b.invoices {
+		if params != nil && params.Customer != nil && *params.Customer != inv.Customer.ID {
+			continue
+		}
+		if params != nil && params.Subscription != nil && *params.Subscription != inv.Subscription {
+			continue
+		}
+		if params != nil && params.Status != nil && *params.Status != string(inv.Status) {
+			continue
+		}
+		if params != nil && params.CreatedRange != nil {
+			if r := params.CreatedRange; r.GreaterThanOrEqual != 0 && inv.Created < r.GreaterThanOrEqual ||
+				r.LesserThan != 0 && inv.Created >= r.LesserThan {
+				continue
+			}
+		}
+		invCopy := *inv
+		invoices = append(invoices, &invCopy)
+	}
+
+	// Like Stripe, list the most recent invoices first
+	sort.Slice(invoices, func(i, j int) bool {
+		if invoices[i].Created != invoices[j].Created {
+			return invoices[i].Created > invoices[j].Created
+		}
+		return invoices[i].ID > invoices[j].ID
+	})
+
+	return invoices, nil
+}
+
+func (b *MemoryBilling) PayInvoice(id string) (*stripe.Invoice, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	inv, ok := b.invoices[id]
+	if !ok {
+		return nil, memoryBillingNotFound("invoice", id)
+	}
+
+	if !inv.Paid {
+		b.chargeInvoice(inv)
+		if !inv.Paid {
+			return nil, memoryBillingCardDeclined()
+		}
+	}
+
+	invCopy := *inv
+	return &invCopy, nil
+}
+
+func (b *MemoryBilling) UpcomingInvoice(params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	id := stripe.StringValue(params.Subscription)
+	s, ok := b.subscriptions[id]
+	if !ok || s.Status == stripe.SubscriptionStatusCanceled {
+		return nil, memoryBillingNotFound("subscription", id)
+	}
+
+	// Work on a copy so the preview doesn't affect the actual subscription
+	sv := *s
+	now := time.Now()
+
+	planChanged := false
+	var credit int64
+	if params.SubscriptionPlan != nil && *params.SubscriptionPlan != sv.Plan.ID {
+		plan, err := b.getPlan(*params.SubscriptionPlan)
+		if err != nil {
+			return nil, err
+		}
+		if sv.Status == stripe.SubscriptionStatusActive && stripe.BoolValue(params.SubscriptionProrate) {
+			credit = b.unusedTime(&sv, now)
+		}
+		sv.Plan = plan
+		planChanged = true
+	}
+
+	if params.SubscriptionQuantity != nil {
+		sv.Quantity = *params.SubscriptionQuantity
+	}
+
+	if err := b.applyCoupon(&sv, params.Coupon); err != nil {
+		return nil, err
+	}
+
+	endTrial := params.SubscriptionTrialEnd != nil && *params.SubscriptionTrialEnd <= now.Unix()
+
+	var start time.Time
+	if planChanged || sv.Status == stripe.SubscriptionStatusTrialing && endTrial {
+		start = now
+	} else {
+		start = time.Unix(sv.CurrentPeriodEnd, 0)
+		// Invoices are voided while collection is paused, so the next one that gets paid is the first
+		// one after the pause ends
+		if until, ok := b.pausedUntil[id]; ok && start.Unix() < until {
+			start = time.Unix(until, 0)
+		}
+	}
+	sv.CurrentPeriodStart = start.Unix()
+	sv.CurrentPeriodEnd = periodEnd(start, sv.Plan).Unix()
+
+	inv := b.buildInvoice(&sv, credit)
+	inv.NextPaymentAttempt = start.Unix()
+
+	return inv, nil
+}
+
+func (b *MemoryBilling) GetCoupon(code string) (*stripe.Coupon, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, ok := b.Coupons[code]
+	if !ok {
+		return nil, memoryBillingNotFound("coupon", code)
+	}
+
+	return c, nil
+}
+
+func (b *MemoryBilling) CreateCoupon(params *stripe.CouponParams) (*stripe.Coupon, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	id := stripe.StringValue(params.ID)
+	if id == "" {
+		id = b.newID("coupon")
+	}
+
+	if _, ok := b.Coupons[id]; ok {
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodeResourceAlreadyExists,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("Coupon already exists: %s", id),
+		}
+	}
+
+	c := &stripe.Coupon{
+		ID:               id,
+		Created:          time.Now().Unix(),
+		AmountOff:        stripe.Int64Value(params.AmountOff),
+		Currency:         stripe.Currency(stripe.StringValue(params.Currency)),
+		Duration:         stripe.CouponDuration(stripe.StringValue(params.Duration)),
+		DurationInMonths: stripe.Int64Value(params.DurationInMonths),
+		MaxRedemptions:   stripe.Int64Value(params.MaxRedemptions),
+		Name:             stripe.StringValue(params.Name),
+		PercentOff:       stripe.Float64Value(params.PercentOff),
+		RedeemBy:         stripe.Int64Value(params.RedeemBy),
+		Metadata:         params.Metadata,
+		Valid:            true,
+	}
+	b.Coupons[id] = c
+
+	return c, nil
+}
+
+func (b *MemoryBilling) ListCoupons() ([]*stripe.Coupon, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var coupons []*stripe.Coupon
+	for _, c := range b.Coupons {
+		coupons = append(coupons, c)
+	}
+
+	return coupons, nil
+}
+
+func (b *MemoryBilling) DeleteCoupon(code string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.Coupons[code]; !ok {
+		return memoryBillingNotFound("coupon", code)
+	}
+	delete(b.Coupons, code)
+
+	return nil
+}
+
+func (b *MemoryBilling) ListPlans() ([]*stripe.Plan, error) {
+	return b.Plans, nil
+}
+
+func (b *MemoryBilling) CreateTaxID(params *stripe.TaxIDParams) (*stripe.TaxID, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, ok := b.customers[stripe.StringValue(params.Customer)]
+	if !ok {
+		return nil, memoryBillingNotFound("customer", stripe.StringValue(params.Customer))
+	}
+
+	id := &stripe.TaxID{
+		ID:       b.newID("txi"),
+		Created:  time.Now().Unix(),
+		Customer: &stripe.Customer{ID: c.ID},
+		Type:     stripe.TaxIDType(stripe.StringValue(params.Type)),
+		Value:    stripe.StringValue(params.Value),
+	}
+
+	if c.TaxIDs == nil {
+		c.TaxIDs = &stripe.TaxIDList{}
+	}
+	c.TaxIDs.Data = append(c.TaxIDs.Data, id)
+
+	return id, nil
+}
+
+func (b *MemoryBilling) DeleteTaxID(customerID string, id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, ok := b.customers[customerID]
+	if !ok {
+		return memoryBillingNotFound("customer", customerID)
+	}
+
+	if c.TaxIDs != nil {
+		for i, t := range c.TaxIDs.Data {
+			if t.ID == id {
+				c.TaxIDs.Data = append(c.TaxIDs.Data[:i:i], c.TaxIDs.Data[i+1:]...)
+				return nil
+			}
+		}
+	}
+
+	return memoryBillingNotFound("tax_id", id)
+}
+
+func (b *MemoryBilling) ListTaxRates() ([]*stripe.TaxRate, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var rates []*stripe.TaxRate
+	for _, r := range b.taxRates {
+		if r.Active {
+			rates = append(rates, r)
+		}
+	}
+
+	return rates, nil
+}
+
+func (b *MemoryBilling) CreateTaxRate(params *stripe.TaxRateParams) (*stripe.TaxRate, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	r := &stripe.TaxRate{
+		ID:           b.newID("txr"),
+		Active:       true,
+		Created:      time.Now().Unix(),
+		DisplayName:  stripe.StringValue(params.DisplayName),
+		Jurisdiction: stripe.StringValue(params.Jurisdiction),
+		Percentage:   stripe.Float64Value(params.Percentage),
+		Inclusive:    stripe.BoolValue(params.Inclusive),
+	}
+	b.taxRates = append(b.taxRates, r)
+
+	return r, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+)
+
+func postForm(path string, form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// Runs the `CheckSubscription` middleware for the given account and returns the reported status
+func subStatus(t *testing.T, server *Server, email string) string {
+	w := httptest.NewRecorder()
+	h := (&CheckSubscription{Server: server}).Wrap(pc.HandlerFunc(func(http.ResponseWriter, *http.Request, *pc.AuthToken) error {
+		return nil
+	}))
+	if err := h.Handle(w, httptest.NewRequest("GET", "/", nil), &pc.AuthToken{Email: email}); err != nil {
+		t.Fatal(err)
+	}
+	return w.Header().Get("X-Sub-Status")
+}
+
+func TestMemoryBillingSubscription(t *testing.T) {
+	server := newTestServer(t)
+	a := &pc.AuthToken{Email: "alice@example.com"}
+
+	// New accounts start out with a trial
+	if status := subStatus(t, server, a.Email); status != "trialing" {
+		t.Fatalf("Expected new account to be trialing, got %q", status)
+	}
+
+	if err := (&Subscribe{server}).Handle(httptest.NewRecorder(), postForm("/subscribe/", url.Values{
+		"stripeToken": {MemoryBillingDeclinedToken},
+	}), a); err == nil {
+		t.Fatal("Expected declined card to be rejected")
+	} else if _, ok := err.(*StripeError); !ok {
+		t.Fatalf("Expected StripeError, got %v", err)
+	}
+
+	if status := subStatus(t, server, a.Email); status != "trialing" {
+		t.Errorf("Expected declined card not to change the subscription, got %q", status)
+	}
+
+	if err := (&Subscribe{server}).Handle(httptest.NewRecorder(), postForm("/subscribe/", url.Values{
+		"stripeToken": {"tok_visa"},
+	}), a); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := subStatus(t, server, a.Email); status != "active" {
+		t.Fatalf("Expected subscription to be active, got %q", status)
+	}
+
+	acc, _ := server.GetAccount(a.Email)
+	if acc.GetPaymentSource() == nil {
+		t.Error("Expected payment source to be stored with the account")
+	}
+
+	invoices, err := server.Billing.ListInvoices(&stripe.InvoiceListParams{Customer: &acc.Customer.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invoices) != 1 || !invoices[0].Paid || invoices[0].Total != testPlans[0].Amount {
+		t.Errorf("Expected a single paid invoice, got %+v", invoices)
+	}
+
+	if err := (&UpdateBilling{server}).Handle(httptest.NewRecorder(), postForm("/billing/", url.Values{
+		"name":     {"Alice"},
+		"address1": {"1 Main St"},
+		"zip":      {"12345"},
+		"city":     {"Springfield"},
+		"country":  {"US"},
+	}), a); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, _ = server.GetAccount(a.Email)
+	if info := acc.BillingInfo(); info["name"] != "Alice" || info["city"] != "Springfield" || info["country"] != "US" {
+		t.Errorf("Unexpected billing info: %v", info)
+	}
+
+	c, err := server.Billing.GetCustomer(acc.Customer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Shipping == nil || c.Shipping.Address.Line1 != "1 Main St" {
+		t.Errorf("Expected billing address to be updated with the provider, got %+v", c.Shipping)
+	}
+
+	if err := (&Unsubscribe{server}).Handle(httptest.NewRecorder(), postForm("/unsubscribe/", url.Values{
+		"reason": {string(CancellationReasonPrice)},
+	}), a); err != nil {
+		t.Fatal(err)
+	}
+
+	// The subscription keeps running until the end of the paid period
+	acc, _ = server.GetAccount(a.Email)
+	if s := acc.Subscription(); s == nil || !s.CancelAtPeriodEnd {
+		t.Errorf("Expected subscription to be cancelled at period end, got %+v", s)
+	}
+	if acc.Cancellation == nil || acc.Cancellation.Effective.Before(time.Now()) {
+		t.Errorf("Unexpected cancellation: %+v", acc.Cancellation)
+	}
+	if status := subStatus(t, server, a.Email); status != "active" {
+		t.Errorf("Expected subscription to stay active until the end of the period, got %q", status)
+	}
+
+	// Subscribing again revokes the cancellation
+	if err := (&Subscribe{server}).Handle(httptest.NewRecorder(), postForm("/subscribe/", nil), a); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, _ = server.GetAccount(a.Email)
+	if s := acc.Subscription(); s == nil || s.CancelAtPeriodEnd || acc.Cancellation != nil {
+		t.Errorf("Expected cancellation to be revoked, got %+v", s)
+	}
+
+	if err := (&Unsubscribe{server}).Handle(httptest.NewRecorder(), postForm("/unsubscribe/", url.Values{
+		"reason":      {string(CancellationReasonPrice)},
+		"immediately": {"true"},
+	}), a); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := subStatus(t, server, a.Email); status == "active" || status == "trialing" {
+		t.Errorf("Expected subscription to be cancelled, got %q", status)
+	}
+}
+
+func TestMemoryBillingFailedCharge(t *testing.T) {
+	server := newTestServer(t)
+	a := &pc.AuthToken{Email: "alice@example.com"}
+
+	if err := (&Subscribe{server}).Handle(httptest.NewRecorder(), postForm("/subscribe/", url.Values{
+		"stripeToken": {MemoryBillingChargeFailToken},
+	}), a); err == nil {
+		t.Fatal("Expected failed charge to be reported")
+	} else if _, ok := err.(*StripeError); !ok {
+		t.Fatalf("Expected StripeError, got %v", err)
+	}
+
+	if status := subStatus(t, server, a.Email); status == "active" {
+		t.Fatal("Expected subscription not to be active after a failed charge")
+	}
+
+	// Retrying with a working card goes through
+	if err := (&Subscribe{server}).Handle(httptest.NewRecorder(), postForm("/subscribe/", url.Values{
+		"stripeToken": {"tok_visa"},
+	}), a); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := subStatus(t, server, a.Email); status != "active" {
+		t.Errorf("Expected subscription to be active, got %q", status)
+	}
+}
+
+func TestMemoryBillingListOrder(t *testing.T) {
+	b := NewMemoryBilling(testPlans, nil)
+
+	var ids []string
+	for i := 0; i < 10; i++ {
+		c, _ := b.CreateCustomer("alice@example.com")
+		params := &stripe.CustomerParams{}
+		params.SetSource("tok_visa")
+		b.UpdateCustomer(c.ID, params)
+		b.mutex.Lock()
+		// Spread creation times so that the order doesn't depend on the id tie-breaker
+		b.customers[c.ID].Created = time.Now().Add(time.Duration(i-10) * time.Hour).Unix()
+		b.mutex.Unlock()
+		ids = append(ids, c.ID)
+	}
+
+	customers, err := b.ListCustomers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(customers) != len(ids) {
+		t.Fatalf("Expected %d customers, got %d", len(ids), len(customers))
+	}
+	for i, c := range customers {
+		if c.ID != ids[len(ids)-1-i] {
+			t.Fatalf("Expected customers to be listed most recent first, got %s at position %d", c.ID, i)
+		}
+	}
+
+	plan := testPlans[0].ID
+	for _, id := range ids {
+		if _, err := b.CreateSubscription(&stripe.SubscriptionParams{Customer: &id, Plan: &plan}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.mutex.Lock()
+	var n int64
+	for _, inv := range b.invoices {
+		n = n + 1
+		inv.Created = n * 1000
+	}
+	b.mutex.Unlock()
+
+	for i := 0; i < 3; i++ {
+		invoices, err := b.ListInvoices(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(invoices) != int(n) {
+			t.Fatalf("Expected %d invoices, got %d", n, len(invoices))
+		}
+		for j := 1; j < len(invoices); j++ {
+			if invoices[j-1].Created <= invoices[j].Created {
+				t.Fatalf("Expected invoices to be listed most recent first, got %v", invoices)
+			}
+		}
+	}
+}
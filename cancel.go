@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+)
+
+// Maximum length of the free text feedback given when cancelling
+const maxCancellationFeedback = 2000
+
+type CancellationReason string
+
+const (
+	CancellationReasonPrice          CancellationReason = "price"
+	CancellationReasonMissingFeature CancellationReason = "missing_feature"
+	CancellationReasonSwitching      CancellationReason = "switching_product"
+	CancellationReasonOther          CancellationReason = "other"
+)
+
+func validCancellationReason(reason CancellationReason) bool {
+	switch reason {
+	case "", CancellationReasonPrice, CancellationReasonMissingFeature, CancellationReasonSwitching, CancellationReasonOther:
+		return true
+	default:
+		return false
+	}
+}
+
+// Records a customer's request to cancel their subscription, along with the (optional) reason
+type Cancellation struct {
+	Reason   CancellationReason `json:"reason"`
+	Feedback string             `json:"feedback"`
+	// Time the cancellation was requested
+	Requested time.Time `json:"requested"`
+	// Time the subscription ends (or ended)
+	Effective time.Time `json:"effective"`
+}
+
+type UndoUnsubscribe struct {
+	*Server
+}
+
+func (h *UndoUnsubscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	s := acc.Subscription()
+	if s == nil || !s.CancelAtPeriodEnd {
+		return &pc.BadRequest{Msg: "This subscription is not scheduled to be cancelled"}
+	}
+
+	cancelAtPeriodEnd := false
+	if s_, err := h.Billing.UpdateSubscription(s.ID, &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: &cancelAtPeriodEnd,
+	}); err != nil {
+		return err
+	} else {
+		*s = *s_
+	}
+
+	var reason CancellationReason
+	if acc.Cancellation != nil {
+		reason = acc.Cancellation.Reason
+	}
+	acc.Cancellation = nil
+
+	if err := h.Storage.Put(acc); err != nil {
+		return err
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=unsubscribe-undone", http.StatusFound)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	h.Info.Printf("%s - undo_unsubscribe - %s\n", pc.FormatRequest(r), acc.Email)
+
+	h.Track(&TrackingEvent{
+		Name: "Undo Cancel Subscription",
+		Properties: map[string]interface{}{
+			"Reason": reason,
+		},
+		authToken: a,
+		request:   r,
+	})
+
+	return nil
+}
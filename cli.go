@@ -4,9 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/customer"
 	"gopkg.in/urfave/cli.v1"
 	"gopkg.in/yaml.v2"
 
@@ -16,6 +21,12 @@ import (
 type CliConfig struct {
 	Stripe   StripeConfig   `yaml:"stripe"`
 	Mixpanel MixpanelConfig `yaml:"mixpanel"`
+	Tracking TrackingConfig `yaml:"tracking"`
+	Itunes   ItunesConfig   `yaml:"itunes"`
+	Play     PlayConfig     `yaml:"play"`
+	Pricing  PricingConfig  `yaml:"pricing"`
+	Promo    PromoConfig    `yaml:"promo"`
+	Deletion DeletionConfig `yaml:"deletion"`
 }
 
 func (c *CliConfig) LoadFromFile(path string) error {
@@ -33,6 +44,29 @@ func (c *CliConfig) LoadFromFile(path string) error {
 	return nil
 }
 
+// Replaces a non-empty secret with a placeholder
+func redact(secret *string) {
+	if *secret != "" {
+		*secret = "<redacted>"
+	}
+}
+
+// Returns copies of the given configurations with all secrets redacted, suitable for logging
+func redactConfig(pcConfig pc.CliConfig, config CliConfig) (pc.CliConfig, CliConfig) {
+	redact(&pcConfig.Server.Secret)
+	redact(&pcConfig.Server.SkeletonKey)
+	redact(&pcConfig.Email.Password)
+
+	redact(&config.Stripe.SecretKey)
+	redact(&config.Stripe.WebhookSecret)
+	redact(&config.Tracking.HttpToken)
+	redact(&config.Itunes.SharedSecret)
+	redact(&config.Play.NotificationToken)
+	redact(&config.Promo.AdminSecret)
+
+	return pcConfig, config
+}
+
 type CliApp struct {
 	*pc.CliApp
 	Server *Server
@@ -49,14 +83,25 @@ func (cliApp *CliApp) RunServer(context *cli.Context) error {
 		return err
 	}
 
-	cliApp.Server = NewServer(cliApp.CliApp.Server, &cliApp.Config.Stripe, &cliApp.Config.Mixpanel)
+	cliApp.Server = NewServer(
+		cliApp.CliApp.Server,
+		&cliApp.Config.Stripe,
+		&cliApp.Config.Mixpanel,
+		&cliApp.Config.Tracking,
+		&cliApp.Config.Itunes,
+		&cliApp.Config.Play,
+		&cliApp.Config.Pricing,
+		&cliApp.Config.Promo,
+		&cliApp.Config.Deletion,
+	)
 
 	if err := cliApp.Server.Init(); err != nil {
 		return err
 	}
 
-	cfg, _ := yaml.Marshal(cliApp.CliApp.Config)
-	cfg2, _ := yaml.Marshal(cliApp.Config)
+	pcConfig, config := redactConfig(*cliApp.CliApp.Config, *cliApp.Config)
+	cfg, _ := yaml.Marshal(pcConfig)
+	cfg2, _ := yaml.Marshal(config)
 	cliApp.Server.Info.Printf("Running server with the following configuration:\n%s%s", cfg, cfg2)
 
 	if cliApp.CliApp.Server.Config.Test {
@@ -117,14 +162,58 @@ func (cliApp *CliApp) UpdateAccount(context *cli.Context) error {
 	}
 
 	var err error
-	if acc.Customer, err = customer.Get(cid, nil); err != nil {
+	if acc.Customer, err = NewStripeBilling(cliApp.Config.Stripe.SecretKey).GetCustomer(cid); err != nil {
+		return err
+	}
+
+	if err := cliApp.Storage.Put(acc); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (cliApp *CliApp) GrantAccess(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return errors.New("Please provide an email address!")
+	}
+
+	days := context.Int("days")
+	if days <= 0 {
+		return errors.New("Please provide a positive number of days!")
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	acc := &Account{
+		Email: email,
+	}
+
+	if err := cliApp.Storage.Get(acc); err != nil {
 		return err
 	}
 
+	plan := NewFreePlan(time.Duration(days) * 24 * time.Hour)
+
+	switch EntitlementSource(context.String("source")) {
+	case EntitlementSourceComp:
+		acc.Plans.Comp = plan
+	case EntitlementSourcePromo:
+		acc.Plans.Promo = plan
+	default:
+		return errors.New("Source must be either comp or promo!")
+	}
+
 	if err := cliApp.Storage.Put(acc); err != nil {
 		return err
 	}
 
+	fmt.Printf("Granted access to %s until %s\n", email, plan.Expires.Format(time.RFC3339))
+
 	return nil
 }
 
@@ -143,88 +232,544 @@ func (cliApp *CliApp) DeleteAccount(context *cli.Context) error {
 	return cliApp.Storage.Delete(acc)
 }
 
-func (cliApp *CliApp) SyncCustomers(context *cli.Context) error {
-	tracker := NewMixpanelTracker(cliApp.Config.Mixpanel.Token, cliApp.Storage)
+func (cliApp *CliApp) RestoreAccount(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return errors.New("Please provide an email address!")
+	}
 
 	if err := cliApp.Storage.Open(); err != nil {
 		return err
 	}
 	defer cliApp.Storage.Close()
 
-	params := &stripe.CustomerListParams{}
-	// params.Filters.AddFilter("limit", "", "100")
-	params.Filters.AddFilter("include[]", "", "total_count")
-	i := customer.List(params)
+	acc := &Account{Email: email, billing: NewStripeBilling(cliApp.Config.Stripe.SecretKey)}
+	if err := cliApp.Storage.Get(acc); err == pc.ErrNotFound {
+		return fmt.Errorf("No account found for %s", email)
+	} else if err != nil {
+		return err
+	}
 
-	curr := 0
-	count := i.Meta().TotalCount
-	nupd := 0
-	ndel := 0
-	nretries := 0
+	if acc.Deletion == nil {
+		return fmt.Errorf("Account %s is not scheduled for deletion", email)
+	}
 
-	fmt.Printf("Processing %d customers...\n", count)
+	reactivate := acc.Deletion.CancelledSubscription
+
+	if err := acc.Restore(); err != nil {
+		return err
+	}
 
-	var iter func() error
-	iter = func() error {
-		for i.Next() {
-			curr = curr + 1
-			fmt.Printf("Processing customer %d/%d ... ", curr, count)
+	if err := cliApp.Storage.Put(acc); err != nil {
+		return err
+	}
 
-			c := i.Customer()
-			acc := &Account{Email: c.Email}
+	fmt.Printf("Restored account %s\n", email)
+	if reactivate {
+		fmt.Println("The subscription will be renewed again at the end of the current period.")
+	}
 
-			if err := cliApp.Storage.Get(acc); err == nil {
+	return nil
+}
 
-				if acc.Customer == nil || c.ID == acc.Customer.ID {
+func (cliApp *CliApp) ExportAccount(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return errors.New("Please provide an email address!")
+	}
 
-					fmt.Printf("Found account with matching customer ID: %s; Updating...\n", acc.Email)
-					acc.SetCustomer(c)
-					if err := cliApp.Storage.Put(acc); err != nil {
-						return err
-					}
-					nupd = nupd + 1
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
 
-					go tracker.UpdateProfile(acc, nil)
+	acc := &Account{Email: email}
+	if err := cliApp.Storage.Get(acc); err == pc.ErrNotFound {
+		return fmt.Errorf("No account found for %s", email)
+	} else if err != nil {
+		return err
+	}
 
-				} else {
+	export, err := ExportAccount(cliApp.Storage, NewStripeBilling(cliApp.Config.Stripe.SecretKey), acc)
+	if err != nil {
+		return err
+	}
+
+	path := context.String("output")
+	if path == "" {
+		path = fmt.Sprintf("padlock-export-%s.zip", email)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := export.WriteArchive(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported account %s to %s\n", email, path)
+
+	return nil
+}
+
+func (cliApp *CliApp) ExperimentReport(context *cli.Context) error {
+	filter := context.String("experiment")
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	type variantStats struct {
+		accounts  int
+		converted int
+	}
+
+	// experiment name -> variant name -> stats
+	stats := make(map[string]map[string]*variantStats)
+	var experiments []string
+	variants := make(map[string][]string)
+
+	iter, err := cliApp.Storage.Iterator(&Account{})
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	for iter.Next() {
+		acc := &Account{}
+		if err := iter.Get(acc); err != nil {
+			return err
+		}
+
+		converted := false
+		for _, e := range acc.Entitlements() {
+			if e.Source == EntitlementSourceStripe && e.Tier == EntitlementTierPremium {
+				converted = true
+			}
+		}
+
+		for name, a := range acc.Experiments {
+			if filter != "" && name != filter {
+				continue
+			}
+
+			if stats[name] == nil {
+				stats[name] = make(map[string]*variantStats)
+				experiments = append(experiments, name)
+			}
+
+			vs := stats[name][a.Variant]
+			if vs == nil {
+				vs = &variantStats{}
+				stats[name][a.Variant] = vs
+				variants[name] = append(variants[name], a.Variant)
+			}
+
+			vs.accounts = vs.accounts + 1
+			if converted {
+				vs.converted = vs.converted + 1
+			}
+		}
+	}
+
+	sort.Strings(experiments)
+
+	for _, name := range experiments {
+		fmt.Printf("Experiment: %s\n", name)
+		fmt.Printf("%-20s %10s %10s %10s\n", "Variant", "Accounts", "Converted", "Rate")
+
+		sort.Strings(variants[name])
+		for _, v := range variants[name] {
+			vs := stats[name][v]
+			fmt.Printf("%-20s %10d %10d %9.2f%%\n", v, vs.accounts, vs.converted, 100*float64(vs.converted)/float64(vs.accounts))
+		}
+
+		fmt.Println()
+	}
+
+	return nil
+}
+
+// Returns a short description of the discount granted by a coupon, e.g. "20% off for 3 months"
+func describeCoupon(c *stripe.Coupon) string {
+	var discount string
+	if c.PercentOff != 0 {
+		discount = fmt.Sprintf("%g%% off", c.PercentOff)
+	} else {
+		discount = fmt.Sprintf("%s off", formatCurrency(c.AmountOff, c.Currency))
+	}
+
+	switch c.Duration {
+	case stripe.CouponDurationRepeating:
+		return fmt.Sprintf("%s for %d months", discount, c.DurationInMonths)
+	case stripe.CouponDurationForever:
+		return discount + " forever"
+	default:
+		return discount + " once"
+	}
+}
+
+func (cliApp *CliApp) CreatePromo(context *cli.Context) error {
+	code := context.Args().Get(0)
+	if code == "" {
+		return errors.New("Please provide a coupon code!")
+	}
+
+	percentOff := context.Float64("percent-off")
+	amountOff := context.Int64("amount-off")
+	if (percentOff <= 0) == (amountOff <= 0) {
+		return errors.New("Please provide either a positive percent-off or amount-off!")
+	}
+
+	params := &stripe.CouponParams{
+		ID:       &code,
+		Duration: stripe.String(context.String("duration")),
+	}
+
+	if percentOff > 0 {
+		params.PercentOff = &percentOff
+	} else {
+		params.AmountOff = &amountOff
+		params.Currency = stripe.String(context.String("currency"))
+	}
+
+	switch stripe.CouponDuration(*params.Duration) {
+	case stripe.CouponDurationRepeating:
+		months := context.Int64("months")
+		if months <= 0 {
+			return errors.New("Please provide a positive number of months for repeating coupons!")
+		}
+		params.DurationInMonths = &months
+	case stripe.CouponDurationOnce, stripe.CouponDurationForever:
+	default:
+		return errors.New("Duration must be either once, repeating or forever!")
+	}
+
+	if max := context.Int64("max-redemptions"); max > 0 {
+		params.MaxRedemptions = &max
+	}
+
+	if redeemBy := context.String("redeem-by"); redeemBy != "" {
+		t, err := time.Parse("2006-01-02", redeemBy)
+		if err != nil {
+			return errors.New("Please provide the redeem-by date in the format YYYY-MM-DD!")
+		}
+		params.RedeemBy = stripe.Int64(t.Unix())
+	}
+
+	// Metadata read by `PromoFromCoupon` and promo campaigns
+	for key, flag := range map[string]string{
+		"title":        "title",
+		"description":  "description",
+		"emailSubject": "email-subject",
+		"emailBody":    "email-body",
+	} {
+		if val := context.String(flag); val != "" {
+			params.AddMetadata(key, val)
+		}
+	}
+	if days := context.Int("redeem-within"); days > 0 {
+		params.AddMetadata("redeemWithin", strconv.Itoa(days))
+	}
+
+	coupon, err := NewStripeBilling(cliApp.Config.Stripe.SecretKey).CreateCoupon(params)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created coupon %s: %s\n", coupon.ID, describeCoupon(coupon))
+
+	return nil
+}
+
+func (cliApp *CliApp) ListPromos(context *cli.Context) error {
+	coupons, err := NewStripeBilling(cliApp.Config.Stripe.SecretKey).ListCoupons()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(coupons, func(i, j int) bool {
+		return coupons[i].Created > coupons[j].Created
+	})
+
+	fmt.Printf("%-20s %-30s %-12s %10s %6s  %s\n", "Coupon", "Discount", "Created", "Redeemed", "Valid", "Title")
+	for _, c := range coupons {
+		redeemed := strconv.FormatInt(c.TimesRedeemed, 10)
+		if c.MaxRedemptions > 0 {
+			redeemed = fmt.Sprintf("%d/%d", c.TimesRedeemed, c.MaxRedemptions)
+		}
+		fmt.Printf("%-20s %-30s %-12s %10s %6t  %s\n", c.ID, describeCoupon(c), formatTimeStamp(c.Created), redeemed, c.Valid, c.Metadata["title"])
+	}
+
+	return nil
+}
+
+func (cliApp *CliApp) ShowPromo(context *cli.Context) error {
+	code := context.Args().Get(0)
+	if code == "" {
+		return errors.New("Please provide a coupon code!")
+	}
+
+	promo, err := PromoFromCoupon(NewStripeBilling(cliApp.Config.Stripe.SecretKey), code)
+	if err != nil {
+		return err
+	}
+	c := promo.Coupon
+
+	fmt.Printf("Coupon:         %s\n", c.ID)
+	fmt.Printf("Discount:       %s\n", describeCoupon(c))
+	fmt.Printf("Created:        %s\n", formatTimeStamp(c.Created))
+	if c.RedeemBy != 0 {
+		fmt.Printf("Redeem by:      %s\n", formatTimeStamp(c.RedeemBy))
+	}
+	fmt.Printf("Valid:          %t\n", c.Valid)
+	fmt.Printf("Title:          %s\n", promo.Title)
+	fmt.Printf("Description:    %s\n", promo.Description)
+	if promo.RedeemWithin > 0 {
+		fmt.Printf("Redeem within:  %d days\n", promo.RedeemWithin)
+	}
+	if subject := c.Metadata["emailSubject"]; subject != "" {
+		fmt.Printf("Email subject:  %s\n", subject)
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	var offered, shown, expired, redeemed int
+
+	iter, err := cliApp.Storage.Iterator(&Account{})
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	for iter.Next() {
+		acc := &Account{}
+		if err := iter.Get(acc); err != nil {
+			return err
+		}
+
+		if acc.Promo == nil || acc.Promo.Coupon == nil || acc.Promo.Coupon.ID != code {
+			continue
+		}
+
+		offered = offered + 1
+		if !acc.Promo.Created.IsZero() {
+			shown = shown + 1
+		}
+		if acc.RedeemedCoupon(code) {
+			redeemed = redeemed + 1
+		} else if acc.Promo.Expired() {
+			expired = expired + 1
+		}
+	}
+
+	rate := 0.0
+	if offered != 0 {
+		rate = 100 * float64(redeemed) / float64(offered)
+	}
+
+	fmt.Printf("\nTimes redeemed: %d\n", c.TimesRedeemed)
+	fmt.Printf("Offered:        %d\n", offered)
+	fmt.Printf("Shown:          %d\n", shown)
+	fmt.Printf("Expired:        %d\n", expired)
+	fmt.Printf("Redeemed:       %d (%.2f%%)\n", redeemed, rate)
+
+	return nil
+}
+
+func (cliApp *CliApp) ApplyPromo(context *cli.Context) error {
+	code := context.Args().Get(0)
+	if code == "" {
+		return errors.New("Please provide a coupon code!")
+	}
+
+	path := context.String("file")
+	if path == "" {
+		return errors.New("Please provide a file containing the email addresses!")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	promo, err := PromoFromCoupon(NewStripeBilling(cliApp.Config.Stripe.SecretKey), code)
+	if err != nil {
+		return err
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	napplied := 0
+	nmissing := 0
+
+	// One email address per line. Empty lines and lines starting with "#" are ignored
+	for _, line := range strings.Split(string(data), "\n") {
+		email := strings.TrimSpace(line)
+		if email == "" || strings.HasPrefix(email, "#") {
+			continue
+		}
+
+		acc := &Account{Email: email}
+		if err := cliApp.Storage.Get(acc); err == pc.ErrNotFound {
+			fmt.Printf("Account not found: %s\n", email)
+			nmissing = nmissing + 1
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Accounts that already have this promo keep it, along with their redemption window
+		if acc.OfferPromo(promo) {
+			if err := cliApp.Storage.Put(acc); err != nil {
+				return err
+			}
+		}
+		napplied = napplied + 1
+	}
 
-					fmt.Printf("Found account with different customer ID: %s; Deleting stripe customer...\n", acc.Email)
+	fmt.Printf("Applied promo %s to %d accounts (%d not found)\n", code, napplied, nmissing)
+
+	return nil
+}
+
+func (cliApp *CliApp) RevokePromo(context *cli.Context) error {
+	code := context.Args().Get(0)
+	if code == "" {
+		return errors.New("Please provide a coupon code!")
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	iter, err := cliApp.Storage.Iterator(&Account{})
+	if err != nil {
+		return err
+	}
+
+	// Collect accounts first so we don't modify the storage while iterating over it
+	var accs []*Account
+	for iter.Next() {
+		acc := &Account{}
+		if err := iter.Get(acc); err != nil {
+			iter.Release()
+			return err
+		}
+		if acc.Promo != nil && acc.Promo.Coupon != nil && acc.Promo.Coupon.ID == code {
+			accs = append(accs, acc)
+		}
+	}
+	iter.Release()
+
+	for _, acc := range accs {
+		acc.Promo = nil
+		if err := cliApp.Storage.Put(acc); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Revoked promo %s from %d accounts\n", code, len(accs))
+
+	if context.Bool("delete-coupon") {
+		if err := NewStripeBilling(cliApp.Config.Stripe.SecretKey).DeleteCoupon(code); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted coupon %s\n", code)
+	}
+
+	return nil
+}
+
+func (cliApp *CliApp) SyncCustomers(context *cli.Context) error {
+	tracker, err := NewTracker(&cliApp.Config.Tracking, &cliApp.Config.Mixpanel, cliApp.Storage, log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime))
+	if err != nil {
+		return err
+	}
+	defer CloseTracker(tracker)
+	billing := NewStripeBilling(cliApp.Config.Stripe.SecretKey)
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	var customers []*stripe.Customer
+	for nretries := 0; ; nretries++ {
+		if customers, err = billing.ListCustomers(&stripe.CustomerListParams{}); err == nil {
+			break
+		} else if nretries >= 100 {
+			return err
+		}
+		fmt.Printf("Encountered error %v - retrying (%d/100)\n", err, nretries+1)
+	}
+
+	count := len(customers)
+	nupd := 0
+	ndel := 0
+
+	fmt.Printf("Processing %d customers...\n", count)
 
-					if c.DefaultSource != nil {
-						fmt.Println("Customer has payment source! Bailing...")
-					} else {
-						ndel = ndel + 1
-						go customer.Del(c.ID, nil)
-					}
+	for i, c := range customers {
+		fmt.Printf("Processing customer %d/%d ... ", i+1, count)
 
+		acc := &Account{Email: c.Email}
+
+		if err := cliApp.Storage.Get(acc); err == nil {
+
+			if acc.Customer == nil || c.ID == acc.Customer.ID {
+
+				fmt.Printf("Found account with matching customer ID: %s; Updating...\n", acc.Email)
+				acc.SetCustomer(c)
+				if err := cliApp.Storage.Put(acc); err != nil {
+					return err
 				}
-			} else if err == pc.ErrNotFound {
+				nupd = nupd + 1
+
+				tracker.UpdateProfile(acc, nil)
+
+			} else {
 
-				fmt.Printf("Account not found: %s; Deleting stripe customer...\n", acc.Email)
+				fmt.Printf("Found account with different customer ID: %s; Deleting stripe customer...\n", acc.Email)
 
 				if c.DefaultSource != nil {
 					fmt.Println("Customer has payment source! Bailing...")
 				} else {
 					ndel = ndel + 1
-					go customer.Del(c.ID, nil)
+					go billing.DeleteCustomer(c.ID)
 				}
 
-			} else {
-				return err
 			}
-		}
+		} else if err == pc.ErrNotFound {
 
-		if err := i.Err(); err != nil && nretries < 100 {
-			nretries = nretries + 1
-			fmt.Printf("Encountered error %v - retrying (%d/100)\n", err, nretries)
-			return iter()
-		}
+			fmt.Printf("Account not found: %s; Deleting stripe customer...\n", acc.Email)
 
-		return nil
-	}
+			if c.DefaultSource != nil {
+				fmt.Println("Customer has payment source! Bailing...")
+			} else {
+				ndel = ndel + 1
+				go billing.DeleteCustomer(c.ID)
+			}
 
-	if err := iter(); err != nil {
-		return err
+		} else {
+			return err
+		}
 	}
 
 	fmt.Printf("Customers Updated: %d\nCustomers Deleted: %d\n", nupd, ndel)
@@ -254,6 +799,20 @@ func NewCliApp() *CliApp {
 			EnvVar:      "PC_STRIPE_PUBLIC_KEY",
 			Destination: &config.Stripe.PublicKey,
 		},
+		cli.StringFlag{
+			Name:        "stripe-webhook-secret",
+			Value:       "",
+			Usage:       "Secret for verifying Stripe webhook signatures",
+			EnvVar:      "PC_STRIPE_WEBHOOK_SECRET",
+			Destination: &config.Stripe.WebhookSecret,
+		},
+		cli.IntFlag{
+			Name:        "stripe-webhook-tolerance",
+			Value:       0,
+			Usage:       "Maximum age of Stripe webhook signatures in seconds (default 300)",
+			EnvVar:      "PC_STRIPE_WEBHOOK_TOLERANCE",
+			Destination: &config.Stripe.WebhookTolerance,
+		},
 		cli.StringFlag{
 			Name:        "mixpanel-token",
 			Value:       "",
@@ -261,6 +820,130 @@ func NewCliApp() *CliApp {
 			EnvVar:      "PC_MIXPANEL_TOKEN",
 			Destination: &config.Mixpanel.Token,
 		},
+		cli.StringSliceFlag{
+			Name:   "tracking-backend",
+			Usage:  "Tracking backend to send events to (mixpanel, noop, file or http). Can be repeated to send events to multiple backends",
+			EnvVar: "PC_TRACKING_BACKENDS",
+		},
+		cli.StringFlag{
+			Name:        "tracking-file",
+			Value:       "",
+			Usage:       "File the file tracking backend appends events to",
+			EnvVar:      "PC_TRACKING_FILE",
+			Destination: &config.Tracking.File,
+		},
+		cli.StringFlag{
+			Name:        "tracking-http-url",
+			Value:       "",
+			Usage:       "Url the http tracking backend posts events to",
+			EnvVar:      "PC_TRACKING_HTTP_URL",
+			Destination: &config.Tracking.HttpUrl,
+		},
+		cli.StringFlag{
+			Name:        "tracking-http-token",
+			Value:       "",
+			Usage:       "Bearer token the http tracking backend authenticates with",
+			EnvVar:      "PC_TRACKING_HTTP_TOKEN",
+			Destination: &config.Tracking.HttpToken,
+		},
+		cli.StringFlag{
+			Name:        "tracking-spool-dir",
+			Value:       "",
+			Usage:       "Directory for spooling tracking events that can't be delivered right away",
+			EnvVar:      "PC_TRACKING_SPOOL_DIR",
+			Destination: &config.Tracking.Queue.SpoolDir,
+		},
+		cli.StringFlag{
+			Name:        "tracking-catalog",
+			Value:       "",
+			Usage:       "YAML file describing the events accepted by the /track/ endpoint",
+			EnvVar:      "PC_TRACKING_CATALOG",
+			Destination: &config.Tracking.Catalog,
+		},
+		cli.IntFlag{
+			Name:        "tracking-rate-limit-ip",
+			Value:       defaultTrackingRateLimitIP,
+			Usage:       "Maximum number of tracking events accepted per minute from a single IP address",
+			EnvVar:      "PC_TRACKING_RATE_LIMIT_IP",
+			Destination: &config.Tracking.RateLimitIP,
+		},
+		cli.IntFlag{
+			Name:        "tracking-rate-limit-tid",
+			Value:       defaultTrackingRateLimitTrackingID,
+			Usage:       "Maximum number of tracking events accepted per minute for a single tracking id",
+			EnvVar:      "PC_TRACKING_RATE_LIMIT_TID",
+			Destination: &config.Tracking.RateLimitTrackingID,
+		},
+		cli.StringFlag{
+			Name:        "itunes-shared-secret",
+			Value:       "",
+			Usage:       "Shared secret for validating App Store receipts",
+			EnvVar:      "PC_ITUNES_SHARED_SECRET",
+			Destination: &config.Itunes.SharedSecret,
+		},
+		cli.StringFlag{
+			Name:        "itunes-environment",
+			Value:       "sandbox",
+			Usage:       "App Store environment (production or sandbox)",
+			EnvVar:      "PC_ITUNES_ENVIRONMENT",
+			Destination: &config.Itunes.Environment,
+		},
+		cli.StringFlag{
+			Name:        "itunes-verify-url",
+			Value:       "",
+			Usage:       "Explicit url for validating App Store receipts (e.g. for testing)",
+			EnvVar:      "PC_ITUNES_VERIFY_URL",
+			Destination: &config.Itunes.VerifyUrl,
+		},
+		cli.StringFlag{
+			Name:        "play-package-name",
+			Value:       "",
+			Usage:       "Package name of the Android app",
+			EnvVar:      "PC_PLAY_PACKAGE_NAME",
+			Destination: &config.Play.PackageName,
+		},
+		cli.StringFlag{
+			Name:        "play-service-account-file",
+			Value:       "",
+			Usage:       "Path to service account key file for accessing the Play Developer API",
+			EnvVar:      "PC_PLAY_SERVICE_ACCOUNT_FILE",
+			Destination: &config.Play.ServiceAccountFile,
+		},
+		cli.StringFlag{
+			Name:        "play-base-url",
+			Value:       "",
+			Usage:       "Explicit base url for the Play Developer API (e.g. for testing)",
+			EnvVar:      "PC_PLAY_BASE_URL",
+			Destination: &config.Play.BaseUrl,
+		},
+		cli.StringFlag{
+			Name:        "play-notification-token",
+			Value:       "",
+			Usage:       "Secret token required for real-time developer notifications",
+			EnvVar:      "PC_PLAY_NOTIFICATION_TOKEN",
+			Destination: &config.Play.NotificationToken,
+		},
+		cli.StringFlag{
+			Name:        "admin-secret",
+			Value:       "",
+			Usage:       "Secret required for accessing admin endpoints like /apply-promo/",
+			EnvVar:      "PC_ADMIN_SECRET",
+			Destination: &config.Promo.AdminSecret,
+		},
+		cli.IntFlag{
+			Name:        "promo-send-rate",
+			Value:       0,
+			Usage:       "Maximum number of promo campaign emails sent per minute (default 30)",
+			EnvVar:      "PC_PROMO_SEND_RATE",
+			Destination: &config.Promo.SendRate,
+		},
+		cli.IntFlag{
+			Name:        "deletion-grace-period",
+			Value:       0,
+			Usage:       "Number of days after which accounts scheduled for deletion are deleted for good (default 30)",
+			EnvVar:      "PC_DELETION_GRACE_PERIOD",
+			Destination: &config.Deletion.GracePeriod,
+		},
 	}...)
 
 	runserverCmd := &app.Commands[0]
@@ -288,16 +971,162 @@ func NewCliApp() *CliApp {
 						},
 					},
 				},
+				{
+					Name:   "grant",
+					Usage:  "Grant free access to a given account",
+					Action: app.GrantAccess,
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "days",
+							Value: 30,
+							Usage: "Number of days to grant access for",
+						},
+						cli.StringFlag{
+							Name:  "source",
+							Value: "comp",
+							Usage: "Source of the grant (comp or promo)",
+						},
+					},
+				},
 				{
 					Name:   "delete",
 					Usage:  "Delete account",
 					Action: app.DeleteAccount,
 				},
+				{
+					Name:      "restore",
+					Usage:     "Cancel the scheduled deletion of an account",
+					ArgsUsage: "<email>",
+					Action:    app.RestoreAccount,
+				},
+				{
+					Name:      "export",
+					Usage:     "Export all data stored about an account as a zip archive",
+					ArgsUsage: "<email>",
+					Action:    app.ExportAccount,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "File to write the archive to. Defaults to padlock-export-<email>.zip",
+						},
+					},
+				},
 				{
 					Name:   "sync",
 					Usage:  "Sync Stripe Customers",
 					Action: app.SyncCustomers,
 				},
+				{
+					Name:   "experiments",
+					Usage:  "Report conversion rates per pricing experiment variant",
+					Action: app.ExperimentReport,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "experiment",
+							Value: "",
+							Usage: "Only report on the experiment with the given name",
+						},
+					},
+				},
+				{
+					Name:  "promo",
+					Usage: "Commands for managing promotions",
+					Subcommands: []cli.Command{
+						{
+							Name:      "create",
+							Usage:     "Create a coupon for a new promotion",
+							ArgsUsage: "<coupon>",
+							Action:    app.CreatePromo,
+							Flags: []cli.Flag{
+								cli.Float64Flag{
+									Name:  "percent-off",
+									Usage: "Discount in percent",
+								},
+								cli.Int64Flag{
+									Name:  "amount-off",
+									Usage: "Discount in the smallest currency unit (e.g. cents)",
+								},
+								cli.StringFlag{
+									Name:  "currency",
+									Value: "eur",
+									Usage: "Currency of amount-off",
+								},
+								cli.StringFlag{
+									Name:  "duration",
+									Value: "once",
+									Usage: "How long the discount applies (once, repeating or forever)",
+								},
+								cli.Int64Flag{
+									Name:  "months",
+									Usage: "Number of months the discount applies for repeating coupons",
+								},
+								cli.Int64Flag{
+									Name:  "max-redemptions",
+									Usage: "Maximum number of times the coupon can be redeemed",
+								},
+								cli.StringFlag{
+									Name:  "redeem-by",
+									Usage: "Date after which the coupon can no longer be redeemed (YYYY-MM-DD)",
+								},
+								cli.StringFlag{
+									Name:  "title",
+									Usage: "Title shown to customers",
+								},
+								cli.StringFlag{
+									Name:  "description",
+									Usage: "Description shown to customers",
+								},
+								cli.IntFlag{
+									Name:  "redeem-within",
+									Usage: "Number of days the promo can be redeemed after it was first shown",
+								},
+								cli.StringFlag{
+									Name:  "email-subject",
+									Usage: "Subject of the email announcing the promo",
+								},
+								cli.StringFlag{
+									Name:  "email-body",
+									Usage: "Body of the email announcing the promo. {{link}} is replaced with a login link",
+								},
+							},
+						},
+						{
+							Name:   "list",
+							Usage:  "List all coupons",
+							Action: app.ListPromos,
+						},
+						{
+							Name:      "show",
+							Usage:     "Show details and redemption statistics of a promotion",
+							ArgsUsage: "<coupon>",
+							Action:    app.ShowPromo,
+						},
+						{
+							Name:      "apply",
+							Usage:     "Apply a promotion to a list of accounts",
+							ArgsUsage: "<coupon>",
+							Action:    app.ApplyPromo,
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:  "file",
+									Usage: "File containing one email address per line",
+								},
+							},
+						},
+						{
+							Name:      "revoke",
+							Usage:     "Remove a promotion from all accounts it was offered to",
+							ArgsUsage: "<coupon>",
+							Action:    app.RevokePromo,
+							Flags: []cli.Flag{
+								cli.BoolFlag{
+									Name:  "delete-coupon",
+									Usage: "Also delete the coupon. Existing discounts are not affected",
+								},
+							},
+						},
+					},
+				},
 			},
 		},
 	}...)
@@ -312,6 +1141,9 @@ func NewCliApp() *CliApp {
 			if err := config.LoadFromFile(app.ConfigPath); err != nil {
 				return err
 			}
+		} else {
+			// Slice flags don't support destinations
+			config.Tracking.Backends = context.StringSlice("tracking-backend")
 		}
 
 		stripe.Key = config.Stripe.SecretKey
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/stripe/stripe-go"
+)
+
+// Available plans grouped by currency. Each group offers the same plans, priced in its currency
+var PlanGroups map[stripe.Currency][]*stripe.Plan
+
+// Currency used if no other currency can be determined for a customer. This is the currency of
+// the first available plan
+var DefaultCurrency stripe.Currency
+
+// Currencies used in countries outside the euro zone that we may offer plans in. Countries not
+// listed here fall back to the default currency
+var countryCurrencies = map[string]stripe.Currency{
+	"US": stripe.CurrencyUSD,
+	"GB": stripe.CurrencyGBP,
+	"CH": stripe.CurrencyCHF,
+	"LI": stripe.CurrencyCHF,
+	"CA": stripe.CurrencyCAD,
+	"AU": stripe.CurrencyAUD,
+	"NZ": stripe.CurrencyNZD,
+	"JP": stripe.CurrencyJPY,
+	"SE": stripe.CurrencySEK,
+	"NO": stripe.CurrencyNOK,
+	"DK": stripe.CurrencyDKK,
+	"PL": stripe.CurrencyPLN,
+}
+
+var euroCountries = map[string]bool{
+	"AT": true, "BE": true, "CY": true, "DE": true, "EE": true, "ES": true, "FI": true,
+	"FR": true, "GR": true, "HR": true, "IE": true, "IT": true, "LT": true, "LU": true,
+	"LV": true, "MT": true, "NL": true, "PT": true, "SI": true, "SK": true,
+	"AD": true, "MC": true, "ME": true, "SM": true, "VA": true,
+}
+
+// Sets up `PlanGroups` and `DefaultCurrency` from `AvailablePlans`
+func InitPlanGroups() {
+	PlanGroups = make(map[stripe.Currency][]*stripe.Plan)
+	for _, plan := range AvailablePlans {
+		PlanGroups[plan.Currency] = append(PlanGroups[plan.Currency], plan)
+	}
+	DefaultCurrency = AvailablePlans[0].Currency
+}
+
+// Returns the currency with the given code if there are plans available in it
+func ParseCurrency(code string) (stripe.Currency, bool) {
+	currency := stripe.Currency(strings.ToLower(code))
+	_, ok := PlanGroups[currency]
+	return currency, ok
+}
+
+// Returns the currency customers in the given country should be billed in, if we offer plans in it
+func currencyForCountry(country string) (stripe.Currency, bool) {
+	country = strings.ToUpper(country)
+	currency, ok := countryCurrencies[country]
+	if !ok && euroCountries[country] {
+		currency, ok = stripe.CurrencyEUR, true
+	}
+	if !ok {
+		return "", false
+	}
+	_, ok = PlanGroups[currency]
+	return currency, ok
+}
+
+// Returns the plan in the given currency corresponding to `plan`. Plans in different currencies
+// are matched through the `tier` metadata field or, if not set, their billing interval. Returns
+// `nil` if there is no matching plan
+func equivalentPlan(plan *stripe.Plan, currency stripe.Currency) *stripe.Plan {
+	if plan.Currency == currency {
+		return plan
+	}
+
+	for _, p := range PlanGroups[currency] {
+		if tier := plan.Metadata["tier"]; tier != "" {
+			if p.Metadata["tier"] == tier {
+				return p
+			}
+		} else if p.Interval == plan.Interval && p.IntervalCount == plan.IntervalCount {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// Returns the plans available in the given currency, falling back to the default currency
+func PlansForCurrency(currency stripe.Currency) []*stripe.Plan {
+	if plans, ok := PlanGroups[currency]; ok {
+		return plans
+	}
+	return PlanGroups[DefaultCurrency]
+}
+
+// Returns the currency the account should be billed in. Once Stripe has billed a customer, their
+// currency can't be changed anymore. Otherwise the currency is taken from (in that order) an
+// explicit choice, the billing address and the country the card was issued in
+func (acc *Account) Currency() stripe.Currency {
+	c := acc.Customer
+
+	if c != nil && c.Currency != "" {
+		return c.Currency
+	}
+
+	if acc.PreferredCurrency != "" {
+		if _, ok := PlanGroups[acc.PreferredCurrency]; ok {
+			return acc.PreferredCurrency
+		}
+	}
+
+	if currency, ok := currencyForCountry(acc.BillingInfo()["country"]); ok {
+		return currency
+	}
+
+	if c != nil && len(c.Sources.Data) != 0 && c.Sources.Data[0].Card != nil {
+		if currency, ok := currencyForCountry(c.Sources.Data[0].Card.Country); ok {
+			return currency
+		}
+	}
+
+	return DefaultCurrency
+}
+
+// Returns the plan in the account's currency corresponding to `plan`, or the first plan in that
+// currency if there is no direct equivalent
+func (acc *Account) LocalizePlan(plan *stripe.Plan) *stripe.Plan {
+	currency := acc.Currency()
+	if p := equivalentPlan(plan, currency); p != nil {
+		return p
+	}
+	return PlansForCurrency(currency)[0]
+}
+
+// Number formatting conventions of a locale
+type numberFormat struct {
+	Decimal     string
+	Group       string
+	SymbolFirst bool
+}
+
+var (
+	numberFormatEN = &numberFormat{Decimal: ".", Group: ",", SymbolFirst: true}
+	numberFormatDE = &numberFormat{Decimal: ",", Group: ".", SymbolFirst: false}
+	numberFormatNL = &numberFormat{Decimal: ",", Group: ".", SymbolFirst: true}
+	numberFormatFR = &numberFormat{Decimal: ",", Group: " ", SymbolFirst: false}
+	numberFormatCH = &numberFormat{Decimal: ".", Group: "'", SymbolFirst: true}
+)
+
+// Number formats by country. Countries not listed here use `numberFormatEN`
+var countryNumberFormats = map[string]*numberFormat{
+	"AT": numberFormatDE,
+	"BE": numberFormatNL,
+	"DE": numberFormatDE,
+	"DK": numberFormatDE,
+	"ES": numberFormatDE,
+	"FI": numberFormatFR,
+	"FR": numberFormatFR,
+	"GR": numberFormatDE,
+	"HR": numberFormatDE,
+	"IT": numberFormatDE,
+	"LU": numberFormatFR,
+	"NL": numberFormatNL,
+	"NO": numberFormatFR,
+	"PL": numberFormatFR,
+	"PT": numberFormatFR,
+	"SE": numberFormatFR,
+	"SI": numberFormatDE,
+	"CH": numberFormatCH,
+	"LI": numberFormatCH,
+}
+
+// Locale used for formatting amounts in a currency if no locale is given
+var currencyLocales = map[stripe.Currency]string{
+	stripe.CurrencyEUR: "DE",
+	stripe.CurrencyUSD: "US",
+	stripe.CurrencyGBP: "GB",
+	stripe.CurrencyCHF: "CH",
+	stripe.CurrencySEK: "SE",
+	stripe.CurrencyNOK: "NO",
+	stripe.CurrencyDKK: "DK",
+	stripe.CurrencyPLN: "PL",
+}
+
+var currencySymbols = map[stripe.Currency]string{
+	stripe.CurrencyEUR: "€",
+	stripe.CurrencyUSD: "$",
+	stripe.CurrencyGBP: "£",
+	stripe.CurrencyJPY: "¥",
+	stripe.CurrencyCAD: "CA$",
+	stripe.CurrencyAUD: "A$",
+	stripe.CurrencyNZD: "NZ$",
+	stripe.CurrencySEK: "kr",
+	stripe.CurrencyNOK: "kr",
+	stripe.CurrencyDKK: "kr.",
+	stripe.CurrencyPLN: "zł",
+}
+
+// Currencies without minor units, i.e. amounts are given in whole units
+var zeroDecimalCurrencies = map[stripe.Currency]bool{
+	stripe.CurrencyJPY: true,
+	stripe.CurrencyKRW: true,
+}
+
+// Returns the number format for the given locale, which can be either a country code ("DE") or a
+// language tag including the region ("de-DE", "de_DE")
+func localeNumberFormat(locale string) *numberFormat {
+	if i := strings.LastIndexAny(locale, "-_"); i != -1 {
+		locale = locale[i+1:]
+	}
+	if f, ok := countryNumberFormats[strings.ToUpper(locale)]; ok {
+		return f
+	}
+	return numberFormatEN
+}
+
+// Formats an amount given in the smallest currency unit, e.g. "1.234,56 €". The number format
+// follows the given locale or, if omitted, the conventions of the currency's home country
+func formatCurrencyLocale(amount int64, currency stripe.Currency, locale string) string {
+	if locale == "" {
+		locale = currencyLocales[currency]
+	}
+	f := localeNumberFormat(locale)
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	units, cents := amount/100, amount%100
+	if zeroDecimalCurrencies[currency] {
+		units, cents = amount, 0
+	}
+
+	digits := strconv.FormatInt(units, 10)
+	var b strings.Builder
+	for i, d := range digits {
+		if i != 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(f.Group)
+		}
+		b.WriteRune(d)
+	}
+
+	number := b.String()
+	if !zeroDecimalCurrencies[currency] {
+		number = fmt.Sprintf("%s%s%02d", number, f.Decimal, cents)
+	}
+
+	symbol, ok := currencySymbols[currency]
+	if !ok {
+		symbol = strings.ToUpper(string(currency))
+	}
+
+	if f.SymbolFirst {
+		// Separate alphabetic symbols like "CHF" or "kr" from the number
+		if r, _ := utf8.DecodeLastRuneInString(symbol); unicode.IsLetter(r) || r == '.' {
+			symbol = symbol + " "
+		}
+		return sign + symbol + number
+	}
+
+	return sign + number + " " + symbol
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+)
+
+// Number of days accounts are kept around after deletion was requested if not configured otherwise
+const defaultDeletionGracePeriod = 30
+
+type DeletionConfig struct {
+	// Number of days after which accounts scheduled for deletion are deleted for good. Defaults to 30
+	GracePeriod int `yaml:"grace_period"`
+}
+
+// Describes an account that is scheduled for deletion. Until the grace period runs out, the account
+// can be restored with everything in it
+type PendingDeletion struct {
+	Requested time.Time `json:"requested"`
+	DeletesAt time.Time `json:"deletesAt"`
+	// Whether the subscription was set to cancel at period end as part of the deletion, in which case
+	// it is reactivated when the account is restored
+	CancelledSubscription bool `json:"cancelledSubscription"`
+}
+
+// Whether the grace period has run out
+func (d *PendingDeletion) Due() bool {
+	return !d.DeletesAt.After(time.Now())
+}
+
+// Whether the account has a subscription that will renew at the end of the current period
+func (acc *Account) hasRenewingSubscription() bool {
+	s := acc.Subscription()
+	return s != nil && !s.CancelAtPeriodEnd &&
+		s.Status != stripe.SubscriptionStatusCanceled && s.Status != stripe.SubscriptionStatusIncompleteExpired
+}
+
+// Cancels the account's subscription at the end of the current period and marks the account as
+// pending deletion. The account is deleted for good after `days` days unless it is restored
+func (acc *Account) ScheduleDeletion(days int) error {
+	now := time.Now()
+	acc.Deletion = &PendingDeletion{
+		Requested: now,
+		DeletesAt: now.AddDate(0, 0, days),
+	}
+
+	if acc.hasRenewingSubscription() {
+		s := acc.Subscription()
+		cancelAtPeriodEnd := true
+		s_, err := acc.billing.UpdateSubscription(s.ID, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: &cancelAtPeriodEnd,
+		})
+		if err != nil {
+			return err
+		}
+		*s = *s_
+		acc.Deletion.CancelledSubscription = true
+	}
+
+	return nil
+}
+
+// Cancels a scheduled deletion, reactivating the subscription if it was cancelled as part of it
+func (acc *Account) Restore() error {
+	if acc.Deletion == nil {
+		return nil
+	}
+
+	if s := acc.Subscription(); s != nil && acc.Deletion.CancelledSubscription && s.CancelAtPeriodEnd &&
+		s.Status != stripe.SubscriptionStatusCanceled {
+		cancelAtPeriodEnd := false
+		s_, err := acc.billing.UpdateSubscription(s.ID, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: &cancelAtPeriodEnd,
+		})
+		if err != nil {
+			return err
+		}
+		*s = *s_
+	}
+
+	acc.Deletion = nil
+
+	return nil
+}
+
+func (server *Server) deletionGracePeriod() int {
+	if days := server.DeletionConfig.GracePeriod; days > 0 {
+		return days
+	}
+	return defaultDeletionGracePeriod
+}
+
+// Deletes the account for good, along with the Stripe customer, the tracking profile and the
+// padlock-cloud account
+func (server *Server) PurgeAccount(acc *Account) error {
+	if err := server.LeaveGroup(acc); err != nil {
+		server.Error.Printf("Error while removing %s from group: %v", acc.Email, err)
+	}
+
+	if acc.Customer != nil {
+		if c, err := server.Billing.GetCustomer(acc.Customer.ID); err != nil {
+			server.Error.Printf("Error while fetching customer for %s: %v", acc.Email, err)
+		} else {
+			_, migrated := c.Metadata["account"]
+			// Only delete stripe customer if the account has not been migrated to Padloc 3
+			if !migrated {
+				if err := server.Billing.DeleteCustomer(c.ID); err != nil {
+					server.Error.Printf("Error while deleting customer for %s: %v", acc.Email, err)
+				}
+			}
+		}
+	}
+
+	if err := server.DeleteProfile(acc); err != nil {
+		server.Error.Printf("Error while deleting tracking profile for %s: %v", acc.Email, err)
+	}
+
+	if err := server.Storage.Delete(acc); err != nil {
+		return err
+	}
+
+	if err := server.DeleteAccount(acc.Email); err != nil {
+		return err
+	}
+
+	if err := server.SendEmail(acc.Email, "Padlock Account Deletion", server.Templates.AccountDeletedEmail, map[string]interface{}{
+		"email": acc.Email,
+	}, nil); err != nil {
+		server.Error.Printf("Error while sending deletion email to %s: %v", acc.Email, err)
+	}
+
+	return nil
+}
+
+// Deletes the account with the given email if its grace period has run out. Returns whether the
+// account was deleted
+func (server *Server) purgeIfDue(email string) (bool, error) {
+	server.LockAccount(email)
+	defer server.UnlockAccount(email)
+
+	acc, err := server.GetAccount(email)
+	// The account may have been restored in the meantime
+	if err != nil || acc == nil || acc.Deletion == nil || !acc.Deletion.Due() {
+		return false, err
+	}
+
+	// Don't delete a customer that is still being billed. Cached subscription data may be out of
+	// date, so check with the billing provider first
+	if acc.Customer != nil {
+		if c, err := server.Billing.GetCustomer(acc.Customer.ID); err == nil {
+			acc.SetCustomer(c)
+		} else if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+			// Nothing left to bill if the customer is gone already
+			acc.Customer.Subscriptions = &stripe.SubscriptionList{}
+		} else {
+			return false, err
+		}
+	}
+
+	if acc.hasRenewingSubscription() {
+		server.Error.Printf("Not deleting account %s: subscription %s is set to renew", email, acc.Subscription().ID)
+		return false, nil
+	}
+
+	return true, server.PurgeAccount(acc)
+}
+
+// Deletes all accounts whose grace period has run out
+func (server *Server) PurgeDeletedAccounts() error {
+	iter, err := server.Storage.Iterator(&Account{})
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	var due []string
+	for iter.Next() {
+		acc := &Account{}
+		if err := iter.Get(acc); err != nil {
+			return err
+		}
+		if acc.Deletion != nil && acc.Deletion.Due() {
+			due = append(due, acc.Email)
+		}
+	}
+
+	n := 0
+	for _, email := range due {
+		if purged, err := server.purgeIfDue(email); err != nil {
+			server.Error.Printf("Error while deleting account %s: %v", email, err)
+		} else if purged {
+			n = n + 1
+		}
+	}
+
+	if n > 0 {
+		server.Info.Printf("Deleted %d accounts", n)
+	}
+
+	return nil
+}
+
+type DeleteAccount struct {
+	*Server
+}
+
+// Schedules the account for deletion. The account can be restored through the link in the
+// confirmation email until the grace period runs out
+func (h *DeleteAccount) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	acc, err := h.GetAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	// Accounts without a subscription account only need a record to keep track of the deletion
+	if acc == nil {
+		acc = &Account{Email: a.Email, Created: time.Now(), billing: h.Billing}
+	}
+
+	if acc.Deletion != nil {
+		return &pc.BadRequest{Msg: "This account is already scheduled for deletion"}
+	}
+
+	days := h.deletionGracePeriod()
+	if err := acc.ScheduleDeletion(days); err != nil {
+		return err
+	}
+
+	if err := h.Storage.Put(acc); err != nil {
+		return err
+	}
+
+	link, err := h.LoginLink(r, acc.Email, "/restoreaccount/")
+	if err != nil {
+		return err
+	}
+
+	if err := h.SendEmail(acc.Email, "Your Padlock account will be deleted", h.Templates.AccountDeletionEmail, map[string]interface{}{
+		"email":     acc.Email,
+		"days":      days,
+		"deletesAt": acc.Deletion.DeletesAt.Format("02 Jan 2006"),
+		"link":      link,
+	}, r); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - delete_account - %s:%s\n", pc.FormatRequest(r), acc.Email, acc.Deletion.DeletesAt.Format(time.RFC3339))
+
+	return nil
+}
+
+type RestoreAccount struct {
+	*Server
+}
+
+// Cancels a scheduled account deletion. Requests coming from the link in the deletion email are
+// redirected to the dashboard
+func (h *RestoreAccount) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	acc, err := h.GetAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	if acc == nil || acc.Deletion == nil {
+		return &pc.BadRequest{Msg: "This account is not scheduled for deletion"}
+	}
+
+	if err := acc.Restore(); err != nil {
+		return err
+	}
+
+	if err := h.Storage.Put(acc); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - restore_account - %s\n", pc.FormatRequest(r), acc.Email)
+
+	if r.Method == "GET" {
+		http.Redirect(w, r, "/dashboard/", http.StatusFound)
+	}
+
+	return nil
+}
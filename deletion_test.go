@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+)
+
+func TestPurgeSkipsRenewingSubscriptions(t *testing.T) {
+	server := newTestServer(t)
+	a := &pc.AuthToken{Email: "alice@example.com"}
+
+	acc, err := server.GetOrCreateAccount(a.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.ScheduleDeletion(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&Subscribe{server}).Handle(httptest.NewRecorder(), postForm("/subscribe/", url.Values{
+		"stripeToken": {"tok_visa"},
+	}), a); err == nil {
+		t.Fatal("Expected accounts scheduled for deletion not to be able to subscribe")
+	} else if _, ok := err.(*pc.BadRequest); !ok {
+		t.Fatalf("Expected BadRequest, got %v", err)
+	}
+
+	// Reactivate the subscription behind our back, e.g. through the Stripe dashboard
+	cancelAtPeriodEnd := false
+	if _, err := server.Billing.UpdateSubscription(acc.Subscription().ID, &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: &cancelAtPeriodEnd,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	acc.Deletion.DeletesAt = time.Now().Add(-time.Minute)
+	if err := server.Storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	if purged, err := server.purgeIfDue(acc.Email); err != nil {
+		t.Fatal(err)
+	} else if purged {
+		t.Error("Expected account with a renewing subscription not to be deleted")
+	}
+
+	if acc, _ := server.GetAccount(a.Email); acc == nil {
+		t.Fatal("Expected account to be kept")
+	} else if _, err := server.Billing.GetCustomer(acc.Customer.ID); err != nil {
+		t.Errorf("Expected customer to be kept, got %v", err)
+	}
+}
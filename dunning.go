@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+	"net/http"
+	"time"
+)
+
+type DunningStage string
+
+const (
+	// A payment attempt failed but Stripe is going to retry
+	DunningStageRetrying DunningStage = "retrying"
+	// The final payment attempt failed and Stripe has given up
+	DunningStageFinal DunningStage = "final"
+)
+
+// Keeps track of the recovery process for an account with a failed payment
+type Dunning struct {
+	Stage       DunningStage `json:"stage"`
+	Invoice     string       `json:"invoice"`
+	Attempts    int64        `json:"attempts"`
+	NextAttempt int64        `json:"nextAttempt"`
+	Started     time.Time    `json:"started"`
+	Updated     time.Time    `json:"updated"`
+}
+
+func invoiceFromEvent(event *stripe.Event) (*stripe.Invoice, error) {
+	inv := &stripe.Invoice{}
+	if err := json.Unmarshal(event.Data.Raw, inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func (h *StripeHook) handlePaymentFailed(acc *Account, event *stripe.Event, r *http.Request) error {
+	inv, err := invoiceFromEvent(event)
+	if err != nil {
+		return err
+	}
+
+	stage := DunningStageRetrying
+	if inv.NextPaymentAttempt == 0 {
+		stage = DunningStageFinal
+	}
+
+	if acc.Dunning == nil || acc.Dunning.Invoice != inv.ID {
+		acc.Dunning = &Dunning{
+			Invoice: inv.ID,
+			Started: time.Now(),
+		}
+	}
+
+	acc.Dunning.Stage = stage
+	acc.Dunning.Attempts = inv.AttemptCount
+	acc.Dunning.NextAttempt = inv.NextPaymentAttempt
+	acc.Dunning.Updated = time.Now()
+
+	link, err := h.LoginLink(r, acc.Email, "/dashboard/?action=payment-failed")
+	if err != nil {
+		return err
+	}
+
+	nextAttempt := ""
+	if inv.NextPaymentAttempt != 0 {
+		nextAttempt = formatTimeStamp(inv.NextPaymentAttempt)
+	}
+
+	return h.SendEmail(acc.Email, "Your Padlock Cloud payment failed", h.Templates.PaymentFailedEmail, map[string]interface{}{
+		"amount":      formatCurrency(inv.AmountDue, inv.Currency),
+		"nextAttempt": nextAttempt,
+		"link":        link,
+	}, r)
+}
+
+func (h *StripeHook) handlePaymentSucceeded(acc *Account, event *stripe.Event, r *http.Request) error {
+	inv, err := invoiceFromEvent(event)
+	if err != nil {
+		return err
+	}
+
+	if acc.Dunning != nil {
+		h.Info.Printf("%s - stripe_hook - %s recovered after %d attempts", pc.FormatRequest(r), acc.Email, acc.Dunning.Attempts)
+		acc.Dunning = nil
+	}
+
+	// Don't send receipts for free invoices (e.g. trial periods)
+	if inv.AmountPaid == 0 {
+		return nil
+	}
+
+	return h.SendEmail(acc.Email, "Your Padlock Cloud receipt", h.Templates.PaymentSucceededEmail, map[string]interface{}{
+		"amount": formatCurrency(inv.AmountPaid, inv.Currency),
+		"date":   formatTimeStamp(inv.Created),
+		"number": inv.Number,
+		"link":   fmt.Sprintf("%s/invoices/%s", h.BaseUrl(r), inv.ID),
+	}, r)
+}
+
+func (h *StripeHook) handleUpcomingInvoice(acc *Account, event *stripe.Event, r *http.Request) error {
+	inv, err := invoiceFromEvent(event)
+	if err != nil {
+		return err
+	}
+
+	if inv.AmountDue == 0 {
+		return nil
+	}
+
+	date := inv.NextPaymentAttempt
+	if date == 0 {
+		date = inv.PeriodEnd
+	}
+
+	return h.SendEmail(acc.Email, "Your Padlock Cloud subscription renews soon", h.Templates.UpcomingInvoiceEmail, map[string]interface{}{
+		"amount": formatCurrency(inv.AmountDue, inv.Currency),
+		"date":   formatTimeStamp(date),
+		"link":   fmt.Sprintf("%s/dashboard/", h.BaseUrl(r)),
+	}, r)
+}
+
+func (h *StripeHook) handleSourceExpiring(acc *Account, event *stripe.Event, r *http.Request) error {
+	card := &stripe.Card{}
+	if err := json.Unmarshal(event.Data.Raw, card); err != nil {
+		return err
+	}
+
+	link, err := h.LoginLink(r, acc.Email, "/dashboard/?action=update-payment")
+	if err != nil {
+		return err
+	}
+
+	return h.SendEmail(acc.Email, "Your card on file expires soon", h.Templates.SourceExpiringEmail, map[string]interface{}{
+		"brand":    card.Brand,
+		"lastFour": card.Last4,
+		"expires":  fmt.Sprintf("%02d/%d", card.ExpMonth, card.ExpYear),
+		"link":     link,
+	}, r)
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/satori/go.uuid"
+	"github.com/stripe/stripe-go"
+)
+
+// Time after which unconfirmed email changes expire
+const emailChangeExpiry = 24 * time.Hour
+
+var ErrEmailTaken = errors.New("email address is already in use")
+
+// Request to change the email address of an account. The change is only carried out once it has
+// been confirmed from both the old and the new address
+type EmailChange struct {
+	ID           string
+	OldEmail     string
+	NewEmail     string
+	OldToken     string
+	NewToken     string
+	OldConfirmed bool
+	NewConfirmed bool
+	Created      time.Time
+}
+
+func NewEmailChange(oldEmail string, newEmail string) *EmailChange {
+	return &EmailChange{
+		ID:       uuid.NewV4().String(),
+		OldEmail: oldEmail,
+		NewEmail: newEmail,
+		OldToken: uuid.NewV4().String(),
+		NewToken: uuid.NewV4().String(),
+		Created:  time.Now(),
+	}
+}
+
+// Implements the `Key` method of the `Storable` interface
+func (c *EmailChange) Key() []byte {
+	return []byte(c.ID)
+}
+
+// Implementation of the `Storable.Deserialize` method
+func (c *EmailChange) Deserialize(data []byte) error {
+	return json.Unmarshal(data, c)
+}
+
+// Implementation of the `Storable.Serialize` method
+func (c *EmailChange) Serialize() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func (c *EmailChange) Expired() bool {
+	return time.Since(c.Created) > emailChangeExpiry
+}
+
+// Marks the address the given token was sent to as confirmed. Returns false if the token doesn't
+// match either address
+func (c *EmailChange) Confirm(token string) bool {
+	switch {
+	case token == "":
+		return false
+	case subtle.ConstantTimeCompare([]byte(token), []byte(c.OldToken)) == 1:
+		c.OldConfirmed = true
+	case subtle.ConstantTimeCompare([]byte(token), []byte(c.NewToken)) == 1:
+		c.NewConfirmed = true
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *EmailChange) Confirmed() bool {
+	return c.OldConfirmed && c.NewConfirmed
+}
+
+// Whether any records are stored under the given email address. Addresses are compared
+// case-insensitively so that no two accounts can differ only in the case of their email
+func (server *Server) emailTaken(email string) (bool, error) {
+	for _, s := range []pc.Storable{
+		&Account{Email: email},
+		&pc.Account{Email: email},
+		&pc.DataStore{Account: &pc.Account{Email: email}},
+	} {
+		if err := server.Storage.Get(s); err == nil {
+			return true, nil
+		} else if err != pc.ErrNotFound {
+			return false, err
+		}
+	}
+
+	// Records are keyed by the exact address, so finding other spellings requires a full scan
+	iter, err := server.Storage.Iterator(&Account{})
+	if err != nil {
+		return false, err
+	}
+	defer iter.Release()
+
+	for iter.Next() {
+		acc := &Account{}
+		if err := iter.Get(acc); err != nil {
+			return false, err
+		}
+		if strings.EqualFold(acc.Email, email) {
+			return true, nil
+		}
+	}
+
+	pcIter, err := server.Storage.Iterator(&pc.Account{})
+	if err != nil {
+		return false, err
+	}
+	defer pcIter.Release()
+
+	for pcIter.Next() {
+		acc := &pc.Account{}
+		if err := pcIter.Get(acc); err != nil {
+			return false, err
+		}
+		if strings.EqualFold(acc.Email, email) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Moves the account with the given email, along with the padlock-cloud account, the synced data,
+// app store purchases and any group references, to the new address and updates the Stripe customer
+// accordingly. Either all of it succeeds or everything is rolled back. All auth tokens are revoked in
+// the process, so clients have to log in again with the new address. `held` is the account the
+// caller has already locked, if any
+func (server *Server) ChangeEmail(oldEmail string, newEmail string, held string) (err error) {
+	defer server.lockAccounts(held, oldEmail, newEmail)()
+
+	acc, err := server.GetAccount(oldEmail)
+	if err != nil {
+		return err
+	}
+	if acc == nil {
+		return pc.ErrNotFound
+	}
+
+	if taken, err := server.emailTaken(newEmail); err != nil {
+		return err
+	} else if taken {
+		return ErrEmailTaken
+	}
+
+	pcAcc := &pc.Account{Email: oldEmail}
+	if err := server.Storage.Get(pcAcc); err == pc.ErrNotFound {
+		pcAcc = nil
+	} else if err != nil {
+		return err
+	}
+
+	data := &pc.DataStore{Account: &pc.Account{Email: oldEmail}}
+	if err := server.Storage.Get(data); err == pc.ErrNotFound {
+		data = nil
+	} else if err != nil {
+		return err
+	}
+
+	purchases, err := server.playPurchases(oldEmail)
+	if err != nil {
+		return err
+	}
+
+	transactions, err := server.itunesTransactions(oldEmail)
+	if err != nil {
+		return err
+	}
+
+	// Steps for reverting what has been done so far, in reverse order
+	var undo []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if e := undo[i](); e != nil {
+				server.Error.Printf("Error while rolling back email change from %s to %s: %v", oldEmail, newEmail, e)
+			}
+		}
+	}()
+
+	put := func(s pc.Storable) error {
+		if err := server.Storage.Put(s); err != nil {
+			return err
+		}
+		undo = append(undo, func() error { return server.Storage.Delete(s) })
+		return nil
+	}
+
+	if acc.Customer != nil {
+		customerID := acc.Customer.ID
+		c, err := server.Billing.UpdateCustomer(customerID, &stripe.CustomerParams{Email: stripe.String(newEmail)})
+		if err != nil {
+			return err
+		}
+		undo = append(undo, func() error {
+			_, err := server.Billing.UpdateCustomer(customerID, &stripe.CustomerParams{Email: stripe.String(oldEmail)})
+			return err
+		})
+		acc.SetCustomer(c)
+	}
+
+	// The tracking id and everything else is carried over as is
+	acc.Email = newEmail
+	if err := put(acc); err != nil {
+		return err
+	}
+
+	if pcAcc != nil {
+		if err := put(&pc.Account{Email: newEmail, Created: pcAcc.Created}); err != nil {
+			return err
+		}
+	}
+
+	if data != nil {
+		if err := put(&pc.DataStore{Account: &pc.Account{Email: newEmail}, Content: data.Content}); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range purchases {
+		p.Email = newEmail
+		if err := server.Storage.Put(p); err != nil {
+			return err
+		}
+		p := p
+		undo = append(undo, func() error {
+			p.Email = oldEmail
+			return server.Storage.Put(p)
+		})
+	}
+
+	for _, t := range transactions {
+		t.Email = newEmail
+		if err := server.Storage.Put(t); err != nil {
+			return err
+		}
+		t := t
+		undo = append(undo, func() error {
+			t.Email = oldEmail
+			return server.Storage.Put(t)
+		})
+	}
+
+	if acc.GroupID != "" {
+		if err := server.renameGroupMember(acc.GroupID, oldEmail, newEmail, &undo); err != nil {
+			return err
+		}
+	}
+
+	// Everything is in place under the new address, so the old records can go. Failing to delete
+	// them leaves stale copies behind but doesn't affect the migrated account
+	old := []pc.Storable{&Account{Email: oldEmail}}
+	if pcAcc != nil {
+		old = append(old, pcAcc)
+	}
+	if data != nil {
+		old = append(old, data)
+	}
+	for _, s := range old {
+		if e := server.Storage.Delete(s); e != nil {
+			server.Error.Printf("Error while removing records of %s after email change: %v", oldEmail, e)
+		}
+	}
+
+	return nil
+}
+
+// Replaces the given member's email address in the group with the given id
+func (server *Server) renameGroupMember(id string, oldEmail string, newEmail string, undo *[]func() error) error {
+	server.groupMutex.Lock()
+	defer server.groupMutex.Unlock()
+
+	g, err := server.GetGroup(id)
+	if err != nil || g == nil {
+		return err
+	}
+
+	prev, err := g.Serialize()
+	if err != nil {
+		return err
+	}
+
+	if g.Owner == oldEmail {
+		g.Owner = newEmail
+	}
+	for _, m := range g.Members {
+		if m.Email == oldEmail {
+			m.Email = newEmail
+		}
+	}
+
+	if err := server.Storage.Put(g); err != nil {
+		return err
+	}
+
+	*undo = append(*undo, func() error {
+		server.groupMutex.Lock()
+		defer server.groupMutex.Unlock()
+		restored := &Group{}
+		if err := restored.Deserialize(prev); err != nil {
+			return err
+		}
+		return server.Storage.Put(restored)
+	})
+
+	return nil
+}
+
+type RequestEmailChange struct {
+	*Server
+}
+
+// Starts changing the account's email address by sending confirmation links to both the old and
+// the new address
+func (h *RequestEmailChange) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	if email == "" || !strings.Contains(email, "@") {
+		return &pc.BadRequest{Msg: "Invalid email address"}
+	}
+
+	if strings.EqualFold(email, a.Email) {
+		return &pc.BadRequest{Msg: "This is already your current email address"}
+	}
+
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	if acc.Deletion != nil {
+		return &pc.BadRequest{Msg: "This account is scheduled for deletion"}
+	}
+
+	if taken, err := h.emailTaken(email); err != nil {
+		return err
+	} else if taken {
+		return &pc.BadRequest{Msg: "This email address is already in use"}
+	}
+
+	c := NewEmailChange(acc.Email, email)
+	if err := h.Storage.Put(c); err != nil {
+		return err
+	}
+
+	baseUrl := h.BaseUrl(r)
+	for _, rec := range []struct {
+		email string
+		token string
+		isNew bool
+	}{
+		{c.OldEmail, c.OldToken, false},
+		{c.NewEmail, c.NewToken, true},
+	} {
+		if err := h.SendEmail(rec.email, "Confirm your new email address", h.Templates.EmailChangeEmail, map[string]interface{}{
+			"old":   c.OldEmail,
+			"new":   c.NewEmail,
+			"isNew": rec.isNew,
+			"hours": int(emailChangeExpiry.Hours()),
+			"link":  fmt.Sprintf("%s/confirmemailchange/?id=%s&t=%s", baseUrl, c.ID, rec.token),
+		}, r); err != nil {
+			return err
+		}
+	}
+
+	h.Info.Printf("%s - request_email_change - %s:%s\n", pc.FormatRequest(r), c.OldEmail, c.NewEmail)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+type ConfirmEmailChange struct {
+	*Server
+}
+
+// Confirms an email change from one of the two addresses and carries it out once both have
+// been confirmed
+func (h *ConfirmEmailChange) Handle(w http.ResponseWriter, r *http.Request, auth *pc.AuthToken) error {
+	q := r.URL.Query()
+	id := q.Get("id")
+	if id == "" {
+		return &pc.BadRequest{}
+	}
+
+	c := &EmailChange{ID: id}
+	if err := h.Storage.Get(c); err == pc.ErrNotFound {
+		return &pc.BadRequest{Msg: "This link is invalid or has expired"}
+	} else if err != nil {
+		return err
+	}
+
+	if c.Expired() {
+		h.Storage.Delete(c)
+		return &pc.BadRequest{Msg: "This link is invalid or has expired"}
+	}
+
+	if !c.Confirm(q.Get("t")) {
+		return &pc.BadRequest{Msg: "This link is invalid or has expired"}
+	}
+
+	if !c.Confirmed() {
+		if err := h.Storage.Put(c); err != nil {
+			return err
+		}
+		w.Write([]byte("Thanks! Your email change will be completed once it has been confirmed from the other address as well."))
+		return nil
+	}
+
+	if err := h.ChangeEmail(c.OldEmail, c.NewEmail, lockedAccount(r)); err == ErrEmailTaken {
+		h.Storage.Delete(c)
+		return &pc.BadRequest{Msg: "This email address is already in use"}
+	} else if err == pc.ErrNotFound {
+		h.Storage.Delete(c)
+		return &pc.BadRequest{Msg: "This account no longer exists"}
+	} else if err != nil {
+		return err
+	}
+
+	if err := h.Storage.Delete(c); err != nil {
+		h.LogError(err, r)
+	}
+
+	if acc, err := h.GetAccount(c.NewEmail); err != nil {
+		h.LogError(err, r)
+	} else if acc != nil {
+		if err := h.UpdateProfile(acc, nil); err != nil {
+			h.LogError(err, r)
+		}
+	}
+
+	h.Info.Printf("%s - change_email - %s:%s\n", pc.FormatRequest(r), c.OldEmail, c.NewEmail)
+
+	w.Write([]byte(fmt.Sprintf("Your email address has been changed to %s! Please log in again using your new address.", c.NewEmail)))
+
+	return nil
+}
+
+func init() {
+	pc.RegisterStorable(&EmailChange{}, "email-changes")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+)
+
+// Storage that refuses to store groups, for failing an email change after most records have been
+// migrated already
+type groupFailingStorage struct {
+	pc.Storage
+}
+
+func (s *groupFailingStorage) Put(t pc.Storable) error {
+	if _, ok := t.(*Group); ok {
+		return errors.New("storage failure")
+	}
+	return s.Storage.Put(t)
+}
+
+func TestChangeEmailRollback(t *testing.T) {
+	server := newTestServer(t)
+
+	// The migration looks up purchases by iterating over them, which requires a storage that
+	// reliably iterates over all records
+	dir, err := ioutil.TempDir("", "email-change")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &pc.LevelDBStorage{Config: &pc.LevelDBConfig{Path: dir}}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	server.Storage = storage
+
+	oldEmail := "alice@example.com"
+	newEmail := "alice@example.org"
+
+	acc, err := server.GetOrCreateAccount(oldEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := NewGroup(oldEmail)
+	acc.GroupID = g.ID
+	for _, s := range []pc.Storable{
+		acc,
+		g,
+		&pc.Account{Email: oldEmail},
+		&pc.DataStore{Account: &pc.Account{Email: oldEmail}, Content: []byte("data")},
+		&PlayPurchase{Token: "play-token", Email: oldEmail},
+		&ItunesTransaction{OriginalTransactionID: "itunes-transaction", Email: oldEmail},
+	} {
+		if err := server.Storage.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fail on renaming the group member, after the customer, account, data and purchases have
+	// been moved over
+	server.Storage = &groupFailingStorage{storage}
+	if err := server.ChangeEmail(oldEmail, newEmail, ""); err == nil {
+		t.Fatal("Expected email change to fail")
+	}
+	server.Storage = storage
+
+	if acc, err := server.GetAccount(oldEmail); err != nil {
+		t.Fatal(err)
+	} else if acc == nil || acc.Email != oldEmail || acc.GroupID != g.ID {
+		t.Errorf("Expected account to be kept under the old email, got %+v", acc)
+	}
+
+	if err := server.Storage.Get(&pc.Account{Email: oldEmail}); err != nil {
+		t.Errorf("Expected padlock cloud account to be kept under the old email, got %v", err)
+	}
+
+	data := &pc.DataStore{Account: &pc.Account{Email: oldEmail}}
+	if err := server.Storage.Get(data); err != nil || string(data.Content) != "data" {
+		t.Errorf("Expected data to be kept under the old email, got %q, %v", data.Content, err)
+	}
+
+	if purchases, err := server.playPurchases(oldEmail); err != nil {
+		t.Fatal(err)
+	} else if len(purchases) != 1 {
+		t.Errorf("Expected play purchase to be reverted to the old email, got %v", purchases)
+	}
+
+	if transactions, err := server.itunesTransactions(oldEmail); err != nil {
+		t.Fatal(err)
+	} else if len(transactions) != 1 {
+		t.Errorf("Expected itunes transaction to be reverted to the old email, got %v", transactions)
+	}
+
+	if g, err := server.GetGroup(g.ID); err != nil {
+		t.Fatal(err)
+	} else if g == nil || g.Owner != oldEmail {
+		t.Errorf("Expected group to be unchanged, got %+v", g)
+	}
+
+	if c, err := server.Billing.GetCustomer(acc.Customer.ID); err != nil {
+		t.Fatal(err)
+	} else if c.Email != oldEmail {
+		t.Errorf("Expected customer email to be reverted, got %s", c.Email)
+	}
+
+	// Nothing may be left behind under the new address
+	if taken, err := server.emailTaken(newEmail); err != nil {
+		t.Fatal(err)
+	} else if taken {
+		t.Error("Expected no records under the new email")
+	}
+	if purchases, err := server.playPurchases(newEmail); err != nil || len(purchases) != 0 {
+		t.Errorf("Expected no play purchases under the new email, got %v, %v", purchases, err)
+	}
+	if transactions, err := server.itunesTransactions(newEmail); err != nil || len(transactions) != 0 {
+		t.Errorf("Expected no itunes transactions under the new email, got %v, %v", transactions, err)
+	}
+
+	// With the failure out of the way, the change goes through
+	if err := server.ChangeEmail(oldEmail, newEmail, ""); err != nil {
+		t.Fatal(err)
+	}
+	if acc, err := server.GetAccount(newEmail); err != nil || acc == nil {
+		t.Fatalf("Expected account to be moved to the new email, got %v", err)
+	}
+	if acc, err := server.GetAccount(oldEmail); err != nil || acc != nil {
+		t.Errorf("Expected account to be removed from the old email, got %+v, %v", acc, err)
+	}
+}
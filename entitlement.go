@@ -0,0 +1,211 @@
+package main
+
+import (
+	"time"
+
+	"github.com/stripe/stripe-go"
+)
+
+// How long an account keeps its access after a failed renewal payment while Stripe keeps retrying
+const stripeGracePeriod = 7 * 24 * time.Hour
+
+// How long an active subscription is trusted past the end of its current period. Renewals only
+// reach us through webhooks or the daily customer refresh, so the cached period end may lag behind
+const stripeRenewalLeeway = 3 * 24 * time.Hour
+
+type EntitlementSource string
+
+const (
+	EntitlementSourceStripe EntitlementSource = "stripe"
+	EntitlementSourceItunes EntitlementSource = "itunes"
+	EntitlementSourcePlay   EntitlementSource = "play"
+	// Complimentary access granted by support
+	EntitlementSourceComp EntitlementSource = "comp"
+	// Free access granted as part of a promotion
+	EntitlementSourcePromo EntitlementSource = "promo"
+	// Access through the subscription of a group owner
+	EntitlementSourceGroup EntitlementSource = "group"
+)
+
+type EntitlementTier string
+
+const (
+	EntitlementTierTrial   EntitlementTier = "trial"
+	EntitlementTierPremium EntitlementTier = "premium"
+)
+
+// Describes the access an account has been granted through one of its subscription sources
+type Entitlement struct {
+	Source EntitlementSource
+	Tier   EntitlementTier
+	// Time until which the entitlement is paid for (or the trial period runs)
+	ValidUntil time.Time
+	// Time until which access is retained after `ValidUntil` has passed, e.g. while a failed payment
+	// is being retried. Zero if there is no grace period
+	GraceUntil time.Time
+	// Paused entitlements only grant read access. `ValidUntil` is the time the pause ends
+	Paused bool
+}
+
+// Whether the entitlement currently grants access, including any grace period
+func (e *Entitlement) Active() bool {
+	now := time.Now()
+	return e.ValidUntil.After(now) || e.GraceUntil.After(now)
+}
+
+func (e *Entitlement) InGracePeriod() bool {
+	now := time.Now()
+	return !e.ValidUntil.After(now) && e.GraceUntil.After(now)
+}
+
+// Status string as reported to clients before entitlements were introduced. Still used for the
+// `X-Sub-Status` header and the `subscription` block in the account info
+func (e *Entitlement) Status() string {
+	if e.Paused {
+		return "paused"
+	} else if e.InGracePeriod() {
+		return "past_due"
+	} else if e.Tier == EntitlementTierTrial {
+		return "trialing"
+	} else {
+		return "active"
+	}
+}
+
+// Returns the end of the time span covered by the entitlement, including any grace period
+func (e *Entitlement) End() time.Time {
+	if e.GraceUntil.After(e.ValidUntil) {
+		return e.GraceUntil
+	}
+	return e.ValidUntil
+}
+
+// Whether `e` should take precedence over `other` when determining an account's effective entitlement
+func (e *Entitlement) Outranks(other *Entitlement) bool {
+	if e.Active() != other.Active() {
+		return e.Active()
+	}
+	if e.Paused != other.Paused {
+		return !e.Paused
+	}
+	if e.InGracePeriod() != other.InGracePeriod() {
+		return !e.InGracePeriod()
+	}
+	if e.Tier != other.Tier {
+		return e.Tier == EntitlementTierPremium
+	}
+	return e.End().After(other.End())
+}
+
+func (e *Entitlement) ToMap() map[string]interface{} {
+	var graceUntil int64
+	if !e.GraceUntil.IsZero() {
+		graceUntil = e.GraceUntil.Unix()
+	}
+
+	return map[string]interface{}{
+		"source":     e.Source,
+		"tier":       e.Tier,
+		"status":     e.Status(),
+		"validUntil": e.ValidUntil.Unix(),
+		"graceUntil": graceUntil,
+		"paused":     e.Paused,
+	}
+}
+
+func entitlementFromSubscription(s *stripe.Subscription) *Entitlement {
+	switch s.Status {
+	case stripe.SubscriptionStatusTrialing:
+		return &Entitlement{
+			Source:     EntitlementSourceStripe,
+			Tier:       EntitlementTierTrial,
+			ValidUntil: time.Unix(s.TrialEnd, 0),
+		}
+	case stripe.SubscriptionStatusActive:
+		validUntil := time.Unix(s.CurrentPeriodEnd, 0)
+		// Subscriptions that are set to cancel won't renew, so there's nothing to wait for
+		if !s.CancelAtPeriodEnd {
+			validUntil = validUntil.Add(stripeRenewalLeeway)
+		}
+		return &Entitlement{
+			Source:     EntitlementSourceStripe,
+			Tier:       EntitlementTierPremium,
+			ValidUntil: validUntil,
+		}
+	case stripe.SubscriptionStatusPastDue:
+		// The renewal payment failed, so the new period isn't paid for yet
+		start := time.Unix(s.CurrentPeriodStart, 0)
+		return &Entitlement{
+			Source:     EntitlementSourceStripe,
+			Tier:       EntitlementTierPremium,
+			ValidUntil: start,
+			GraceUntil: start.Add(stripeGracePeriod),
+		}
+	default:
+		return nil
+	}
+}
+
+func entitlementFromPlan(plan *Plan, source EntitlementSource, tier EntitlementTier) *Entitlement {
+	return &Entitlement{
+		Source:     source,
+		Tier:       tier,
+		ValidUntil: plan.Expires,
+	}
+}
+
+// Returns the entitlements granted by each of the account's subscription sources, whether they
+// are still active or not
+func (acc *Account) Entitlements() []*Entitlement {
+	var ents []*Entitlement
+
+	if s := acc.Subscription(); s != nil {
+		if e := entitlementFromSubscription(s); e != nil {
+			if p := acc.Pause; p != nil && p.Active() {
+				e.Paused = true
+				e.ValidUntil = p.ResumesAt
+				e.GraceUntil = time.Time{}
+			}
+			ents = append(ents, e)
+		}
+	}
+
+	if p := acc.Plans.Itunes; p != nil {
+		ents = append(ents, entitlementFromPlan(p.Plan, EntitlementSourceItunes, EntitlementTierPremium))
+	}
+
+	// Purchases with a pending payment don't grant access until the payment has been received
+	if p := acc.Plans.Play; p != nil && p.PaymentState != PlayPaymentStatePending {
+		tier := EntitlementTierPremium
+		if p.PaymentState == PlayPaymentStateTrial {
+			tier = EntitlementTierTrial
+		}
+		ents = append(ents, entitlementFromPlan(p.Plan, EntitlementSourcePlay, tier))
+	}
+
+	if p := acc.Plans.Comp; p != nil {
+		ents = append(ents, entitlementFromPlan(p.Plan, EntitlementSourceComp, EntitlementTierPremium))
+	}
+
+	if p := acc.Plans.Promo; p != nil {
+		ents = append(ents, entitlementFromPlan(p.Plan, EntitlementSourcePromo, EntitlementTierPremium))
+	}
+
+	if acc.groupEntitlement != nil {
+		ents = append(ents, acc.groupEntitlement)
+	}
+
+	return ents
+}
+
+// Returns the effective entitlement across all subscription sources or `nil` if the account
+// doesn't have access through any of them
+func (acc *Account) Entitlement() *Entitlement {
+	var effective *Entitlement
+	for _, e := range acc.Entitlements() {
+		if e.Active() && (effective == nil || e.Outranks(effective)) {
+			effective = e
+		}
+	}
+	return effective
+}
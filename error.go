@@ -25,6 +25,63 @@ func (e *SubscriptionRequired) Message() string {
 	return http.StatusText(e.Status())
 }
 
+type InvalidCoupon struct {
+}
+
+func (e *InvalidCoupon) Code() string {
+	return "invalid_coupon"
+}
+
+func (e *InvalidCoupon) Error() string {
+	return fmt.Sprintf("%s", e.Code())
+}
+
+func (e *InvalidCoupon) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *InvalidCoupon) Message() string {
+	return "This coupon is not valid for your account."
+}
+
+type PromoExpired struct {
+}
+
+func (e *PromoExpired) Code() string {
+	return "promo_expired"
+}
+
+func (e *PromoExpired) Error() string {
+	return fmt.Sprintf("%s", e.Code())
+}
+
+func (e *PromoExpired) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *PromoExpired) Message() string {
+	return "This offer has expired."
+}
+
+type SubscriptionPaused struct {
+}
+
+func (e *SubscriptionPaused) Code() string {
+	return "subscription_paused"
+}
+
+func (e *SubscriptionPaused) Error() string {
+	return fmt.Sprintf("%s", e.Code())
+}
+
+func (e *SubscriptionPaused) Status() int {
+	return http.StatusForbidden
+}
+
+func (e *SubscriptionPaused) Message() string {
+	return "Your subscription is paused. Resume it to make changes again."
+}
+
 type InvalidReceipt struct {
 }
 
@@ -63,3 +120,22 @@ func (e *StripeError) Status() int {
 func (e *StripeError) Message() string {
 	return e.Err.Msg
 }
+
+type InvalidWebhookSignature struct {
+}
+
+func (e *InvalidWebhookSignature) Code() string {
+	return "invalid_webhook_signature"
+}
+
+func (e *InvalidWebhookSignature) Error() string {
+	return fmt.Sprintf("%s", e.Code())
+}
+
+func (e *InvalidWebhookSignature) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *InvalidWebhookSignature) Message() string {
+	return http.StatusText(e.Status())
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Name of the experiment used when no pricing experiments are configured. Splits new accounts
+// evenly across all available plans
+const defaultPricingExperiment = "trial-plan"
+
+type ExperimentVariant struct {
+	Name string `yaml:"name"`
+	// Id of the plan new accounts in this variant are subscribed to
+	Plan string `yaml:"plan"`
+	// Relative weight of this variant. Defaults to 1
+	Weight int `yaml:"weight"`
+}
+
+func (v *ExperimentVariant) weight() int {
+	if v.Weight <= 0 {
+		return 1
+	}
+	return v.Weight
+}
+
+type Experiment struct {
+	Name string `yaml:"name"`
+	// Only active experiments assign new accounts. Existing assignments are kept either way
+	Active   bool                 `yaml:"active"`
+	Variants []*ExperimentVariant `yaml:"variants"`
+}
+
+// Deterministically picks a variant for the given key (usually an email address). The same key
+// always maps to the same variant as long as the variants and their weights stay the same
+func (e *Experiment) Pick(key string) *ExperimentVariant {
+	total := 0
+	for _, v := range e.Variants {
+		total = total + v.weight()
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	hash := sha256.Sum256([]byte(e.Name + ":" + key))
+	n := int(binary.BigEndian.Uint64(hash[:8]) % uint64(total))
+
+	for _, v := range e.Variants {
+		if n < v.weight() {
+			return v
+		}
+		n = n - v.weight()
+	}
+
+	return nil
+}
+
+// Checks that the experiment is well-formed and only references available plans
+func (e *Experiment) Validate() error {
+	if e.Name == "" {
+		return errors.New("Experiment name must not be empty")
+	}
+
+	if len(e.Variants) == 0 {
+		return fmt.Errorf("Experiment %s has no variants", e.Name)
+	}
+
+	names := make(map[string]bool)
+	for _, v := range e.Variants {
+		if v.Name == "" || names[v.Name] {
+			return fmt.Errorf("Experiment %s has an empty or duplicate variant name", e.Name)
+		}
+		names[v.Name] = true
+
+		if FindPlan(v.Plan) == nil {
+			return fmt.Errorf("Variant %s of experiment %s references unavailable plan %s", v.Name, e.Name, v.Plan)
+		}
+	}
+
+	return nil
+}
+
+type PricingConfig struct {
+	Experiments []*Experiment `yaml:"experiments"`
+}
+
+// Pricing experiments loaded from the config, validated against `AvailablePlans`
+var PricingExperiments []*Experiment
+
+// Returns the experiment used for assigning trial plans to new accounts
+func ActivePricingExperiment() *Experiment {
+	for _, e := range PricingExperiments {
+		if e.Active {
+			return e
+		}
+	}
+	return nil
+}
+
+func defaultExperiment() *Experiment {
+	e := &Experiment{
+		Name:   defaultPricingExperiment,
+		Active: true,
+	}
+	for _, plan := range PlanGroups[DefaultCurrency] {
+		e.Variants = append(e.Variants, &ExperimentVariant{
+			Name: plan.ID,
+			Plan: plan.ID,
+		})
+	}
+	return e
+}
+
+// Validates the configured experiments and sets up `PricingExperiments`
+func InitPricingExperiments(config *PricingConfig) error {
+	PricingExperiments = nil
+
+	names := make(map[string]bool)
+	for _, e := range config.Experiments {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+		if names[e.Name] {
+			return fmt.Errorf("Duplicate experiment name: %s", e.Name)
+		}
+		names[e.Name] = true
+		PricingExperiments = append(PricingExperiments, e)
+	}
+
+	if ActivePricingExperiment() == nil {
+		PricingExperiments = append(PricingExperiments, defaultExperiment())
+	}
+
+	return nil
+}
+
+// Records which variant of an experiment an account has been assigned to
+type ExperimentAssignment struct {
+	Variant  string    `json:"variant"`
+	Plan     string    `json:"plan"`
+	Assigned time.Time `json:"assigned"`
+	// Time the assignment was reported to the tracker. Zero if it hasn't been reported yet
+	Exposed time.Time `json:"exposed"`
+}
+
+// Returns the account's assignment for the given experiment, assigning it to a variant first if
+// necessary. Assignments are sticky, so changing the variants later won't affect existing accounts
+func (acc *Account) AssignExperiment(e *Experiment) *ExperimentAssignment {
+	if a := acc.Experiments[e.Name]; a != nil {
+		return a
+	}
+
+	v := e.Pick(acc.Email)
+	if v == nil {
+		return nil
+	}
+
+	if acc.Experiments == nil {
+		acc.Experiments = make(map[string]*ExperimentAssignment)
+	}
+
+	a := &ExperimentAssignment{
+		Variant:  v.Name,
+		Plan:     v.Plan,
+		Assigned: time.Now(),
+	}
+	acc.Experiments[e.Name] = a
+
+	return a
+}
+
+// Sends exposure events for any experiment assignments that haven't been reported yet. The
+// account has to be saved afterwards to persist the exposure times
+func (server *Server) TrackExposures(acc *Account) {
+	for name, a := range acc.Experiments {
+		if !a.Exposed.IsZero() {
+			continue
+		}
+
+		if acc.TrackingID == "" {
+			acc.TrackingID = uuid.NewV4().String()
+		}
+
+		a.Exposed = time.Now()
+
+		server.Track(&TrackingEvent{
+			TrackingID: acc.TrackingID,
+			Name:       "Experiment Exposure",
+			Properties: map[string]interface{}{
+				"Experiment": name,
+				"Variant":    a.Variant,
+				"Plan":       a.Plan,
+			},
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+)
+
+// Promo campaign email sent to an account
+type ExportedCampaign struct {
+	Campaign string                  `json:"campaign"`
+	Coupon   string                  `json:"coupon"`
+	Subject  string                  `json:"subject"`
+	Status   CampaignRecipientStatus `json:"status"`
+	Updated  time.Time               `json:"updated"`
+}
+
+type ExportedPromos struct {
+	// Promo currently offered to the account
+	Current *Promo `json:"current"`
+	// Coupons redeemed by the account
+	Redeemed []*stripe.Coupon `json:"redeemed"`
+	// Promo campaign emails sent to the account
+	Campaigns []*ExportedCampaign `json:"campaigns"`
+}
+
+type ExportedTracking struct {
+	TrackingID string `json:"trackingID"`
+	// Properties of the profile sent to our tracking backends
+	Profile map[string]interface{} `json:"profile"`
+}
+
+// Everything we hold about an account, as handed out to its owner on request
+type AccountExport struct {
+	Exported time.Time
+	Account  *Account
+	Customer *stripe.Customer
+	Invoices []*stripe.Invoice
+	Promos   *ExportedPromos
+	Tracking *ExportedTracking
+}
+
+// Collects the data stored about the given account, both locally and with Stripe
+func ExportAccount(storage pc.Storage, billing BillingProvider, acc *Account) (*AccountExport, error) {
+	export := &AccountExport{
+		Exported: time.Now().UTC(),
+		Account:  acc,
+		Customer: acc.Customer,
+		Invoices: make([]*stripe.Invoice, 0),
+		Promos: &ExportedPromos{
+			Current:   acc.Promo,
+			Redeemed:  make([]*stripe.Coupon, 0),
+			Campaigns: make([]*ExportedCampaign, 0),
+		},
+		Tracking: &ExportedTracking{
+			TrackingID: acc.TrackingID,
+		},
+	}
+
+	if acc.Customer != nil {
+		c, err := billing.GetCustomer(acc.Customer.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !c.Deleted {
+			export.Customer = c
+		}
+
+		if export.Invoices, err = billing.ListInvoices(&stripe.InvoiceListParams{
+			Customer: &acc.Customer.ID,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := export.Customer; c != nil {
+		if c.Discount != nil && c.Discount.Coupon != nil {
+			export.Promos.Redeemed = append(export.Promos.Redeemed, c.Discount.Coupon)
+		}
+		if c.Subscriptions != nil {
+			for _, s := range c.Subscriptions.Data {
+				if s.Discount != nil && s.Discount.Coupon != nil {
+					export.Promos.Redeemed = append(export.Promos.Redeemed, s.Discount.Coupon)
+				}
+			}
+		}
+	}
+
+	iter, err := storage.Iterator(&PromoCampaign{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	for iter.Next() {
+		c := &PromoCampaign{}
+		if err := iter.Get(c); err != nil {
+			return nil, err
+		}
+		for _, rec := range c.Recipients {
+			if rec.Email == acc.Email {
+				export.Promos.Campaigns = append(export.Promos.Campaigns, &ExportedCampaign{
+					Campaign: c.ID,
+					Coupon:   c.Coupon,
+					Subject:  c.Subject,
+					Status:   rec.Status,
+					Updated:  rec.Updated,
+				})
+			}
+		}
+	}
+
+	// Profiles are only sent for accounts with a tracking id
+	if acc.TrackingID != "" {
+		export.Tracking.Profile = accountProfile(acc, nil)
+	}
+
+	return export, nil
+}
+
+// Writes the export as a zip archive containing one JSON file per section
+func (e *AccountExport) WriteArchive(w io.Writer) error {
+	z := zip.NewWriter(w)
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"account.json", e.Account},
+		{"stripe/customer.json", e.Customer},
+		{"stripe/invoices.json", e.Invoices},
+		{"promos.json", e.Promos},
+		{"tracking.json", e.Tracking},
+	}
+
+	for _, file := range files {
+		f, err := z.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: e.Exported,
+		})
+		if err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(file.data, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return z.Close()
+}
+
+// File name the export is offered for download as
+func (e *AccountExport) FileName() string {
+	return fmt.Sprintf("padlock-export-%s.zip", e.Exported.Format("2006-01-02"))
+}
+
+type ExportAccountData struct {
+	*Server
+}
+
+// Lets users download an archive of all the data we hold about their account
+func (h *ExportAccountData) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	acc, err := h.GetAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	if acc == nil {
+		return &pc.BadRequest{Msg: "No such account"}
+	}
+
+	export, err := ExportAccount(h.Storage, h.Billing, acc)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", export.FileName()))
+
+	if err := export.WriteArchive(w); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - export - %s\n", pc.FormatRequest(r), acc.Email)
+
+	return nil
+}
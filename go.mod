@@ -7,6 +7,7 @@ require (
 	github.com/padloc/padlock-cloud v1.3.4
 	github.com/satori/go.uuid v1.2.0
 	github.com/stripe/stripe-go v68.4.0+incompatible
+	gopkg.in/throttled/throttled.v2 v2.2.4
 	gopkg.in/urfave/cli.v1 v1.20.0
 	gopkg.in/yaml.v2 v2.2.7
 )
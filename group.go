@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/satori/go.uuid"
+	"github.com/stripe/stripe-go"
+)
+
+// How long group invitations stay valid
+const groupInviteExpiry = 7 * 24 * time.Hour
+
+// Returns the number of seats (including the owner's) included in the given plan. Plans with more
+// than one seat can be shared with other accounts via a group
+func planSeats(plan *stripe.Plan) int64 {
+	if plan == nil {
+		return 1
+	}
+	seats, err := strconv.ParseInt(plan.Metadata["seats"], 10, 64)
+	if err != nil || seats < 1 {
+		return 1
+	}
+	return seats
+}
+
+type GroupMember struct {
+	Email  string    `json:"email"`
+	Joined time.Time `json:"joined"`
+}
+
+type GroupInvite struct {
+	Email   string    `json:"email"`
+	Token   string    `json:"token,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func (inv *GroupInvite) Expired() bool {
+	return time.Since(inv.Created) > groupInviteExpiry
+}
+
+// A group of accounts sharing the subscription of its owner (e.g. a family or a small team). Each
+// member occupies one seat of the owner's subscription
+type Group struct {
+	ID      string
+	Owner   string
+	Created time.Time
+	Members []*GroupMember
+	Invites []*GroupInvite
+}
+
+// Implements the `Key` method of the `Storable` interface
+func (g *Group) Key() []byte {
+	return []byte(g.ID)
+}
+
+// Implementation of the `Storable.Deserialize` method
+func (g *Group) Deserialize(data []byte) error {
+	return json.Unmarshal(data, g)
+}
+
+// Implementation of the `Storable.Serialize` method
+func (g *Group) Serialize() ([]byte, error) {
+	return json.Marshal(g)
+}
+
+// Number of occupied seats, including the owner's
+func (g *Group) Seats() int64 {
+	return int64(1 + len(g.Members))
+}
+
+// Number of seats that are either occupied or reserved by a pending invitation
+func (g *Group) ReservedSeats() int64 {
+	n := g.Seats()
+	for _, inv := range g.Invites {
+		if !inv.Expired() {
+			n = n + 1
+		}
+	}
+	return n
+}
+
+func (g *Group) Member(email string) (int, *GroupMember) {
+	for i, m := range g.Members {
+		if strings.EqualFold(m.Email, email) {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+func (g *Group) Invite(email string) (int, *GroupInvite) {
+	for i, inv := range g.Invites {
+		if strings.EqualFold(inv.Email, email) {
+			return i, inv
+		}
+	}
+	return -1, nil
+}
+
+func (g *Group) RemoveMember(email string) bool {
+	if i, _ := g.Member(email); i != -1 {
+		g.Members = append(g.Members[:i], g.Members[i+1:]...)
+		return true
+	}
+	return false
+}
+
+func (g *Group) RemoveInvite(email string) bool {
+	if i, _ := g.Invite(email); i != -1 {
+		g.Invites = append(g.Invites[:i], g.Invites[i+1:]...)
+		return true
+	}
+	return false
+}
+
+func (g *Group) ToMap() map[string]interface{} {
+	invites := make([]*GroupInvite, 0)
+	for _, inv := range g.Invites {
+		if !inv.Expired() {
+			// The token is only meant for the invitee and must not be handed out to clients
+			invites = append(invites, &GroupInvite{
+				Email:   inv.Email,
+				Created: inv.Created,
+			})
+		}
+	}
+
+	members := make([]*GroupMember, len(g.Members))
+	copy(members, g.Members)
+
+	return map[string]interface{}{
+		"id":      g.ID,
+		"owner":   g.Owner,
+		"created": g.Created.Unix(),
+		"members": members,
+		"invites": invites,
+		"seats":   g.Seats(),
+	}
+}
+
+func NewGroup(owner string) *Group {
+	return &Group{
+		ID:      uuid.NewV4().String(),
+		Owner:   owner,
+		Created: time.Now(),
+	}
+}
+
+// Returns the group with the given id or `nil` if it doesn't exist
+func (server *Server) GetGroup(id string) (*Group, error) {
+	g := &Group{ID: id}
+	if err := server.Storage.Get(g); err == pc.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Loads the account of the group owner without locking it. Only used for reading the owner's
+// subscription
+func (server *Server) getGroupOwner(g *Group) (*Account, error) {
+	owner := &Account{Email: g.Owner, billing: server.Billing}
+	if err := server.Storage.Get(owner); err == pc.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+// Returns the entitlement a group member gets through the owner's subscription, if any
+func (server *Server) groupEntitlement(acc *Account) (*Entitlement, error) {
+	g, err := server.GetGroup(acc.GroupID)
+	if err != nil || g == nil || g.Owner == acc.Email {
+		return nil, err
+	}
+
+	if _, m := g.Member(acc.Email); m == nil {
+		return nil, nil
+	}
+
+	owner, err := server.getGroupOwner(g)
+	if err != nil || owner == nil {
+		return nil, err
+	}
+
+	if s := owner.Subscription(); s == nil || planSeats(s.Plan) < 2 {
+		return nil, nil
+	}
+
+	for _, e := range owner.Entitlements() {
+		if e.Source == EntitlementSourceStripe {
+			ge := *e
+			ge.Source = EntitlementSourceGroup
+			return &ge, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Updates the quantity of the owner's subscription to match the number of occupied seats
+func (server *Server) updateGroupQuantity(g *Group) error {
+	owner, err := server.getGroupOwner(g)
+	if err != nil || owner == nil {
+		return err
+	}
+
+	s := owner.Subscription()
+	if s == nil {
+		return nil
+	}
+
+	quantity := g.Seats()
+	_, err = server.Billing.UpdateSubscription(s.ID, &stripe.SubscriptionParams{
+		Quantity: &quantity,
+	})
+	return err
+}
+
+// Locks the group with the given id. If `held`, the account already locked by the caller, owns the
+// group, the accounts of all members are locked as well, before the group, which is the order used
+// everywhere else. Returns the group along with a function releasing all locks
+func (server *Server) lockGroup(id string, held string) (*Group, func(), error) {
+	for {
+		g, err := server.GetGroup(id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var members []string
+		locked := map[string]bool{}
+		if g != nil && g.Owner == held {
+			for _, m := range g.Members {
+				members = append(members, m.Email)
+				locked[m.Email] = true
+			}
+		}
+
+		unlockMembers := server.lockAccounts(held, members...)
+		server.groupMutex.Lock()
+		unlock := func() {
+			server.groupMutex.Unlock()
+			unlockMembers()
+		}
+
+		if g, err = server.GetGroup(id); err != nil {
+			unlock()
+			return nil, nil, err
+		}
+
+		if g == nil || g.Owner != held {
+			return g, unlock, nil
+		}
+
+		// Members may have joined while we were waiting for the locks, in which case we start over
+		complete := true
+		for _, m := range g.Members {
+			if !locked[m.Email] {
+				complete = false
+			}
+		}
+
+		if complete {
+			return g, unlock, nil
+		}
+
+		unlock()
+	}
+}
+
+// Removes the given account from its group. If the account owns the group, the whole group is
+// dissolved. The account itself has to be locked by the caller and is saved afterwards
+func (server *Server) LeaveGroup(acc *Account) error {
+	if acc.GroupID == "" {
+		return nil
+	}
+
+	g, unlock, err := server.lockGroup(acc.GroupID, acc.Email)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	acc.GroupID = ""
+
+	if g != nil && g.Owner == acc.Email {
+		if err := server.Storage.Delete(g); err != nil {
+			return err
+		}
+
+		// Members will no longer find the group, so their entitlement ends right away
+		for _, m := range g.Members {
+			if member, err := server.GetAccount(m.Email); err != nil {
+				server.Error.Printf("Error while removing %s from group %s: %v", m.Email, g.ID, err)
+			} else if member != nil && member.GroupID == g.ID {
+				member.GroupID = ""
+				if err := server.Storage.Put(member); err != nil {
+					server.Error.Printf("Error while removing %s from group %s: %v", m.Email, g.ID, err)
+				}
+			}
+		}
+
+		// Back to a single seat
+		g.Members = nil
+		if err := server.updateGroupQuantity(g); err != nil {
+			return err
+		}
+	} else if g != nil && g.RemoveMember(acc.Email) {
+		if err := server.Storage.Put(g); err != nil {
+			return err
+		}
+		if err := server.updateGroupQuantity(g); err != nil {
+			return err
+		}
+	}
+
+	return server.Storage.Put(acc)
+}
+
+func writeGroup(w http.ResponseWriter, g *Group) error {
+	var res []byte
+	var err error
+	if g == nil {
+		res, err = json.Marshal(nil)
+	} else {
+		res, err = json.Marshal(g.ToMap())
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+	return nil
+}
+
+type GroupInfo struct {
+	*Server
+}
+
+func (h *GroupInfo) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	var g *Group
+	if acc.GroupID != "" {
+		if g, err = h.GetGroup(acc.GroupID); err != nil {
+			return err
+		}
+	}
+
+	return writeGroup(w, g)
+}
+
+type InviteToGroup struct {
+	*Server
+}
+
+func (h *InviteToGroup) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	if email == "" || !strings.Contains(email, "@") {
+		return &pc.BadRequest{Msg: "Invalid email address"}
+	}
+
+	if strings.EqualFold(email, a.Email) {
+		return &pc.BadRequest{Msg: "You can't invite yourself"}
+	}
+
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	s := acc.Subscription()
+	if s == nil || (s.Status != stripe.SubscriptionStatusActive && s.Status != stripe.SubscriptionStatusTrialing) {
+		return &pc.BadRequest{Msg: "This account does not have an active subscription"}
+	}
+
+	seats := planSeats(s.Plan)
+	if seats < 2 {
+		return &pc.BadRequest{Msg: "The current plan can't be shared with other accounts"}
+	}
+
+	h.groupMutex.Lock()
+	defer h.groupMutex.Unlock()
+
+	var g *Group
+	if acc.GroupID != "" {
+		if g, err = h.GetGroup(acc.GroupID); err != nil {
+			return err
+		}
+		if g != nil && g.Owner != acc.Email {
+			return &pc.BadRequest{Msg: "Only the owner of a group can invite new members"}
+		}
+	}
+
+	if g == nil {
+		g = NewGroup(acc.Email)
+	}
+
+	if _, m := g.Member(email); m != nil {
+		return &pc.BadRequest{Msg: "This account is already a member of the group"}
+	}
+
+	// Re-inviting someone replaces their previous invitation
+	g.RemoveInvite(email)
+
+	if g.ReservedSeats() >= seats {
+		return &pc.BadRequest{Msg: fmt.Sprintf("All %d seats of this plan are taken", seats)}
+	}
+
+	inv := &GroupInvite{
+		Email:   email,
+		Token:   uuid.NewV4().String(),
+		Created: time.Now(),
+	}
+	g.Invites = append(g.Invites, inv)
+
+	if err := h.Storage.Put(g); err != nil {
+		return err
+	}
+
+	if acc.GroupID != g.ID {
+		acc.GroupID = g.ID
+		if err := h.Storage.Put(acc); err != nil {
+			return err
+		}
+	}
+
+	link, err := h.LoginLink(r, email, fmt.Sprintf("/group/accept/?group=%s&token=%s", g.ID, inv.Token))
+	if err != nil {
+		return err
+	}
+
+	if err := h.SendEmail(email, "You've been invited to Padlock Cloud", h.Templates.GroupInviteEmail, map[string]interface{}{
+		"owner": acc.Email,
+		"link":  link,
+		"days":  int(groupInviteExpiry.Hours() / 24),
+	}, r); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - group_invite - %s:%s\n", pc.FormatRequest(r), acc.Email, email)
+
+	h.Track(&TrackingEvent{
+		Name: "Invite Group Member",
+		Properties: map[string]interface{}{
+			"Seats": g.ReservedSeats(),
+		},
+		authToken: a,
+		request:   r,
+	})
+
+	return writeGroup(w, g)
+}
+
+type AcceptGroupInvite struct {
+	*Server
+}
+
+func (h *AcceptGroupInvite) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	groupID := r.FormValue("group")
+	token := r.FormValue("token")
+
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	h.groupMutex.Lock()
+	defer h.groupMutex.Unlock()
+
+	g, err := h.GetGroup(groupID)
+	if err != nil {
+		return err
+	}
+
+	var inv *GroupInvite
+	if g != nil {
+		_, inv = g.Invite(acc.Email)
+	}
+
+	if inv == nil || inv.Token == "" || inv.Token != token || inv.Expired() {
+		return &pc.BadRequest{Msg: "This invitation is invalid or has expired"}
+	}
+
+	if acc.GroupID != "" && acc.GroupID != g.ID {
+		return &pc.BadRequest{Msg: "This account is already part of another group. Please leave it first"}
+	}
+
+	prev, err := g.Serialize()
+	if err != nil {
+		return err
+	}
+
+	g.RemoveInvite(acc.Email)
+	if _, m := g.Member(acc.Email); m == nil {
+		g.Members = append(g.Members, &GroupMember{
+			Email:  acc.Email,
+			Joined: time.Now(),
+		})
+	}
+
+	if err := h.Storage.Put(g); err != nil {
+		return err
+	}
+
+	// Only bill for the new seat once the group has been saved, and revert the group if billing fails
+	if err := h.updateGroupQuantity(g); err != nil {
+		restored := &Group{}
+		if e := restored.Deserialize(prev); e != nil {
+			h.LogError(e, r)
+		} else if e := h.Storage.Put(restored); e != nil {
+			h.LogError(e, r)
+		}
+		return wrapCardError(err)
+	}
+
+	acc.GroupID = g.ID
+	if err := h.Storage.Put(acc); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - group_accept - %s:%s\n", pc.FormatRequest(r), acc.Email, g.ID)
+
+	h.Track(&TrackingEvent{
+		Name:      "Join Group",
+		authToken: a,
+		request:   r,
+	})
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=group-joined", http.StatusFound)
+		return nil
+	}
+
+	return writeGroup(w, g)
+}
+
+type LeaveGroup struct {
+	*Server
+}
+
+func (h *LeaveGroup) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	if acc.GroupID == "" {
+		return &pc.BadRequest{Msg: "This account is not part of a group"}
+	}
+
+	if err := h.LeaveGroup(acc); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - group_leave - %s\n", pc.FormatRequest(r), acc.Email)
+
+	h.Track(&TrackingEvent{
+		Name:      "Leave Group",
+		authToken: a,
+		request:   r,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type RemoveFromGroup struct {
+	*Server
+}
+
+func (h *RemoveFromGroup) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	email := strings.TrimSpace(r.PostFormValue("email"))
+
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(email, acc.Email) {
+		return &pc.BadRequest{Msg: "Use /group/leave/ to leave a group"}
+	}
+
+	// Lock the member's account before the group, which is the order used everywhere else
+	if g, err := h.GetGroup(acc.GroupID); err != nil {
+		return err
+	} else if g != nil {
+		if _, m := g.Member(email); m != nil {
+			h.LockAccount(m.Email)
+			defer h.UnlockAccount(m.Email)
+		}
+	}
+
+	h.groupMutex.Lock()
+	defer h.groupMutex.Unlock()
+
+	g, err := h.GetGroup(acc.GroupID)
+	if err != nil {
+		return err
+	}
+
+	if g == nil || g.Owner != acc.Email {
+		return &pc.BadRequest{Msg: "Only the owner of a group can remove members"}
+	}
+
+	if g.RemoveInvite(email) {
+		if err := h.Storage.Put(g); err != nil {
+			return err
+		}
+	} else if g.RemoveMember(email) {
+		if err := h.Storage.Put(g); err != nil {
+			return err
+		}
+
+		if member, err := h.GetAccount(email); err != nil {
+			return err
+		} else if member != nil && member.GroupID == g.ID {
+			member.GroupID = ""
+			if err := h.Storage.Put(member); err != nil {
+				return err
+			}
+		}
+
+		if err := h.updateGroupQuantity(g); err != nil {
+			return err
+		}
+	} else {
+		return &pc.BadRequest{Msg: "No such member or invitation"}
+	}
+
+	h.Info.Printf("%s - group_remove - %s:%s\n", pc.FormatRequest(r), acc.Email, email)
+
+	h.Track(&TrackingEvent{
+		Name:      "Remove Group Member",
+		authToken: a,
+		request:   r,
+	})
+
+	return writeGroup(w, g)
+}
+
+func init() {
+	pc.RegisterStorable(&Group{}, "groups")
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	pc "github.com/padloc/padlock-cloud/padlockcloud"
 	"github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/customer"
-	"github.com/stripe/stripe-go/invoice"
-	"github.com/stripe/stripe-go/sub"
+	"github.com/stripe/stripe-go/webhook"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,9 +25,16 @@ func (h *Dashboard) Handle(w http.ResponseWriter, r *http.Request, auth *pc.Auth
 		return err
 	}
 
-	if coupon := r.URL.Query().Get("coupon"); coupon != "" {
-		if promo, _ := PromoFromCoupon(coupon); promo != nil {
-			acc.Promo = promo
+	// Following the same promo link again must not restart the redemption window
+	if coupon := r.URL.Query().Get("coupon"); coupon != "" && (acc.Promo == nil || acc.Promo.Coupon == nil || acc.Promo.Coupon.ID != coupon) {
+		if promo, _ := PromoFromCoupon(h.Billing, coupon); promo != nil {
+			acc.OfferPromo(promo)
+		}
+	}
+
+	if acc.ClearExpiredPromo() {
+		if err := h.Storage.Put(acc); err != nil {
+			return err
 		}
 	}
 
@@ -44,7 +51,11 @@ func (h *Dashboard) Handle(w http.ResponseWriter, r *http.Request, auth *pc.Auth
 	params["account"] = accMap
 
 	params["stripePublicKey"] = h.StripeConfig.PublicKey
-	params["mixpanelToken"] = h.MixpanelConfig.Token
+	// Don't send any events to Mixpanel from the client unless it's one of the configured backends
+	params["mixpanelToken"] = ""
+	if h.TrackingConfig.UsesBackend("mixpanel", h.MixpanelConfig) {
+		params["mixpanelToken"] = h.MixpanelConfig.Token
+	}
 
 	ref := r.URL.Query().Get("ref")
 	if ref == "" && params["action"] != "" {
@@ -59,7 +70,7 @@ func (h *Dashboard) Handle(w http.ResponseWriter, r *http.Request, auth *pc.Auth
 
 	b.WriteTo(w)
 
-	go h.Track(&TrackingEvent{
+	h.Track(&TrackingEvent{
 		TrackingID: r.URL.Query().Get("tid"),
 		Name:       "Open Dashboard",
 		Properties: map[string]interface{}{
@@ -95,19 +106,44 @@ func (h *Subscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTok
 	token := r.PostFormValue("stripeToken")
 	coupon := r.PostFormValue("coupon")
 	source := r.PostFormValue("source")
-	plan := AvailablePlans[0].ID
+	plan := r.PostFormValue("plan")
 
 	if source == "" {
 		source = sourceFromRef(r.URL.Query().Get("ref"))
 	}
 
+	if plan != "" && FindPlan(plan) == nil {
+		return &pc.BadRequest{Msg: "Invalid plan"}
+	}
+
 	acc, err := h.GetOrCreateAccount(a.Email)
 	if err != nil {
 		return err
 	}
 
+	if acc.Deletion != nil {
+		return &pc.BadRequest{Msg: "This account is scheduled for deletion. Please restore it before subscribing"}
+	}
+
+	if err := acc.ValidateCoupon(coupon); err != nil {
+		if acc.ClearExpiredPromo() {
+			if err := h.Storage.Put(acc); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+
+	if c := r.PostFormValue("currency"); c != "" {
+		currency, ok := ParseCurrency(c)
+		if !ok {
+			return &pc.BadRequest{Msg: "Unsupported currency"}
+		}
+		acc.PreferredCurrency = currency
+	}
+
 	if acc.GetPaymentSource() == nil && token == "" {
-		return &pc.BadRequest{"No existing payment source and no stripe token provided"}
+		return &pc.BadRequest{Msg: "No existing payment source and no stripe token provided"}
 	}
 
 	hadSub := acc.HasActiveSubscription()
@@ -125,25 +161,57 @@ func (h *Subscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTok
 		}
 	}
 
+	// If no plan was chosen explicitly, stick with the current one (as long as it is still available).
+	// The currency is only determined now since it may depend on the country of the new card
+	if plan == "" {
+		if sub := acc.Subscription(); sub != nil && FindPlan(sub.Plan.ID) != nil {
+			plan = acc.LocalizePlan(sub.Plan).ID
+		} else {
+			plan = PlansForCurrency(acc.Currency())[0].ID
+		}
+	} else if currency := acc.Customer.Currency; currency != "" && FindPlan(plan).Currency != currency {
+		return &pc.BadRequest{Msg: "The billing currency of this account can not be changed"}
+	}
+
 	s := acc.Subscription()
 	trialEndNow := true
 	if s == nil {
-		var err error
-		if s, err = sub.New(&stripe.SubscriptionParams{
+		params := &stripe.SubscriptionParams{
 			Customer:    &acc.Customer.ID,
 			Plan:        &plan,
 			TrialEndNow: &trialEndNow,
 			Coupon:      &coupon,
-		}); err != nil {
+		}
+		if err := h.setTaxRates(acc, params); err != nil {
+			return err
+		}
+		var err error
+		if s, err = h.Billing.CreateSubscription(params); err != nil {
 			return wrapCardError(err)
 		}
 		acc.Customer.Subscriptions.Data = []*stripe.Subscription{s}
 	} else {
-		if s_, err := sub.Update(s.ID, &stripe.SubscriptionParams{
+		params := &stripe.SubscriptionParams{
 			Plan:        &plan,
 			TrialEndNow: &trialEndNow,
 			Coupon:      &coupon,
-		}); err != nil {
+		}
+		// Subscribing again revokes any pending cancellation
+		if s.CancelAtPeriodEnd {
+			cancelAtPeriodEnd := false
+			params.CancelAtPeriodEnd = &cancelAtPeriodEnd
+			acc.Cancellation = nil
+		}
+		// Credit any unused time on the previous plan when switching plans mid-period (e.g. from
+		// monthly to yearly)
+		if s.Status == stripe.SubscriptionStatusActive && s.Plan.ID != plan {
+			prorate := true
+			params.Prorate = &prorate
+		}
+		if err := h.setTaxRates(acc, params); err != nil {
+			return err
+		}
+		if s_, err := h.Billing.UpdateSubscription(s.ID, params); err != nil {
 			return wrapCardError(err)
 		} else {
 			*s = *s_
@@ -156,15 +224,32 @@ func (h *Subscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTok
 
 	if s.Status == "unpaid" || s.Status == "past_due" {
 		// Attempt to pay any unpaid invoices
-		i := invoice.List(&stripe.InvoiceListParams{
+		invoices, err := h.Billing.ListInvoices(&stripe.InvoiceListParams{
 			Subscription: &s.ID,
 		})
-		for i.Next() {
-			inv := i.Invoice()
+		if err != nil {
+			return err
+		}
+		paid := false
+		for _, inv := range invoices {
 			if inv.Attempted && !inv.Paid {
-				if _, err := invoice.Pay(inv.ID, nil); err != nil {
+				if _, err := h.Billing.PayInvoice(inv.ID); err != nil {
 					return wrapCardError(err)
 				}
+				paid = true
+			}
+		}
+
+		// Paying the invoices reactivates the subscription, so don't wait for the webhook to update
+		// the account
+		if paid {
+			if c, err := h.Billing.GetCustomer(acc.Customer.ID); err != nil {
+				return err
+			} else {
+				acc.SetCustomer(c)
+			}
+			if err := h.Storage.Put(acc); err != nil {
+				return err
 			}
 		}
 	}
@@ -179,11 +264,12 @@ func (h *Subscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTok
 
 	h.Info.Printf("%s - subscribe - %s\n", pc.FormatRequest(r), acc.Email)
 
-	go h.Track(&TrackingEvent{
+	h.Track(&TrackingEvent{
 		Name: "Update Subscription",
 		Properties: map[string]interface{}{
 			"Coupon":                  coupon,
 			"Plan":                    plan,
+			"Currency":                FindPlan(plan).Currency,
 			"Source":                  source,
 			"Previous Status":         prevStatus,
 			"Previous Plan":           prevPlan,
@@ -197,6 +283,126 @@ func (h *Subscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTok
 	return nil
 }
 
+type SubscribePreview struct {
+	*Server
+}
+
+func (h *SubscribePreview) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	planID := r.FormValue("plan")
+	coupon := r.FormValue("coupon")
+
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	s := acc.Subscription()
+	if s == nil {
+		return &pc.BadRequest{Msg: "This account does not have an active subscription"}
+	}
+
+	if err := acc.ValidateCoupon(coupon); err != nil {
+		return err
+	}
+
+	if c := r.FormValue("currency"); c != "" {
+		currency, ok := ParseCurrency(c)
+		if !ok {
+			return &pc.BadRequest{Msg: "Unsupported currency"}
+		}
+		acc.PreferredCurrency = currency
+	}
+
+	if planID == "" {
+		planID = acc.LocalizePlan(s.Plan).ID
+	}
+
+	plan := FindPlan(planID)
+	if plan == nil {
+		return &pc.BadRequest{Msg: "Invalid plan"}
+	}
+
+	// Mirror the parameters used by `Subscribe`, which ends any trial period right away and prorates
+	// plan changes on active subscriptions
+	now := time.Now().Unix()
+	params := &stripe.InvoiceParams{
+		Customer:                  &acc.Customer.ID,
+		Subscription:              &s.ID,
+		SubscriptionPlan:          &planID,
+		SubscriptionProrationDate: &now,
+	}
+	if coupon != "" {
+		params.Coupon = &coupon
+	}
+	if s.Status == stripe.SubscriptionStatusTrialing {
+		params.SubscriptionTrialEnd = &now
+	}
+	if s.Status == stripe.SubscriptionStatusActive && s.Plan.ID != planID {
+		prorate := true
+		params.SubscriptionProrate = &prorate
+	}
+
+	inv, err := h.Billing.UpcomingInvoice(params)
+	if err != nil {
+		return wrapCardError(err)
+	}
+
+	var prorationCredit int64
+	lines := make([]map[string]interface{}, 0)
+	if inv.Lines != nil {
+		for _, l := range inv.Lines.Data {
+			line := map[string]interface{}{
+				"description": l.Description,
+				"amount":      l.Amount,
+				"proration":   l.Proration,
+				"quantity":    l.Quantity,
+			}
+			if l.Plan != nil {
+				line["plan"] = l.Plan.ID
+			}
+			if l.Period != nil {
+				line["periodStart"] = l.Period.Start
+				line["periodEnd"] = l.Period.End
+			}
+			if l.Proration && l.Amount < 0 {
+				prorationCredit = prorationCredit - l.Amount
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	nextBilling := inv.NextPaymentAttempt
+	if nextBilling == 0 {
+		nextBilling = inv.PeriodEnd
+	}
+
+	res, err := json.Marshal(map[string]interface{}{
+		"plan":            planToMap(plan),
+		"currency":        inv.Currency,
+		"lines":           lines,
+		"prorationCredit": prorationCredit,
+		"subtotal":        inv.Subtotal,
+		"tax":             inv.Tax,
+		"total":           inv.Total,
+		"amountDue":       inv.AmountDue,
+		"nextBillingDate": nextBilling,
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+
+	h.Info.Printf("%s - subscribe_preview - %s:%s\n", pc.FormatRequest(r), acc.Email, planID)
+
+	return nil
+}
+
 type Unsubscribe struct {
 	*Server
 }
@@ -210,11 +416,52 @@ func (h *Unsubscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthT
 	s := acc.Subscription()
 
 	if s == nil {
-		return &pc.BadRequest{"This account does not have an active subscription"}
+		return &pc.BadRequest{Msg: "This account does not have an active subscription"}
 	}
 
-	if _, err := sub.Cancel(s.ID, nil); err != nil {
-		return err
+	reason := CancellationReason(r.PostFormValue("reason"))
+	if !validCancellationReason(reason) {
+		return &pc.BadRequest{Msg: "Invalid cancellation reason"}
+	}
+
+	feedback := strings.TrimSpace(r.PostFormValue("feedback"))
+	if len(feedback) > maxCancellationFeedback {
+		feedback = feedback[:maxCancellationFeedback]
+	}
+
+	// By default, the subscription keeps running until the end of the period the customer already
+	// paid for. Paused and unpaid subscriptions have nothing left to run out, so those are cancelled
+	// right away
+	immediately := r.PostFormValue("immediately") == "true" ||
+		acc.Pause != nil && acc.Pause.Active() ||
+		(s.Status != stripe.SubscriptionStatusActive && s.Status != stripe.SubscriptionStatusTrialing)
+
+	var effective time.Time
+	if immediately {
+		if s_, err := h.Billing.CancelSubscription(s.ID); err != nil {
+			return err
+		} else {
+			*s = *s_
+		}
+		effective = time.Now()
+		acc.Pause = nil
+	} else {
+		cancelAtPeriodEnd := true
+		if s_, err := h.Billing.UpdateSubscription(s.ID, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: &cancelAtPeriodEnd,
+		}); err != nil {
+			return err
+		} else {
+			*s = *s_
+		}
+		effective = time.Unix(s.CurrentPeriodEnd, 0)
+	}
+
+	acc.Cancellation = &Cancellation{
+		Reason:    reason,
+		Feedback:  feedback,
+		Requested: time.Now(),
+		Effective: effective,
 	}
 
 	if err := acc.UpdateCustomer(); err != nil {
@@ -231,8 +478,13 @@ func (h *Unsubscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthT
 
 	h.Info.Printf("%s - unsubscribe - %s\n", pc.FormatRequest(r), acc.Email)
 
-	go h.Track(&TrackingEvent{
-		Name:      "Cancel Subscription",
+	h.Track(&TrackingEvent{
+		Name: "Cancel Subscription",
+		Properties: map[string]interface{}{
+			"Reason":        reason,
+			"Feedback":      feedback,
+			"At Period End": !immediately,
+		},
 		authToken: a,
 		request:   r,
 	})
@@ -260,6 +512,13 @@ func (h *UpdateBilling) Handle(w http.ResponseWriter, r *http.Request, a *pc.Aut
 	zip := r.PostFormValue("zip")
 	city := r.PostFormValue("city")
 	country := r.PostFormValue("country")
+	vatID := r.PostFormValue("vat")
+
+	if vatID != "" {
+		if vatID, err = NormalizeVATID(vatID, country); err != nil {
+			return err
+		}
+	}
 
 	params := &stripe.CustomerParams{
 		Shipping: &stripe.CustomerShippingDetailsParams{
@@ -274,12 +533,16 @@ func (h *UpdateBilling) Handle(w http.ResponseWriter, r *http.Request, a *pc.Aut
 		},
 	}
 
-	if customer, err := customer.Update(acc.Customer.ID, params); err != nil {
+	if customer, err := h.Billing.UpdateCustomer(acc.Customer.ID, params); err != nil {
 		return err
 	} else {
 		acc.SetCustomer(customer)
 	}
 
+	if err := h.UpdateTax(acc, vatID); err != nil {
+		return err
+	}
+
 	if err := h.Storage.Put(acc); err != nil {
 		return err
 	}
@@ -288,8 +551,12 @@ func (h *UpdateBilling) Handle(w http.ResponseWriter, r *http.Request, a *pc.Aut
 
 	h.Info.Printf("%s - update_billing - %s\n", pc.FormatRequest(r), acc.Email)
 
-	go h.Track(&TrackingEvent{
-		Name:      "Update Billing Info",
+	h.Track(&TrackingEvent{
+		Name: "Update Billing Info",
+		Properties: map[string]interface{}{
+			"Country":        country,
+			"Reverse Charge": isReverseCharge(country, vatID),
+		},
 		authToken: a,
 		request:   r,
 	})
@@ -306,11 +573,46 @@ func (h *StripeHook) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTo
 	if err != nil {
 		return err
 	}
-	event := &stripe.Event{}
-	if err := json.Unmarshal(body, event); err != nil {
+
+	if h.StripeConfig.WebhookSecret == "" {
+		return &InvalidWebhookSignature{}
+	}
+
+	event, err := webhook.ConstructEventWithTolerance(
+		body,
+		r.Header.Get("Stripe-Signature"),
+		h.StripeConfig.WebhookSecret,
+		h.StripeConfig.WebhookToleranceDuration(),
+	)
+	if err != nil {
+		h.LogError(err, r)
+		return &InvalidWebhookSignature{}
+	}
+
+	// Hold the event while checking whether it has been processed already, so concurrent deliveries
+	// of the same event can't both get past the check
+	defer h.lockStripeEvent(event.ID)()
+
+	processed := &ProcessedStripeEvent{ID: event.ID}
+	if err := h.Storage.Get(processed); err == nil {
+		// We've seen this one before; Acknowledge but don't apply it again
+		h.Info.Printf("%s - stripe_hook - skipping duplicate event %s", pc.FormatRequest(r), event.ID)
+		return nil
+	} else if err != pc.ErrNotFound {
 		return err
 	}
 
+	if err := h.HandleEvent(&event, r); err != nil {
+		return err
+	}
+
+	processed.Type = event.Type
+	processed.Processed = time.Now()
+	return h.Storage.Put(processed)
+}
+
+// Applies a verified webhook event to the corresponding account
+func (h *StripeHook) HandleEvent(event *stripe.Event, r *http.Request) error {
 	var c *stripe.Customer
 
 	switch event.Type {
@@ -320,10 +622,12 @@ func (h *StripeHook) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTo
 			return err
 		}
 
-	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted",
+		"invoice.payment_failed", "invoice.payment_succeeded", "invoice.upcoming", "customer.source.expiring":
 		var err error
-		if c, err = customer.Get(event.GetObjectValue("customer"), nil); err != nil {
-			h.LogError(err, r)
+		// Failing here means the event isn't applied, so we let Stripe know to retry it later
+		if c, err = h.Billing.GetCustomer(event.GetObjectValue("customer")); err != nil {
+			return err
 		}
 	}
 
@@ -331,14 +635,31 @@ func (h *StripeHook) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTo
 		return nil
 	}
 
-	h.LockAccount(c.Email)
-	defer h.UnlockAccount(c.Email)
+	prevEmail, _ := event.Data.PreviousAttributes["email"].(string)
+
+	defer h.lockAccounts("", c.Email, prevEmail)()
 
 	acc, err := h.GetAccount(c.Email)
 	if err != nil {
 		return err
 	}
 
+	// Accounts are looked up by email, so changing the email on Stripe's end breaks the link between
+	// customer and account. Those changes have to go through `ChangeEmail` instead, so we restore the
+	// previous email and keep the customer linked to the account it belongs to
+	if prevEmail != "" && prevEmail != c.Email && (acc == nil || acc.Customer == nil || acc.Customer.ID != c.ID) {
+		if acc, err = h.GetAccount(prevEmail); err != nil {
+			return err
+		}
+
+		if acc != nil && acc.Customer != nil && acc.Customer.ID == c.ID {
+			h.Error.Printf("Email of stripe customer %s was changed from %s to %s outside of the email change flow; reverting", c.ID, prevEmail, c.Email)
+			if c, err = h.Billing.UpdateCustomer(c.ID, &stripe.CustomerParams{Email: stripe.String(prevEmail)}); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Only update customer if the ids match (even though that theoretically shouldn't happen,
 	// it's possible that there are two stripe customers with the same email. In that case, this guard
 	// against unexpected behaviour by making sure only one of the customers is used)
@@ -348,6 +669,26 @@ func (h *StripeHook) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTo
 
 	acc.SetCustomer(c)
 
+	// Failing to notify the customer (or to process any event specifics) shouldn't prevent the
+	// account from being updated, so we only log any errors here
+	var notifyErr error
+	switch event.Type {
+	case "invoice.payment_failed":
+		notifyErr = h.handlePaymentFailed(acc, event, r)
+	case "invoice.payment_succeeded":
+		notifyErr = h.handlePaymentSucceeded(acc, event, r)
+	case "invoice.upcoming":
+		notifyErr = h.handleUpcomingInvoice(acc, event, r)
+	case "customer.source.expiring":
+		notifyErr = h.handleSourceExpiring(acc, event, r)
+	case "customer.subscription.updated", "customer.subscription.deleted":
+		notifyErr = h.handleSubscriptionUpdated(acc, event, r)
+	}
+
+	if notifyErr != nil {
+		h.LogError(notifyErr, r)
+	}
+
 	if err := h.Storage.Put(acc); err != nil {
 		return err
 	}
@@ -366,12 +707,20 @@ type Track struct {
 }
 
 func (h *Track) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := h.eventCatalog.ReadBody(w, r)
 	if err != nil {
 		return err
 	}
 	event := &TrackingEvent{}
 	if err := json.Unmarshal(body, event); err != nil {
+		return &pc.BadRequest{Msg: "Invalid event"}
+	}
+
+	if err := h.eventCatalog.Validate(event); err != nil {
+		return err
+	}
+
+	if err := h.trackingRateLimiter.Limit(r, []*TrackingEvent{event}); err != nil {
 		return err
 	}
 
@@ -395,6 +744,77 @@ func (h *Track) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken)
 	return nil
 }
 
+type TrackBatch struct {
+	*Server
+}
+
+// Tracks an array of events at once. The batch is rejected as a whole if any of the events is invalid
+func (h *TrackBatch) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	body, err := h.eventCatalog.ReadBody(w, r)
+	if err != nil {
+		return err
+	}
+	var events []*TrackingEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		return &pc.BadRequest{Msg: "Invalid events"}
+	}
+
+	if len(events) == 0 {
+		return &pc.BadRequest{Msg: "No events provided"}
+	}
+
+	if len(events) > h.eventCatalog.MaxBatchSize {
+		return &pc.BadRequest{Msg: fmt.Sprintf("Too many events; at most %d are allowed per batch", h.eventCatalog.MaxBatchSize)}
+	}
+
+	for i, event := range events {
+		if event == nil {
+			return &pc.BadRequest{Msg: fmt.Sprintf("Invalid event at index %d", i)}
+		}
+		if err := h.eventCatalog.Validate(event); err != nil {
+			msg := err.Error()
+			if br, ok := err.(*pc.BadRequest); ok {
+				msg = br.Msg
+			}
+			return &pc.BadRequest{Msg: fmt.Sprintf("Invalid event at index %d: %s", i, msg)}
+		}
+	}
+
+	if err := h.trackingRateLimiter.Limit(r, events); err != nil {
+		return err
+	}
+
+	// Events without a tracking id all belong to the same new client
+	var tid string
+	for _, event := range events {
+		event.authToken = a
+		event.request = r
+		if event.TrackingID == "" {
+			event.TrackingID = tid
+		}
+
+		if err := h.Track(event); err != nil {
+			return err
+		}
+
+		if tid == "" {
+			tid = event.TrackingID
+		}
+	}
+
+	var response []byte
+	if response, err = json.Marshal(events); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+
+	h.Info.Printf("%s - track_batch - %d events", pc.FormatRequest(r), len(events))
+
+	return nil
+}
+
 type Invoices struct {
 	*Server
 }
@@ -414,9 +834,16 @@ func (h *Invoices) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToke
 		id = p[2]
 	}
 
+	// Invoices can be requested as PDF either through the `.pdf` extension or the `Accept` header
+	pdf := strings.Contains(r.Header.Get("Accept"), "application/pdf")
+	if strings.HasSuffix(id, ".pdf") {
+		id = strings.TrimSuffix(id, ".pdf")
+		pdf = true
+	}
+
 	if id != "" {
 
-		inv, err := invoice.Get(id, nil)
+		inv, err := h.Billing.GetInvoice(id)
 		if err != nil {
 			return err
 		}
@@ -425,10 +852,18 @@ func (h *Invoices) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToke
 			return &pc.UnauthorizedError{}
 		}
 
+		if pdf {
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"padlock-invoice-%s.pdf\"", inv.Number))
+			w.Write(renderInvoicePDF(inv, acc.BillingInfo()))
+			return nil
+		}
+
 		var b bytes.Buffer
 		if err := h.Templates.Invoice.Execute(&b, &map[string]interface{}{
 			"invoice":  inv,
 			"customer": acc.Customer,
+			"billing":  acc.BillingInfo(),
 		}); err != nil {
 			return err
 		}
@@ -437,29 +872,76 @@ func (h *Invoices) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToke
 
 	} else {
 
-		var invoices []*stripe.Invoice
-		i := invoice.List(&stripe.InvoiceListParams{
-			Customer: &acc.Customer.ID,
-		})
-		for i.Next() {
-			inv := i.Invoice()
-			if inv.Paid {
-				invoices = append(invoices, inv)
-			}
+		q, err := ParseInvoiceQuery(r)
+		if err != nil {
+			return err
+		}
+
+		all, err := h.Billing.ListInvoices(q.ListParams(acc.Customer.ID))
+		if err != nil {
+			return err
+		}
+
+		var records []*InvoiceRecord
+		for _, inv := range q.Paginate(all) {
+			records = append(records, NewInvoiceRecord(inv))
+		}
+
+		var prevURL, nextURL string
+		var links []string
+		if q.Page > 1 {
+			prevURL = q.PageURL(r, q.Page-1)
+			links = append(links, fmt.Sprintf("<%s>; rel=\"prev\"", prevURL))
+		}
+		if q.Page*q.PerPage < len(all) {
+			nextURL = q.PageURL(r, q.Page+1)
+			links = append(links, fmt.Sprintf("<%s>; rel=\"next\"", nextURL))
 		}
 
-		if r.Header.Get("Accept") == "application/json" {
-			if b, err := json.Marshal(invoices); err != nil {
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(all)))
+		if len(links) != 0 {
+			w.Header().Set("Link", strings.Join(links, ", "))
+		}
+
+		switch q.Format {
+		case "json":
+			if records == nil {
+				records = []*InvoiceRecord{}
+			}
+			if b, err := json.Marshal(map[string]interface{}{
+				"invoices": records,
+				"page":     q.Page,
+				"perPage":  q.PerPage,
+				"total":    len(all),
+			}); err != nil {
 				return err
 			} else {
 				w.Header().Set("Content-Type", "application/json")
 				w.Write(b)
 			}
-		} else {
+		case "csv":
+			var b bytes.Buffer
+			cw := csv.NewWriter(&b)
+			cw.Write(invoiceCSVHeader)
+			for _, rec := range records {
+				cw.Write(rec.CSV())
+			}
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename=\"padlock-invoices.csv\"")
+			b.WriteTo(w)
+		default:
 			var b bytes.Buffer
 			if err := h.Templates.InvoiceList.Execute(&b, &map[string]interface{}{
-				"invoices": invoices,
+				"invoices": records,
 				"customer": acc.Customer,
+				"total":    len(all),
+				"prevURL":  prevURL,
+				"nextURL":  nextURL,
 			}); err != nil {
 				return err
 			}
@@ -483,6 +965,12 @@ func (h *AccountInfo) Handle(w http.ResponseWriter, r *http.Request, auth *pc.Au
 		return err
 	}
 
+	if subAcc.ClearExpiredPromo() {
+		if err := h.Storage.Put(subAcc); err != nil {
+			return err
+		}
+	}
+
 	if subAcc.Promo != nil && subAcc.Promo.Created.IsZero() {
 		subAcc.Promo.Created = time.Now()
 		if err := h.Storage.Put(subAcc); err != nil {
@@ -507,10 +995,38 @@ type Plans struct {
 	*Server
 }
 
+// Returns the plans available in the caller's currency. The currency can be chosen explicitly via the
+// `currency` parameter. Otherwise it is derived from the caller's account, if authenticated, or the
+// `country` parameter
 func (h *Plans) Handle(w http.ResponseWriter, r *http.Request, auth *pc.AuthToken) error {
-	plans := make([]map[string]interface{}, len(AvailablePlans))
-	for i, v := range AvailablePlans {
+	currency := DefaultCurrency
+	country := r.URL.Query().Get("country")
+
+	if c := r.URL.Query().Get("currency"); c != "" {
+		var ok bool
+		if currency, ok = ParseCurrency(c); !ok {
+			return &pc.BadRequest{Msg: "Unsupported currency"}
+		}
+	} else if auth != nil {
+		acc, err := h.GetAccount(auth.Email)
+		if err != nil {
+			return err
+		}
+		if acc != nil {
+			currency = acc.Currency()
+			if country == "" {
+				country = acc.BillingInfo()["country"]
+			}
+		}
+	} else if c, ok := currencyForCountry(country); ok {
+		currency = c
+	}
+
+	available := PlansForCurrency(currency)
+	plans := make([]map[string]interface{}, len(available))
+	for i, v := range available {
 		plans[i] = planToMap(v)
+		plans[i]["formattedAmount"] = formatCurrency(v.Amount, v.Currency, country)
 	}
 	res, err := json.Marshal(plans)
 	if err != nil {
@@ -527,115 +1043,187 @@ type ApplyPromo struct {
 	*Server
 }
 
+// Offers the promo to the account with the given email. Returns `nil` if there is no such account
+func (h *ApplyPromo) offerPromo(r *http.Request, email string, promo *Promo) (*Account, error) {
+	// The account the request is authenticated with is already locked and may well be in the list
+	defer h.lockAccounts(lockedAccount(r), email)()
+
+	acc, err := h.GetAccount(email)
+	if err != nil || acc == nil {
+		return nil, err
+	}
+
+	if acc.OfferPromo(promo) {
+		if err := h.Storage.Put(acc); err != nil {
+			return nil, err
+		}
+	}
+
+	return acc, nil
+}
+
+// Applies the promo for the given coupon to a list of users exported from Mixpanel. If the coupon
+// specifies an `emailSubject` and `emailBody`, a campaign announcing the promo is started as well
+// and its status is returned
 func (h *ApplyPromo) Handle(w http.ResponseWriter, r *http.Request, auth *pc.AuthToken) error {
 	usersJSON := []byte(r.PostFormValue("users"))
 	var users []struct {
 		Properties struct {
-			Email string `json:"$email"`
+			Email        string      `json:"$email"`
+			Unsubscribed interface{} `json:"$unsubscribed"`
 		} `json:"$properties"`
 	}
 
-	promo, err := PromoFromCoupon(r.URL.Query().Get("coupon"))
+	promo, err := PromoFromCoupon(h.Billing, r.URL.Query().Get("coupon"))
 	if err != nil {
-		return &pc.BadRequest{fmt.Sprintf("%v", err)}
+		return &pc.BadRequest{Msg: fmt.Sprintf("%v", err)}
 	}
 
 	if err := json.Unmarshal(usersJSON, &users); err != nil {
-		return &pc.BadRequest{fmt.Sprintf("%v", err)}
+		return &pc.BadRequest{Msg: fmt.Sprintf("%v", err)}
 	}
 
+	var campaign *PromoCampaign
+	if promo.Coupon.Metadata["emailSubject"] != "" && promo.Coupon.Metadata["emailBody"] != "" {
+		campaign = NewPromoCampaign(promo, h.BaseUrl(r))
+	}
+
+	applied := 0
 	for _, user := range users {
 		email := user.Properties.Email
-		if acc, _ := h.GetAccount(email); acc != nil {
+		if email == "" {
+			continue
+		}
 
-			acc.Promo = promo
-			if err := h.Storage.Put(acc); err != nil {
-				return err
+		acc, err := h.offerPromo(r, email, promo)
+		if err != nil {
+			return err
+		}
+
+		if acc == nil {
+			if campaign != nil {
+				campaign.AddRecipient(email, CampaignRecipientSkipped, "no account")
 			}
-			//
-			// authRequest, err := pc.NewAuthRequest(email, "web", "", nil)
-			// if err != nil {
-			// 	return err
-			// }
-			// authRequest.Redirect = "/dashboard/?action=subscribe"
-			//
-			// // Save key-token pair to database for activating it later in a separate request
-			// if err := h.Storage.Put(authRequest); err != nil {
-			// 	return err
-			// }
-			// if user.Properties.Unsubscribed == "" {
-			// 	go func() {
-			// 		actLink := fmt.Sprintf("%s/a/?t=%s", h.BaseUrl(r), authRequest.Token)
-			// 		optoutLink := fmt.Sprintf("%s/optout/?tid=%s", h.BaseUrl(r), acc.TrackingID)
-			// 		message := fmt.Sprintf(
-			// 			"%s\n\nUnsubscribe -> %s",
-			// 			fmt.Sprintf(promo.Coupon.Meta["emailBody"], actLink),
-			// 			optoutLink,
-			// 		)
-			//
-			// 		if err := h.Sender.Send(email, promo.Coupon.Meta["emailSubject"], message); err != nil {
-			// 			h.LogError(err, r)
-			// 		}
-			// 	}()
-			// }
+			continue
+		}
+
+		applied = applied + 1
+
+		if campaign == nil {
+			continue
+		}
+
+		if unsubscribed, _ := user.Properties.Unsubscribed.(bool); unsubscribed || user.Properties.Unsubscribed == "true" {
+			campaign.AddRecipient(email, CampaignRecipientSkipped, "unsubscribed")
+		} else {
+			campaign.AddRecipient(email, CampaignRecipientPending, "")
 		}
 	}
 
-	return nil
-}
+	res := map[string]interface{}{
+		"coupon":  promo.Coupon.ID,
+		"applied": applied,
+	}
 
-type DeleteAccount struct {
-	*Server
-}
+	if campaign != nil {
+		if err := h.Storage.Put(campaign); err != nil {
+			return err
+		}
+		res["campaign"] = campaign.ToMap()
+	}
 
-func (h *DeleteAccount) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
-	acc, err := h.GetAccount(a.Email)
+	h.Info.Printf("%s - apply_promo - %s (%d accounts)\n", pc.FormatRequest(r), promo.Coupon.ID, applied)
 
+	b, err := json.Marshal(res)
 	if err != nil {
 		return err
 	}
 
-	if acc.Customer != nil {
-		if c, err := customer.Get(acc.Customer.ID, nil); err != nil {
-			h.LogError(err, r)
-		} else {
-			_, migrated := c.Metadata["account"]
-			// Only delete stripe customer if the account has not been migrated to Padloc 3
-			if !migrated {
-				if _, err := customer.Del(c.ID, nil); err != nil {
-					h.LogError(err, r)
-				}
-			}
-		}
-	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 
-	if err := h.DeleteProfile(acc); err != nil {
-		h.LogError(err, r)
+	return nil
+}
+
+type ValidateReceipt struct {
+	*Server
+}
+
+func (h *ValidateReceipt) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
 	}
 
-	if err := h.Storage.Delete(acc); err != nil {
-		return err
+	receiptType := r.PostFormValue("type")
+	receiptData := r.PostFormValue("receipt")
+
+	// Make sure all required parameters are there
+	if receiptType == "" || receiptData == "" {
+		return &pc.BadRequest{Msg: "Missing receiptType or receiptData field"}
 	}
 
-	if err := h.DeleteAccount(acc.Email); err != nil {
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
 		return err
 	}
 
-	if err := h.Sender.Send(acc.Email, "Padlock Account Deletion", fmt.Sprintf(`
-Hi there,
+	switch receiptType {
+	case ReceiptTypeItunes:
+		// Validate receipt
+		plan, err := h.Itunes.ValidateReceipt(receiptData)
+		// If the receipt is invalid or the subcription expired, return the appropriate error
+		if err == ErrInvalidReceipt || (err == nil && plan.Status == ItunesStatusExpired) {
+			return &InvalidReceipt{}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Save the plan with the corresponding account
+		if err := h.SetItunesPlan(acc, plan); err == ErrReceiptInUse {
+			return &pc.BadRequest{Msg: "This purchase is already linked to another account"}
+		} else if err != nil {
+			return err
+		}
+	case ReceiptTypePlay:
+		// For Play purchases, the "receipt" is the purchase token, which is only valid in combination
+		// with the id of the purchased subscription
+		subscriptionID := r.PostFormValue("subscription")
+		if subscriptionID == "" {
+			return &pc.BadRequest{Msg: "Missing subscription field"}
+		}
 
-we're writing you to inform you that your Padlock online account %s was deleted successfully.
+		plan, err := h.Play.ValidatePurchase(subscriptionID, receiptData)
+		if err == ErrInvalidReceipt || (err == nil && !plan.Active()) {
+			return &InvalidReceipt{}
+		}
 
-Sorry to see you go! We'll continue to work hard on making Padlock better and we hope you'll
-give us another chance in the future! If you have any suggestions on how we can improve our
-product, please let us know! Just reply to this email to send us your feedback.
+		if err != nil {
+			return err
+		}
 
-Thanks!
-Your Padlock Team
-`, acc.Email)); err != nil {
-		h.LogError(err, r)
+		if err := h.SetPlayPlan(acc, plan); err == ErrReceiptInUse {
+			return &pc.BadRequest{Msg: "This purchase is already linked to another account"}
+		} else if err != nil {
+			return err
+		}
+	default:
+		return &pc.BadRequest{Msg: "Invalid receipt type"}
 	}
 
+	h.Info.Printf("%s - validate_receipt - %s:%s\n", pc.FormatRequest(r), acc.Email, receiptType)
+
+	h.Track(&TrackingEvent{
+		Name: "Validate Receipt",
+		Properties: map[string]interface{}{
+			"Receipt Type": receiptType,
+		},
+		authToken: a,
+		request:   r,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
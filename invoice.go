@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+)
+
+// Name and address printed as the issuer on all invoices, both in the PDF and on the invoice page
+var invoiceIssuer = []string{
+	"MaKleSoft UG",
+	"Meisentrasse 5",
+	"91522 Ansbach, Germany",
+}
+
+// Describes an invoice line item, e.g. "Padlock Premium (01 Jan 2018 - 01 Feb 2018)"
+func invoiceLineDescription(l *stripe.InvoiceLine) string {
+	desc := l.Description
+	if l.Plan != nil {
+		if l.Plan.Nickname != "" {
+			desc = l.Plan.Nickname
+		} else if desc == "" {
+			desc = l.Plan.ID
+		}
+	}
+
+	if l.Period != nil && l.Period.Start != 0 {
+		desc = fmt.Sprintf("%s (%s - %s)", desc, formatTimeStamp(l.Period.Start), formatTimeStamp(l.Period.End))
+	}
+
+	return desc
+}
+
+// Returns the tax rate applied to the invoice in percent
+func invoiceTaxPercent(inv *stripe.Invoice) float64 {
+	if inv.TaxPercent != 0 {
+		return inv.TaxPercent
+	}
+	for _, t := range inv.TotalTaxAmounts {
+		if t.TaxRate != nil {
+			return t.TaxRate.Percentage
+		}
+	}
+	return 0
+}
+
+// Note printed on invoices of business customers in other EU member states
+const reverseChargeNote = "Reverse charge: VAT to be accounted for by the recipient (Art. 196 Council Directive 2006/112/EC)"
+
+// Returns the customer's VAT ID as recorded when the invoice was issued
+func invoiceVATID(inv *stripe.Invoice) string {
+	for _, id := range inv.CustomerTaxIDs {
+		if id.Type == stripe.TaxIDTypeEUVAT {
+			return id.Value
+		}
+	}
+	return ""
+}
+
+func invoiceReverseCharge(inv *stripe.Invoice) bool {
+	return inv.CustomerTaxExempt == stripe.CustomerTaxExemptReverse
+}
+
+// Returns the lines of the billing address in the format used on invoices
+func billingAddressLines(billing map[string]string) []string {
+	var lines []string
+	for _, l := range []string{
+		billing["name"],
+		billing["address1"],
+		billing["address2"],
+		strings.TrimSpace(billing["postalCode"] + " " + billing["city"]),
+		billing["country"],
+	} {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// Renders an invoice as a PDF document. `billing` is the customer's billing information as
+// returned by `Account.BillingInfo`
+func renderInvoicePDF(inv *stripe.Invoice, billing map[string]string) []byte {
+	const (
+		left   = 50.0
+		right  = pdfPageWidth - 50.0
+		bottom = 80.0
+	)
+
+	doc := newPDFDocument()
+
+	doc.Text(left, 770, 28, true, "Padlock")
+
+	y := 790.0
+	for _, l := range invoiceIssuer {
+		doc.TextRight(right, y, 10, false, l)
+		y = y - 14
+	}
+
+	y = 690.0
+	for _, l := range billingAddressLines(billing) {
+		doc.Text(left, y, 11, false, l)
+		y = y - 15
+	}
+	if vatID := invoiceVATID(inv); vatID != "" {
+		doc.Text(left, y, 11, false, "VAT ID: "+vatID)
+	}
+
+	doc.TextRight(right, 690, 11, false, formatTimeStamp(inv.Created))
+	doc.TextRight(right, 675, 11, false, "Invoice Nr.: "+inv.Number)
+
+	y = 580.0
+	doc.Text(left, y, 11, true, "Description")
+	doc.TextRight(right, y, 11, true, "Amount")
+	y = y - 8
+	doc.Line(left, y, right, y)
+	y = y - 20
+
+	if inv.Lines != nil {
+		for _, l := range inv.Lines.Data {
+			if y < bottom {
+				doc.AddPage()
+				y = pdfPageHeight - bottom
+			}
+			doc.Text(left, y, 11, false, invoiceLineDescription(l))
+			doc.TextRight(right, y, 11, false, formatCurrency(l.Amount, l.Currency, billing["country"]))
+			y = y - 20
+		}
+	}
+
+	if y < bottom+60 {
+		doc.AddPage()
+		y = pdfPageHeight - bottom
+	}
+
+	doc.Line(left, y+12, right, y+12)
+	y = y - 6
+	doc.Text(left, y, 11, false, "Subtotal")
+	doc.TextRight(right, y, 11, false, formatCurrency(inv.Subtotal, inv.Currency, billing["country"]))
+	y = y - 20
+	doc.Text(left, y, 11, false, fmt.Sprintf("VAT (%g%%)", invoiceTaxPercent(inv)))
+	doc.TextRight(right, y, 11, false, formatCurrency(inv.Tax, inv.Currency, billing["country"]))
+	y = y - 24
+	doc.TextRight(right, y, 12, true, "Total: "+formatCurrency(inv.Total, inv.Currency, billing["country"]))
+
+	if invoiceReverseCharge(inv) {
+		doc.Text(left, y-40, 9, false, reverseChargeNote)
+	}
+
+	return doc.Bytes()
+}
+
+// Default and maximum number of invoices per page when listing invoices
+const (
+	defaultInvoicePageSize = 50
+	maxInvoicePageSize     = 500
+)
+
+// Layout of the dates used in invoice exports and the `from` and `to` query parameters
+const invoiceDateLayout = "2006-01-02"
+
+// Stable representation of an invoice as returned by the invoice export. Amounts are in the
+// smallest unit of the currency (e.g. cents), dates are formatted as YYYY-MM-DD in UTC and the
+// currency is given as a lower case ISO 4217 code. Fields are only ever added, never removed or
+// renamed. In CSV exports, columns appear in the order of `invoiceCSVHeader`
+type InvoiceRecord struct {
+	ID          string          `json:"id"`
+	Number      string          `json:"number"`
+	Date        string          `json:"date"`
+	Status      string          `json:"status"`
+	Description string          `json:"description"`
+	PeriodStart string          `json:"periodStart"`
+	PeriodEnd   string          `json:"periodEnd"`
+	Currency    stripe.Currency `json:"currency"`
+	Subtotal    int64           `json:"subtotal"`
+	TaxPercent  float64         `json:"taxPercent"`
+	Tax         int64           `json:"tax"`
+	Total       int64           `json:"total"`
+	AmountPaid  int64           `json:"amountPaid"`
+}
+
+var invoiceCSVHeader = []string{
+	"id",
+	"number",
+	"date",
+	"status",
+	"description",
+	"periodStart",
+	"periodEnd",
+	"currency",
+	"subtotal",
+	"taxPercent",
+	"tax",
+	"total",
+	"amountPaid",
+}
+
+func formatInvoiceDate(timestamp int64) string {
+	if timestamp == 0 {
+		return ""
+	}
+	return time.Unix(timestamp, 0).UTC().Format(invoiceDateLayout)
+}
+
+func NewInvoiceRecord(inv *stripe.Invoice) *InvoiceRecord {
+	var descs []string
+	start, end := inv.PeriodStart, inv.PeriodEnd
+	if inv.Lines != nil && len(inv.Lines.Data) != 0 {
+		start, end = 0, 0
+		for _, l := range inv.Lines.Data {
+			descs = append(descs, invoiceLineDescription(l))
+			if l.Period != nil {
+				if start == 0 || l.Period.Start < start {
+					start = l.Period.Start
+				}
+				if l.Period.End > end {
+					end = l.Period.End
+				}
+			}
+		}
+	}
+
+	return &InvoiceRecord{
+		ID:          inv.ID,
+		Number:      inv.Number,
+		Date:        formatInvoiceDate(inv.Created),
+		Status:      string(inv.Status),
+		Description: strings.Join(descs, "; "),
+		PeriodStart: formatInvoiceDate(start),
+		PeriodEnd:   formatInvoiceDate(end),
+		Currency:    inv.Currency,
+		Subtotal:    inv.Subtotal,
+		TaxPercent:  invoiceTaxPercent(inv),
+		Tax:         inv.Tax,
+		Total:       inv.Total,
+		AmountPaid:  inv.AmountPaid,
+	}
+}
+
+// Returns the record's fields in the order of `invoiceCSVHeader`
+func (rec *InvoiceRecord) CSV() []string {
+	return []string{
+		rec.ID,
+		rec.Number,
+		rec.Date,
+		rec.Status,
+		rec.Description,
+		rec.PeriodStart,
+		rec.PeriodEnd,
+		string(rec.Currency),
+		strconv.FormatInt(rec.Subtotal, 10),
+		strconv.FormatFloat(rec.TaxPercent, 'f', -1, 64),
+		strconv.FormatInt(rec.Tax, 10),
+		strconv.FormatInt(rec.Total, 10),
+		strconv.FormatInt(rec.AmountPaid, 10),
+	}
+}
+
+// Filter and pagination options for listing invoices, parsed from the following query parameters:
+//
+//	from     earliest invoice date (YYYY-MM-DD, inclusive)
+//	to       latest invoice date (YYYY-MM-DD, inclusive)
+//	status   one of "paid" (default), "open" or "void"
+//	format   "csv" or "json". Defaults to JSON if requested via the `Accept` header, HTML otherwise
+//	page     page number, starting at 1
+//	perPage  number of invoices per page (default 50, max 500)
+type InvoiceQuery struct {
+	From    time.Time
+	To      time.Time
+	Status  stripe.InvoiceStatus
+	Format  string
+	Page    int
+	PerPage int
+}
+
+func ParseInvoiceQuery(r *http.Request) (*InvoiceQuery, error) {
+	q := &InvoiceQuery{
+		Status:  stripe.InvoiceStatusPaid,
+		Page:    1,
+		PerPage: defaultInvoicePageSize,
+	}
+
+	if from := r.FormValue("from"); from != "" {
+		t, err := time.Parse(invoiceDateLayout, from)
+		if err != nil {
+			return nil, &pc.BadRequest{Msg: "Invalid date format for 'from', expected YYYY-MM-DD"}
+		}
+		q.From = t
+	}
+
+	if to := r.FormValue("to"); to != "" {
+		t, err := time.Parse(invoiceDateLayout, to)
+		if err != nil {
+			return nil, &pc.BadRequest{Msg: "Invalid date format for 'to', expected YYYY-MM-DD"}
+		}
+		// Include the whole day
+		q.To = t.AddDate(0, 0, 1)
+	}
+
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return nil, &pc.BadRequest{Msg: "'from' must not be after 'to'"}
+	}
+
+	switch status := stripe.InvoiceStatus(r.FormValue("status")); status {
+	case "":
+	case stripe.InvoiceStatusPaid, stripe.InvoiceStatusOpen, stripe.InvoiceStatusVoid:
+		q.Status = status
+	default:
+		return nil, &pc.BadRequest{Msg: "Invalid status, expected one of 'paid', 'open' or 'void'"}
+	}
+
+	switch format := r.FormValue("format"); format {
+	case "csv", "json":
+		q.Format = format
+	case "":
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			q.Format = "json"
+		} else if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			q.Format = "csv"
+		}
+	default:
+		return nil, &pc.BadRequest{Msg: "Invalid format, expected 'csv' or 'json'"}
+	}
+
+	if page := r.FormValue("page"); page != "" {
+		n, err := strconv.Atoi(page)
+		if err != nil || n < 1 {
+			return nil, &pc.BadRequest{Msg: "Invalid page number"}
+		}
+		q.Page = n
+	}
+
+	if perPage := r.FormValue("perPage"); perPage != "" {
+		n, err := strconv.Atoi(perPage)
+		if err != nil || n < 1 || n > maxInvoicePageSize {
+			return nil, &pc.BadRequest{Msg: fmt.Sprintf("Page size must be between 1 and %d", maxInvoicePageSize)}
+		}
+		q.PerPage = n
+	}
+
+	return q, nil
+}
+
+// Returns the parameters for listing the customer's invoices matching the query
+func (q *InvoiceQuery) ListParams(customerID string) *stripe.InvoiceListParams {
+	status := string(q.Status)
+	params := &stripe.InvoiceListParams{
+		Customer: &customerID,
+		Status:   &status,
+	}
+
+	if !q.From.IsZero() || !q.To.IsZero() {
+		params.CreatedRange = &stripe.RangeQueryParams{}
+		if !q.From.IsZero() {
+			params.CreatedRange.GreaterThanOrEqual = q.From.Unix()
+		}
+		if !q.To.IsZero() {
+			params.CreatedRange.LesserThan = q.To.Unix()
+		}
+	}
+
+	return params
+}
+
+// Sorts the invoices from newest to oldest and returns the requested page
+func (q *InvoiceQuery) Paginate(invoices []*stripe.Invoice) []*stripe.Invoice {
+	sort.SliceStable(invoices, func(i, j int) bool {
+		if invoices[i].Created != invoices[j].Created {
+			return invoices[i].Created > invoices[j].Created
+		}
+		return invoices[i].ID > invoices[j].ID
+	})
+
+	start := (q.Page - 1) * q.PerPage
+	if start >= len(invoices) {
+		return []*stripe.Invoice{}
+	}
+
+	end := start + q.PerPage
+	if end > len(invoices) {
+		end = len(invoices)
+	}
+
+	return invoices[start:end]
+}
+
+// Returns the url of the given page, keeping all other query parameters intact
+func (q *InvoiceQuery) PageURL(r *http.Request, page int) string {
+	v := r.URL.Query()
+	v.Set("page", strconv.Itoa(page))
+	return r.URL.Path + "?" + v.Encode()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+)
+
+// Creates a paid invoice in euros with the given number of line items
+func testInvoice(n int) *stripe.Invoice {
+	inv := &stripe.Invoice{
+		ID:         "in_test",
+		Number:     "TEST-0001",
+		Created:    time.Now().Unix(),
+		Currency:   stripe.CurrencyEUR,
+		Status:     stripe.InvoiceStatusPaid,
+		TaxPercent: 19,
+		Lines:      &stripe.InvoiceLineList{},
+	}
+
+	for i := 0; i < n; i++ {
+		inv.Lines.Data = append(inv.Lines.Data, &stripe.InvoiceLine{
+			Description: fmt.Sprintf("Item %d", i+1),
+			Amount:      1000,
+			Currency:    stripe.CurrencyEUR,
+		})
+		inv.Subtotal = inv.Subtotal + 1000
+	}
+	inv.Tax = inv.Subtotal * 19 / 100
+	inv.Total = inv.Subtotal + inv.Tax
+
+	return inv
+}
+
+var testBilling = map[string]string{
+	"name":       "Alice",
+	"address1":   "1 Main St",
+	"postalCode": "10115",
+	"city":       "Berlin",
+	"country":    "DE",
+}
+
+func TestRenderInvoicePDF(t *testing.T) {
+	// Enough lines to spill over onto additional pages
+	inv := testInvoice(60)
+	doc := renderInvoicePDF(inv, testBilling)
+
+	if !bytes.HasPrefix(doc, []byte("%PDF-")) {
+		t.Fatal("Expected a PDF document")
+	}
+
+	if m := regexp.MustCompile(`/Count (\d+)`).FindSubmatch(doc); m == nil {
+		t.Fatal("Expected a page tree")
+	} else if n, _ := strconv.Atoi(string(m[1])); n < 2 {
+		t.Errorf("Expected invoice to span multiple pages, got %d", n)
+	}
+
+	// Every object listed in the cross-reference table has to be found at the given offset
+	xref := bytes.Index(doc, []byte("\nxref\n"))
+	if xref == -1 {
+		t.Fatal("Expected a cross-reference table")
+	}
+	for i, m := range regexp.MustCompile(`(\d{10}) 00000 n`).FindAllSubmatch(doc[xref:], -1) {
+		offset, _ := strconv.Atoi(string(m[1]))
+		if !bytes.HasPrefix(doc[offset:], []byte(fmt.Sprintf("%d 0 obj", i+1))) {
+			t.Errorf("Expected object %d at offset %d", i+1, offset)
+		}
+	}
+
+	content := string(doc)
+
+	for _, l := range invoiceIssuer {
+		if !strings.Contains(content, "("+pdfEscape(l)+")") {
+			t.Errorf("Expected issuer line %q to be printed", l)
+		}
+	}
+
+	for _, l := range inv.Lines.Data {
+		if !strings.Contains(content, "("+l.Description+")") {
+			t.Errorf("Expected line item %q to be printed", l.Description)
+		}
+	}
+
+	total := formatCurrency(inv.Total, inv.Currency, testBilling["country"])
+	if !strings.Contains(total, "€") {
+		t.Fatalf("Expected total to be formatted with the euro sign, got %q", total)
+	}
+	// The euro sign is encoded as 0x80 in the WinAnsi encoding used by the standard fonts
+	if !strings.Contains(content, "(Total: "+strings.Replace(total, "€", "\x80", -1)+")") {
+		t.Errorf("Expected total %q to be printed with the euro sign", total)
+	}
+}
+
+func TestInvoiceTemplateIssuer(t *testing.T) {
+	tt := &Templates{Templates: &pc.Templates{
+		BaseEmail: template.Must(template.New("base").Parse("")),
+	}}
+	if err := LoadTemplates(tt, "assets/templates"); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := tt.Invoice.Execute(&b, &map[string]interface{}{
+		"invoice": testInvoice(2),
+		"billing": testBilling,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The web version of the invoice has to show the same issuer as the PDF
+	for _, l := range invoiceIssuer {
+		if !strings.Contains(b.String(), template.HTMLEscapeString(l)) {
+			t.Errorf("Expected issuer line %q in invoice page", l)
+		}
+	}
+}
@@ -1,15 +1,17 @@
-// +build none
-
 package main
 
-import "time"
-import "encoding/json"
-import "strconv"
-import "net/http"
-import "bytes"
-import "io/ioutil"
-import "errors"
-import "fmt"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+)
 
 const (
 	ItunesStatusOK                   = 0
@@ -32,6 +34,9 @@ const ReceiptTypeItunes = "ios-appstore"
 
 var ErrInvalidReceipt = errors.New("padlock: invalid receipt")
 
+// Returned when a receipt or purchase that is already linked to one account is submitted by another
+var ErrReceiptInUse = errors.New("padlock: receipt is linked to another account")
+
 type ItunesInterface interface {
 	ValidateReceipt(string) (*ItunesPlan, error)
 }
@@ -39,53 +44,143 @@ type ItunesInterface interface {
 type ItunesConfig struct {
 	SharedSecret string `yaml:"shared_secret"`
 	Environment  string `yaml:"environment"`
+	// Explicit url to use in place of Apple's verifyReceipt endpoints (e.g. for testing)
+	VerifyUrl string `yaml:"verify_url"`
+}
+
+// Maps the original transaction id of an iTunes purchase to the account it belongs to, so that the
+// same receipt can't be used to unlock more than one account
+type ItunesTransaction struct {
+	OriginalTransactionID string
+	Email                 string
+}
+
+// Implements the `Key` method of the `Storable` interface
+func (t *ItunesTransaction) Key() []byte {
+	return []byte(t.OriginalTransactionID)
+}
+
+// Implementation of the `Storable.Deserialize` method
+func (t *ItunesTransaction) Deserialize(data []byte) error {
+	return json.Unmarshal(data, t)
+}
+
+// Implementation of the `Storable.Serialize` method
+func (t *ItunesTransaction) Serialize() ([]byte, error) {
+	return json.Marshal(t)
 }
 
 type ItunesServer struct {
 	Config *ItunesConfig
+	Client *http.Client
+}
+
+func NewItunesServer(config *ItunesConfig) *ItunesServer {
+	return &ItunesServer{
+		Config: config,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type itunesReceiptInfo struct {
+	// Legacy (iOS 6 style) receipts
+	Expires string `json:"expires_date"`
+	// iOS 7 style receipts
+	ExpiresMs             string `json:"expires_date_ms"`
+	OriginalTransactionID string `json:"original_transaction_id"`
+}
+
+func (info *itunesReceiptInfo) expiresMs() (int64, error) {
+	str := info.ExpiresMs
+	if str == "" {
+		str = info.Expires
+	}
+	if str == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(str, 10, 64)
+}
+
+// Returns the latest expiration date found in the given receipt info, which may either be a single
+// object (legacy receipts) or a list of transactions (iOS 7 style receipts), along with the
+// original transaction id of the corresponding transaction
+func latestExpires(data json.RawMessage) (int64, string, error) {
+	if len(data) == 0 {
+		return 0, "", nil
+	}
+
+	var infos []*itunesReceiptInfo
+	if data[0] == '[' {
+		if err := json.Unmarshal(data, &infos); err != nil {
+			return 0, "", err
+		}
+	} else {
+		info := &itunesReceiptInfo{}
+		if err := json.Unmarshal(data, info); err != nil {
+			return 0, "", err
+		}
+		infos = append(infos, info)
+	}
+
+	var latest int64
+	var originalTransactionID string
+	for _, info := range infos {
+		expires, err := info.expiresMs()
+		if err != nil {
+			return 0, "", err
+		}
+		if expires >= latest {
+			latest = expires
+			originalTransactionID = info.OriginalTransactionID
+		}
+	}
+
+	return latest, originalTransactionID, nil
 }
 
 func parseItunesResult(data []byte) (*ItunesPlan, error) {
 	result := &struct {
-		Status            int `json:"status"`
-		LatestReceiptInfo struct {
-			Expires string `json:"expires_date"`
-		} `json:"latest_receipt_info"`
-		LatestExpiredReceiptInfo struct {
-			Expires string `json:"expires_date"`
-		} `json:"latest_expired_receipt_info"`
-		LatestReceipt string `json:"latest_receipt"`
+		Status                   int             `json:"status"`
+		LatestReceiptInfo        json.RawMessage `json:"latest_receipt_info"`
+		LatestExpiredReceiptInfo json.RawMessage `json:"latest_expired_receipt_info"`
+		LatestReceipt            string          `json:"latest_receipt"`
 	}{}
 
 	if err := json.Unmarshal(data, result); err != nil {
 		return nil, err
 	}
 
-	expiresStr := result.LatestReceiptInfo.Expires
-	if expiresStr == "" {
-		expiresStr = result.LatestExpiredReceiptInfo.Expires
+	expiresMs, originalTransactionID, err := latestExpires(result.LatestReceiptInfo)
+	if err != nil {
+		return nil, err
 	}
 
-	var expiresInt int
-	var err error
-	if expiresStr != "" {
-		if expiresInt, err = strconv.Atoi(expiresStr); err != nil {
+	if expiresMs == 0 {
+		if expiresMs, originalTransactionID, err = latestExpires(result.LatestExpiredReceiptInfo); err != nil {
 			return nil, err
 		}
 	}
 
-	expires := time.Unix(0, int64(expiresInt)*1000000)
-
 	plan := NewItunesPlan()
-	plan.Expires = expires
+	plan.Expires = time.Unix(0, expiresMs*int64(time.Millisecond))
 	plan.Receipt = result.LatestReceipt
 	plan.Status = result.Status
+	plan.OriginalTransactionID = originalTransactionID
 
 	return plan, nil
 }
 
-func (itunes *ItunesServer) ValidateReceipt(receipt string) (*ItunesPlan, error) {
-	fmt.Printf("validating receipt %s, environment: %s", receipt, itunes.Config.Environment)
+func (itunes *ItunesServer) verifyUrl(sandbox bool) string {
+	if itunes.Config.VerifyUrl != "" {
+		return itunes.Config.VerifyUrl
+	} else if sandbox {
+		return ItunesUrlSandbox
+	} else {
+		return ItunesUrlProduction
+	}
+}
+
+func (itunes *ItunesServer) postReceipt(receipt string, sandbox bool) (*ItunesPlan, error) {
 	body, err := json.Marshal(map[string]string{
 		"receipt-data": receipt,
 		"password":     itunes.Config.SharedSecret,
@@ -94,24 +189,45 @@ func (itunes *ItunesServer) ValidateReceipt(receipt string) (*ItunesPlan, error)
 		return nil, err
 	}
 
-	var itunesUrl string
-	if itunes.Config.Environment == "production" {
-		itunesUrl = ItunesUrlProduction
-	} else {
-		itunesUrl = ItunesUrlSandbox
+	resp, err := itunes.Client.Post(itunes.verifyUrl(sandbox), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	resp, err := http.Post(itunesUrl, "application/json", bytes.NewBuffer(body))
+	respData, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	respData, err := ioutil.ReadAll(resp.Body)
+	plan, err := parseItunesResult(respData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Latest receipt is only included for auto-renewable subscriptions; Hold on to the original
+	// receipt otherwise so we can revalidate it later
+	if plan.Receipt == "" {
+		plan.Receipt = receipt
+	}
+
+	return plan, nil
+}
+
+func (itunes *ItunesServer) ValidateReceipt(receipt string) (*ItunesPlan, error) {
+	sandbox := itunes.Config.Environment != "production"
+
+	result, err := itunes.postReceipt(receipt, sandbox)
 	if err != nil {
 		return nil, err
 	}
 
-	result, err := parseItunesResult(respData)
+	// Receipts from TestFlight and App Review are issued by the sandbox environment even in production
+	if result.Status == ItunesStatusWrongEnvironmentProd && !sandbox {
+		if result, err = itunes.postReceipt(receipt, true); err != nil {
+			return nil, err
+		}
+	}
 
 	switch result.Status {
 	case ItunesStatusOK, ItunesStatusExpired:
@@ -123,50 +239,51 @@ func (itunes *ItunesServer) ValidateReceipt(receipt string) (*ItunesPlan, error)
 	}
 }
 
-type ValidateItunesReceipt struct {
-	*Server
-}
-
-func (h *ValidateItunesReceipt) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
-	receiptType := r.PostFormValue("type")
-	receiptData := r.PostFormValue("receipt")
-	email := r.PostFormValue("email")
+// Attaches a validated iTunes plan to the given account and records which account the purchase
+// belongs to. Returns `ErrReceiptInUse` if the purchase is already linked to another account
+func (server *Server) SetItunesPlan(acc *Account, plan *ItunesPlan) error {
+	if id := plan.OriginalTransactionID; id != "" {
+		t := &ItunesTransaction{OriginalTransactionID: id}
+		if err := server.Storage.Get(t); err == nil && t.Email != acc.Email {
+			return ErrReceiptInUse
+		} else if err != nil && err != pc.ErrNotFound {
+			return err
+		}
 
-	// Make sure all required parameters are there
-	if email == "" || receiptType == "" || receiptData == "" {
-		return &pc.BadRequest{"Missing email, receiptType or receiptData field"}
+		if err := server.Storage.Put(&ItunesTransaction{
+			OriginalTransactionID: id,
+			Email:                 acc.Email,
+		}); err != nil {
+			return err
+		}
 	}
 
-	acc := &Account{Email: email}
+	acc.Plans.Itunes = plan
+	return server.Storage.Put(acc)
+}
 
-	// Load existing account data if there is any. If not, that's fine, one will be created later
-	// if the receipt turns out fine
-	if err := h.Storage.Get(acc); err != nil && err != pc.ErrNotFound {
-		return err
+// Returns all iTunes purchases linked to the account with the given email
+func (server *Server) itunesTransactions(email string) ([]*ItunesTransaction, error) {
+	iter, err := server.Storage.Iterator(&ItunesTransaction{})
+	if err != nil {
+		return nil, err
 	}
+	defer iter.Release()
 
-	switch receiptType {
-	case ReceiptTypeItunes:
-		// Validate receipt
-		plan, err := h.Itunes.ValidateItunesReceipt(receiptData)
-		// If the receipt is invalid or the subcription expired, return the appropriate error
-		if err == ErrInvalidReceipt || plan.Status == ItunesStatusExpired {
-			return &pc.BadRequest{"Invalid itunes receipt"}
-		}
-
-		if err != nil {
-			return err
+	var transactions []*ItunesTransaction
+	for iter.Next() {
+		t := &ItunesTransaction{}
+		if err := iter.Get(t); err != nil {
+			return nil, err
 		}
-
-		// Save the plan with the corresponding account
-		acc.Plans.Itunes = plan
-		if err := h.Storage.Put(acc); err != nil {
-			return err
+		if t.Email == email {
+			transactions = append(transactions, t)
 		}
-	default:
-		return &pc.BadRequest{"Invalid receipt type"}
 	}
 
-	w.WriteHeader(http.StatusNoContent)
-	return nil
+	return transactions, nil
+}
+
+func init() {
+	pc.RegisterStorable(&ItunesTransaction{}, "itunes-transactions")
 }
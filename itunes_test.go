@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+)
+
+// Stand-in for Apple's verifyReceipt endpoint. Knows the following receipts:
+//   - "valid": an active subscription
+//   - "expired": a legacy receipt for a subscription that has run out
+//   - "testflight": a sandbox receipt, rejected on the first attempt as it would be in production
+//
+// Anything else is reported as an invalid receipt
+func newFakeItunesApi(t *testing.T, secret string, expires time.Time) *httptest.Server {
+	var mutex sync.Mutex
+	attempts := make(map[string]int)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &struct {
+			Receipt  string `json:"receipt-data"`
+			Password string `json:"password"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("Invalid request body: %v", err)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": ItunesStatusInvalidJSON})
+			return
+		}
+
+		mutex.Lock()
+		attempts[req.Receipt] = attempts[req.Receipt] + 1
+		n := attempts[req.Receipt]
+		mutex.Unlock()
+
+		expiresMs := fmt.Sprintf("%d", expires.UnixNano()/int64(time.Millisecond))
+
+		var res map[string]interface{}
+		switch {
+		case req.Password != secret:
+			res = map[string]interface{}{"status": ItunesStatusWrongSecret}
+		case req.Receipt == "valid", req.Receipt == "testflight" && n > 1:
+			res = map[string]interface{}{
+				"status": ItunesStatusOK,
+				"latest_receipt_info": []map[string]interface{}{
+					{"expires_date_ms": "1000", "original_transaction_id": "1000001"},
+					{"expires_date_ms": expiresMs, "original_transaction_id": "1000001"},
+				},
+				"latest_receipt": req.Receipt + "-latest",
+			}
+		case req.Receipt == "testflight":
+			res = map[string]interface{}{"status": ItunesStatusWrongEnvironmentProd}
+		case req.Receipt == "expired":
+			res = map[string]interface{}{
+				"status": ItunesStatusExpired,
+				"latest_expired_receipt_info": map[string]interface{}{
+					"expires_date":            "1000",
+					"original_transaction_id": "1000002",
+				},
+			}
+		default:
+			res = map[string]interface{}{"status": ItunesStatusInvalidReceipt}
+		}
+
+		json.NewEncoder(w).Encode(res)
+	}))
+}
+
+func TestItunesValidateReceipt(t *testing.T) {
+	expires := time.Now().Add(24 * time.Hour).Truncate(time.Millisecond)
+	api := newFakeItunesApi(t, "secret", expires)
+	defer api.Close()
+
+	itunes := NewItunesServer(&ItunesConfig{SharedSecret: "secret", Environment: "production", VerifyUrl: api.URL})
+
+	plan, err := itunes.ValidateReceipt("valid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Expires.Equal(expires) || !plan.Active() {
+		t.Errorf("Expected plan to be active until %v, got %v", expires, plan.Expires)
+	}
+	if plan.Receipt != "valid-latest" {
+		t.Errorf("Expected latest receipt to be stored, got %q", plan.Receipt)
+	}
+	if plan.OriginalTransactionID != "1000001" {
+		t.Errorf("Expected original transaction id %q, got %q", "1000001", plan.OriginalTransactionID)
+	}
+
+	if plan, err = itunes.ValidateReceipt("testflight"); err != nil {
+		t.Fatal(err)
+	} else if !plan.Active() {
+		t.Error("Expected sandbox receipt to be accepted in production")
+	}
+
+	if plan, err = itunes.ValidateReceipt("expired"); err != nil {
+		t.Fatal(err)
+	} else if plan.Status != ItunesStatusExpired || plan.Active() || plan.Receipt != "expired" {
+		t.Errorf("Unexpected plan for expired receipt: %+v", plan)
+	} else if plan.OriginalTransactionID != "1000002" {
+		t.Errorf("Expected original transaction id %q, got %q", "1000002", plan.OriginalTransactionID)
+	}
+
+	if _, err := itunes.ValidateReceipt("bogus"); err != ErrInvalidReceipt {
+		t.Errorf("Expected ErrInvalidReceipt, got %v", err)
+	}
+
+	itunes.Config.SharedSecret = "wrong"
+	if _, err := itunes.ValidateReceipt("valid"); err == nil || err == ErrInvalidReceipt {
+		t.Errorf("Expected configuration errors not to be treated as invalid receipts, got %v", err)
+	}
+}
+
+func TestValidateItunesReceiptRejectsReuse(t *testing.T) {
+	server := newTestServer(t)
+
+	api := newFakeItunesApi(t, "secret", time.Now().Add(24*time.Hour))
+	defer api.Close()
+
+	server.ItunesConfig = &ItunesConfig{SharedSecret: "secret", VerifyUrl: api.URL}
+	server.Itunes = NewItunesServer(server.ItunesConfig)
+
+	validate := func(email string) error {
+		r := httptest.NewRequest("POST", "/validatereceipt/", strings.NewReader(url.Values{
+			"type":    {ReceiptTypeItunes},
+			"receipt": {"valid"},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return (&ValidateReceipt{server}).Handle(httptest.NewRecorder(), r, &pc.AuthToken{Email: email})
+	}
+
+	if err := validate("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Submitting the receipt again from the same account is fine
+	if err := validate("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := validate("bob@example.com").(*pc.BadRequest); !ok {
+		t.Error("Expected receipt linked to another account to be rejected")
+	}
+
+	alice, _ := server.GetAccount("alice@example.com")
+	if alice.Plans.Itunes == nil || !alice.Plans.Itunes.Active() {
+		t.Error("Expected plan to be attached to the first account")
+	}
+
+	bob, _ := server.GetAccount("bob@example.com")
+	if bob.Plans.Itunes != nil {
+		t.Error("Expected no plan to be attached to the second account")
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 func NoSubRequired(a *pc.AuthToken) bool {
@@ -31,6 +38,20 @@ func (m *CheckSubscription) Wrap(h pc.Handler) pc.Handler {
 			return err
 		}
 
+		// App store subscriptions may have been renewed since we last checked. Plans are recreated on
+		// every validation, so `Created` tells us when that was
+		if !acc.HasActivePlan() {
+			for _, p := range acc.Plans.All() {
+				if time.Since(p.Created) > time.Hour {
+					if _, err := m.CheckPlansForAccount(acc); err != nil {
+						m.LogError(err, r)
+					}
+					break
+				}
+			}
+		}
+
+		ent := acc.Entitlement()
 		status, trialEnd := acc.SubscriptionStatus()
 
 		if NoSubRequired(a) {
@@ -41,8 +62,83 @@ func (m *CheckSubscription) Wrap(h pc.Handler) pc.Handler {
 		w.Header().Set("X-Sub-Trial-End", strconv.FormatInt(trialEnd, 10))
 		w.Header().Set("X-Stripe-Pub-Key", m.StripeConfig.PublicKey)
 
-		if m.RequireSub && status != "trialing" && status != "active" {
-			return &SubscriptionRequired{}
+		if ent != nil {
+			w.Header().Set("X-Sub-Source", string(ent.Source))
+			w.Header().Set("X-Sub-Tier", string(ent.Tier))
+			w.Header().Set("X-Sub-Valid-Until", strconv.FormatInt(ent.ValidUntil.Unix(), 10))
+			if !ent.GraceUntil.IsZero() {
+				w.Header().Set("X-Sub-Grace-Until", strconv.FormatInt(ent.GraceUntil.Unix(), 10))
+			}
+		}
+
+		if m.RequireSub && !NoSubRequired(a) {
+			if ent == nil {
+				return &SubscriptionRequired{}
+			} else if ent.Paused {
+				// Paused accounts stay readable but can't be written to
+				return &SubscriptionPaused{}
+			}
+		}
+
+		return h.Handle(w, r, a)
+	})
+}
+
+// Maximum age of the timestamp included in signed admin requests
+const adminSignatureTolerance = 5 * time.Minute
+
+// Restricts access to administrative endpoints. Requests need to either provide the admin secret
+// as the password via basic auth or be signed with it. Signed requests include the current unix
+// time in the `X-Admin-Timestamp` header and the hex encoded HMAC-SHA256 of
+// "<timestamp>.<request body>" in the `X-Admin-Signature` header
+type RequireAdmin struct {
+	*Server
+}
+
+func (m *RequireAdmin) authorized(r *http.Request) (bool, error) {
+	secret := []byte(m.PromoConfig.AdminSecret)
+	if len(secret) == 0 {
+		return false, nil
+	}
+
+	if _, password, ok := r.BasicAuth(); ok {
+		return hmac.Equal([]byte(password), secret), nil
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get("X-Admin-Timestamp"), 10, 64)
+	if err != nil {
+		return false, nil
+	}
+
+	if age := time.Since(time.Unix(ts, 0)); age > adminSignatureTolerance || age < -adminSignatureTolerance {
+		return false, nil
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get("X-Admin-Signature"))
+	if err != nil {
+		return false, nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return false, err
+	}
+	// Make the body available to the wrapped handler again
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+
+	return hmac.Equal(signature, mac.Sum(nil)), nil
+}
+
+func (m *RequireAdmin) Wrap(h pc.Handler) pc.Handler {
+	return pc.HandlerFunc(func(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+		if ok, err := m.authorized(r); err != nil {
+			return err
+		} else if !ok {
+			return &pc.UnauthorizedError{}
 		}
 
 		return h.Handle(w, r, a)
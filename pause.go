@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+)
+
+// Maximum number of months a subscription can be paused for
+const maxPauseMonths = 3
+
+// Describes a paused subscription. Pauses start at the end of the period the customer already paid
+// for. While paused, no payments are collected and the account is read-only
+type SubscriptionPause struct {
+	Started   time.Time `json:"started"`
+	ResumesAt time.Time `json:"resumesAt"`
+}
+
+// Whether the pause is currently in effect
+func (p *SubscriptionPause) Active() bool {
+	now := time.Now()
+	return !p.Started.After(now) && p.ResumesAt.After(now)
+}
+
+// Whether the pause has run out
+func (p *SubscriptionPause) Ended() bool {
+	return !p.ResumesAt.After(time.Now())
+}
+
+// Resumes payment collection for the account's subscription and clears the pause
+func (server *Server) ResumeSubscription(acc *Account) error {
+	if s := acc.Subscription(); s != nil {
+		if _, err := server.Billing.ResumeSubscription(s.ID); err != nil {
+			return err
+		}
+	}
+
+	acc.Pause = nil
+
+	if c, err := server.Billing.GetCustomer(acc.Customer.ID); err != nil {
+		return err
+	} else {
+		acc.SetCustomer(c)
+	}
+
+	return server.Storage.Put(acc)
+}
+
+// Resumes all subscriptions whose pause has run out. Stripe resumes collection on its own, so
+// this is mostly about cleaning up in case we missed the corresponding webhook event
+func (server *Server) ResumeDueSubscriptions() error {
+	acc := &Account{}
+	iter, err := server.Storage.Iterator(acc)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	var due []string
+	for iter.Next() {
+		acc := &Account{}
+		if err := iter.Get(acc); err != nil {
+			return err
+		}
+		if acc.Pause != nil && acc.Pause.Ended() {
+			due = append(due, acc.Email)
+		}
+	}
+
+	n := 0
+	for _, email := range due {
+		server.LockAccount(email)
+		acc, err := server.GetAccount(email)
+		if err == nil && acc != nil && acc.Pause != nil {
+			err = server.ResumeSubscription(acc)
+		}
+		server.UnlockAccount(email)
+
+		if err != nil {
+			server.Error.Printf("Error while resuming subscription for %s: %v", email, err)
+		} else {
+			n = n + 1
+		}
+	}
+
+	if n > 0 {
+		server.Info.Printf("Resumed %d paused subscriptions", n)
+	}
+
+	return nil
+}
+
+// Clears the account's pause once Stripe reports that collection has been resumed
+func (h *StripeHook) handleSubscriptionUpdated(acc *Account, event *stripe.Event, r *http.Request) error {
+	sub := &struct {
+		PauseCollection *struct {
+			ResumesAt int64 `json:"resumes_at"`
+		} `json:"pause_collection"`
+	}{}
+	if err := json.Unmarshal(event.Data.Raw, sub); err != nil {
+		return err
+	}
+
+	if acc.Pause != nil && (sub.PauseCollection == nil || event.Type == "customer.subscription.deleted") {
+		acc.Pause = nil
+		h.Info.Printf("%s - stripe_hook - %s resumed", pc.FormatRequest(r), acc.Email)
+	}
+
+	return nil
+}
+
+type PauseSubscription struct {
+	*Server
+}
+
+func (h *PauseSubscription) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	months, err := strconv.Atoi(r.PostFormValue("months"))
+	if err != nil || months < 1 || months > maxPauseMonths {
+		return &pc.BadRequest{Msg: fmt.Sprintf("Pause length must be between 1 and %d months", maxPauseMonths)}
+	}
+
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	s := acc.Subscription()
+	if s == nil || s.Status != stripe.SubscriptionStatusActive {
+		return &pc.BadRequest{Msg: "This account does not have an active subscription"}
+	}
+
+	if acc.Pause != nil && !acc.Pause.Ended() {
+		return &pc.BadRequest{Msg: "This subscription is already paused"}
+	}
+
+	// Collection is paused right away so that the upcoming renewal gets voided, but the account keeps
+	// full access until the end of the current period
+	start := time.Unix(s.CurrentPeriodEnd, 0)
+	resumesAt := start.AddDate(0, months, 0)
+
+	if _, err := h.Billing.PauseSubscription(s.ID, resumesAt); err != nil {
+		return err
+	}
+
+	acc.Pause = &SubscriptionPause{
+		Started:   start,
+		ResumesAt: resumesAt,
+	}
+
+	if err := h.Storage.Put(acc); err != nil {
+		return err
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=paused", http.StatusFound)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	h.Info.Printf("%s - pause_subscription - %s:%d\n", pc.FormatRequest(r), acc.Email, months)
+
+	h.Track(&TrackingEvent{
+		Name: "Pause Subscription",
+		Properties: map[string]interface{}{
+			"Months": months,
+		},
+		authToken: a,
+		request:   r,
+	})
+
+	return nil
+}
+
+type ResumeSubscription struct {
+	*Server
+}
+
+func (h *ResumeSubscription) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	acc, err := h.GetOrCreateAccount(a.Email)
+	if err != nil {
+		return err
+	}
+
+	if acc.Pause == nil {
+		return &pc.BadRequest{Msg: "This subscription is not paused"}
+	}
+
+	if err := h.ResumeSubscription(acc); err != nil {
+		return err
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=resumed", http.StatusFound)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	h.Info.Printf("%s - resume_subscription - %s\n", pc.FormatRequest(r), acc.Email)
+
+	h.Track(&TrackingEvent{
+		Name:      "Resume Subscription",
+		authToken: a,
+		request:   r,
+	})
+
+	return nil
+}
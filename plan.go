@@ -1,5 +1,3 @@
-// +build none
-
 package main
 
 import "time"
@@ -39,6 +37,8 @@ type ItunesPlan struct {
 	*Plan
 	Receipt string
 	Status  int
+	// Identifies the purchase across renewals and restores
+	OriginalTransactionID string
 }
 
 func NewItunesPlan() *ItunesPlan {
@@ -47,25 +47,68 @@ func NewItunesPlan() *ItunesPlan {
 	}
 }
 
+// Subscriptions purchased through app stores and access granted outside of Stripe
+type AccountPlans struct {
+	Itunes *ItunesPlan `json:"itunes,omitempty"`
+	Play   *PlayPlan   `json:"play,omitempty"`
+	// Complimentary access granted by support
+	Comp *FreePlan `json:"comp,omitempty"`
+	// Free access granted as part of a promotion
+	Promo *FreePlan `json:"promo,omitempty"`
+}
+
+// Returns all app store plans attached to the account
+func (plans *AccountPlans) All() []*Plan {
+	var all []*Plan
+	if plans.Itunes != nil {
+		all = append(all, plans.Itunes.Plan)
+	}
+	if plans.Play != nil {
+		all = append(all, plans.Play.Plan)
+	}
+	return all
+}
+
+// Revalidates any app store plans attached to the account and saves the result
 func (server *Server) UpdatePlansForAccount(acc *Account) error {
 	if acc.Plans.Itunes != nil {
 		// Revalidate itunes receipt to see if the plan has been renewed
 		plan, err := server.Itunes.ValidateReceipt(acc.Plans.Itunes.Receipt)
-		if err != nil {
+		if err == ErrInvalidReceipt {
+			acc.Plans.Itunes = nil
+		} else if err != nil {
+			return err
+		} else if err := server.SetItunesPlan(acc, plan); err == ErrReceiptInUse {
+			acc.Plans.Itunes = nil
+		} else if err != nil {
 			return err
 		}
 
-		acc.Plans.Itunes = plan
 		if err := server.Storage.Put(acc); err != nil {
 			return err
 		}
 
 		// If the itunes plan has been renewed then we can stop right here
-		if acc.Plans.Itunes.Active() {
+		if acc.Plans.Itunes != nil && acc.Plans.Itunes.Active() {
 			return nil
 		}
 	}
 
+	if p := acc.Plans.Play; p != nil {
+		// Revalidate purchase token to see if the plan has been renewed
+		plan, err := server.Play.ValidatePurchase(p.SubscriptionID, p.PurchaseToken)
+		if err == ErrInvalidReceipt {
+			acc.Plans.Play = nil
+			if err := server.Storage.Put(acc); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if err := server.SetPlayPlan(acc, plan); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -80,3 +123,51 @@ func (server *Server) CheckPlansForAccount(acc *Account) (bool, error) {
 
 	return acc.HasActivePlan(), nil
 }
+
+// Revalidates all app store plans that have expired or are about to expire. Used for picking up
+// renewals (and cancellations) that happened since the last validation
+func (server *Server) RevalidatePlans() error {
+	acc := &Account{}
+	iter, err := server.Storage.Iterator(acc)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	var due []string
+	for iter.Next() {
+		acc := &Account{}
+		if err := iter.Get(acc); err != nil {
+			return err
+		}
+		for _, p := range acc.Plans.All() {
+			// Plans that lapsed a long time ago are unlikely to be renewed, so we stop checking on them
+			if time.Until(p.Expires) < 24*time.Hour && time.Since(p.Expires) < 30*24*time.Hour {
+				due = append(due, acc.Email)
+				break
+			}
+		}
+	}
+
+	n := 0
+	for _, email := range due {
+		server.LockAccount(email)
+		acc, err := server.GetAccount(email)
+		if err == nil && acc != nil {
+			err = server.UpdatePlansForAccount(acc)
+		}
+		server.UnlockAccount(email)
+
+		if err != nil {
+			server.Error.Printf("Error while revalidating plans for %s: %v", email, err)
+		} else {
+			n = n + 1
+		}
+	}
+
+	if n > 0 {
+		server.Info.Printf("Revalidated app store plans for %d accounts", n)
+	}
+
+	return nil
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PlayUrlProduction = "https://androidpublisher.googleapis.com"
+	PlayTokenUrl      = "https://oauth2.googleapis.com/token"
+	PlayScope         = "https://www.googleapis.com/auth/androidpublisher"
+)
+
+const ReceiptTypePlay = "android-playstore"
+
+// Payment states as reported by the Play Developer API
+const (
+	PlayPaymentStatePending  = 0
+	PlayPaymentStateReceived = 1
+	PlayPaymentStateTrial    = 2
+	PlayPaymentStateDeferred = 3
+)
+
+// Acknowledgement states as reported by the Play Developer API. Purchases that aren't acknowledged
+// within three days are refunded and revoked by Google
+const (
+	PlayAcknowledgementPending      = 0
+	PlayAcknowledgementAcknowledged = 1
+)
+
+// Notification types sent via real-time developer notifications
+const (
+	PlayNotificationRecovered            = 1
+	PlayNotificationRenewed              = 2
+	PlayNotificationCanceled             = 3
+	PlayNotificationPurchased            = 4
+	PlayNotificationOnHold               = 5
+	PlayNotificationInGracePeriod        = 6
+	PlayNotificationRestarted            = 7
+	PlayNotificationPriceChangeConfirmed = 8
+	PlayNotificationDeferred             = 9
+	PlayNotificationPaused               = 10
+	PlayNotificationPauseScheduleChanged = 11
+	PlayNotificationRevoked              = 12
+	PlayNotificationExpired              = 13
+)
+
+type PlayInterface interface {
+	ValidatePurchase(subscriptionID string, token string) (*PlayPlan, error)
+	AcknowledgePurchase(subscriptionID string, token string) error
+}
+
+type PlayConfig struct {
+	PackageName string `yaml:"package_name"`
+	// Path to the json key file of the service account used for accessing the Play Developer API
+	ServiceAccountFile string `yaml:"service_account_file"`
+	// Explicit base url to use in place of the Play Developer API (e.g. for testing)
+	BaseUrl string `yaml:"base_url"`
+	// Secret token that has to be included in the push url of real-time developer notifications
+	NotificationToken string `yaml:"notification_token"`
+}
+
+type PlayPlan struct {
+	*Plan
+	SubscriptionID string
+	PurchaseToken  string
+	// Token of the purchase this one replaces, in case of upgrades, downgrades and resubscriptions
+	LinkedPurchaseToken  string
+	OrderID              string
+	AutoRenewing         bool
+	PaymentState         int
+	AcknowledgementState int
+}
+
+func NewPlayPlan() *PlayPlan {
+	return &PlayPlan{
+		Plan: NewPlan(0),
+	}
+}
+
+// Maps a purchase token to the account it belongs to so that real-time developer notifications,
+// which only contain the token, can be matched to an account
+type PlayPurchase struct {
+	Token string
+	Email string
+}
+
+// Implements the `Key` method of the `Storable` interface
+func (p *PlayPurchase) Key() []byte {
+	return []byte(p.Token)
+}
+
+// Implementation of the `Storable.Deserialize` method
+func (p *PlayPurchase) Deserialize(data []byte) error {
+	return json.Unmarshal(data, p)
+}
+
+// Implementation of the `Storable.Serialize` method
+func (p *PlayPurchase) Serialize() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+type playServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenUri    string `json:"token_uri"`
+}
+
+type PlayServer struct {
+	Config      *PlayConfig
+	Client      *http.Client
+	account     *playServiceAccount
+	accessToken string
+	expires     time.Time
+	mutex       sync.Mutex
+}
+
+func NewPlayServer(config *PlayConfig) *PlayServer {
+	return &PlayServer{
+		Config: config,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (play *PlayServer) baseUrl() string {
+	if play.Config.BaseUrl != "" {
+		return strings.TrimSuffix(play.Config.BaseUrl, "/")
+	}
+	return PlayUrlProduction
+}
+
+func base64UrlEncode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Fetches an OAuth2 access token for the configured service account, using the JWT bearer flow
+func (play *PlayServer) fetchAccessToken() (string, time.Duration, error) {
+	if play.account == nil {
+		data, err := ioutil.ReadFile(play.Config.ServiceAccountFile)
+		if err != nil {
+			return "", 0, err
+		}
+		account := &playServiceAccount{}
+		if err := json.Unmarshal(data, account); err != nil {
+			return "", 0, err
+		}
+		play.account = account
+	}
+
+	block, _ := pem.Decode([]byte(play.account.PrivateKey))
+	if block == nil {
+		return "", 0, errors.New("Invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", 0, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", 0, errors.New("Service account private key is not an RSA key")
+	}
+
+	tokenUrl := play.account.TokenUri
+	if tokenUrl == "" {
+		tokenUrl = PlayTokenUrl
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   play.account.ClientEmail,
+		"scope": PlayScope,
+		"aud":   tokenUrl,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64UrlEncode(header) + "." + base64UrlEncode(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", 0, err
+	}
+
+	resp, err := play.Client.PostForm(tokenUrl, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64UrlEncode(sig)},
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("Failed to obtain access token, status: %d", resp.StatusCode)
+	}
+
+	result := &struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return "", 0, err
+	}
+
+	return result.AccessToken, time.Duration(result.ExpiresIn) * time.Second, nil
+}
+
+// Returns a valid access token, fetching a new one if necessary. Returns an empty string if no
+// service account is configured (e.g. when testing against a local fake)
+func (play *PlayServer) getAccessToken() (string, error) {
+	if play.Config.ServiceAccountFile == "" {
+		return "", nil
+	}
+
+	play.mutex.Lock()
+	defer play.mutex.Unlock()
+
+	if play.accessToken == "" || time.Until(play.expires) < time.Minute {
+		token, expiresIn, err := play.fetchAccessToken()
+		if err != nil {
+			return "", err
+		}
+		play.accessToken = token
+		play.expires = time.Now().Add(expiresIn)
+	}
+
+	return play.accessToken, nil
+}
+
+func parsePlayResult(data []byte) (*PlayPlan, error) {
+	result := &struct {
+		ExpiryTimeMillis     string `json:"expiryTimeMillis"`
+		AutoRenewing         bool   `json:"autoRenewing"`
+		PaymentState         *int   `json:"paymentState"`
+		OrderID              string `json:"orderId"`
+		LinkedPurchaseToken  string `json:"linkedPurchaseToken"`
+		AcknowledgementState int    `json:"acknowledgementState"`
+	}{}
+
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+
+	expiresMs, err := strconv.ParseInt(result.ExpiryTimeMillis, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := NewPlayPlan()
+	plan.Expires = time.Unix(0, expiresMs*int64(time.Millisecond))
+	plan.AutoRenewing = result.AutoRenewing
+	plan.OrderID = result.OrderID
+	plan.LinkedPurchaseToken = result.LinkedPurchaseToken
+	plan.AcknowledgementState = result.AcknowledgementState
+	plan.PaymentState = PlayPaymentStatePending
+	if result.PaymentState != nil {
+		plan.PaymentState = *result.PaymentState
+	}
+
+	return plan, nil
+}
+
+// Sends an authorized request for the subscription purchase with the given token. `action` is
+// appended to the purchase url, e.g. ":acknowledge"
+func (play *PlayServer) purchaseRequest(method string, subscriptionID string, token string, action string) (*http.Response, error) {
+	accessToken, err := play.getAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf(
+		"%s/androidpublisher/v3/applications/%s/purchases/subscriptions/%s/tokens/%s%s",
+		play.baseUrl(),
+		url.PathEscape(play.Config.PackageName),
+		url.PathEscape(subscriptionID),
+		url.PathEscape(token),
+		action,
+	), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	return play.Client.Do(req)
+}
+
+func (play *PlayServer) ValidatePurchase(subscriptionID string, token string) (*PlayPlan, error) {
+	resp, err := play.purchaseRequest("GET", subscriptionID, token, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusGone:
+		return nil, ErrInvalidReceipt
+	default:
+		return nil, fmt.Errorf("Failed to validate purchase token, status: %d", resp.StatusCode)
+	}
+
+	plan, err := parsePlayResult(respData)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.SubscriptionID = subscriptionID
+	plan.PurchaseToken = token
+
+	return plan, nil
+}
+
+func (play *PlayServer) AcknowledgePurchase(subscriptionID string, token string) error {
+	resp, err := play.purchaseRequest("POST", subscriptionID, token, ":acknowledge")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Failed to acknowledge purchase, status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Returns the email of the account the given purchase token is linked to, or an empty string if the
+// token hasn't been registered yet
+func (server *Server) playPurchaseEmail(token string) (string, error) {
+	purchase := &PlayPurchase{Token: token}
+	if err := server.Storage.Get(purchase); err == pc.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return purchase.Email, nil
+}
+
+// Attaches a validated Play plan to the given account and makes sure the purchase token can be
+// traced back to it. Purchases that haven't been acknowledged yet are acknowledged once stored.
+// Returns `ErrReceiptInUse` if the purchase, or the purchase it replaces, is linked to another account
+func (server *Server) SetPlayPlan(acc *Account, plan *PlayPlan) error {
+	for _, token := range []string{plan.PurchaseToken, plan.LinkedPurchaseToken} {
+		if token == "" {
+			continue
+		}
+		if email, err := server.playPurchaseEmail(token); err != nil {
+			return err
+		} else if email != "" && email != acc.Email {
+			return ErrReceiptInUse
+		}
+	}
+
+	if err := server.Storage.Put(&PlayPurchase{
+		Token: plan.PurchaseToken,
+		Email: acc.Email,
+	}); err != nil {
+		return err
+	}
+
+	acc.Plans.Play = plan
+	if err := server.Storage.Put(acc); err != nil {
+		return err
+	}
+
+	// Pending purchases can only be acknowledged once the payment has gone through
+	if server.Play == nil || plan.AcknowledgementState != PlayAcknowledgementPending ||
+		plan.PaymentState == PlayPaymentStatePending {
+		return nil
+	}
+
+	// The plan stays attached either way. Acknowledging is attempted again on the next validation
+	if err := server.Play.AcknowledgePurchase(plan.SubscriptionID, plan.PurchaseToken); err != nil {
+		server.Error.Printf("Failed to acknowledge Play purchase for %s: %v", acc.Email, err)
+		return nil
+	}
+
+	plan.AcknowledgementState = PlayAcknowledgementAcknowledged
+	return server.Storage.Put(acc)
+}
+
+// Returns all purchases linked to the account with the given email
+func (server *Server) playPurchases(email string) ([]*PlayPurchase, error) {
+	iter, err := server.Storage.Iterator(&PlayPurchase{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var purchases []*PlayPurchase
+	for iter.Next() {
+		p := &PlayPurchase{}
+		if err := iter.Get(p); err != nil {
+			return nil, err
+		}
+		if p.Email == email {
+			purchases = append(purchases, p)
+		}
+	}
+
+	return purchases, nil
+}
+
+// Handler for real-time developer notifications, delivered via Cloud Pub/Sub push subscriptions
+type PlayHook struct {
+	*Server
+}
+
+func (h *PlayHook) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	// Pub/Sub push requests can't be signed, so we require a secret token in the push url instead
+	token := r.URL.Query().Get("token")
+	if h.PlayConfig.NotificationToken == "" ||
+		!hmac.Equal([]byte(token), []byte(h.PlayConfig.NotificationToken)) {
+		return &pc.UnauthorizedError{}
+	}
+
+	push := &struct {
+		Message struct {
+			Data      string `json:"data"`
+			MessageID string `json:"messageId"`
+		} `json:"message"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(push); err != nil {
+		return &pc.BadRequest{Msg: fmt.Sprintf("%v", err)}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(push.Message.Data)
+	if err != nil {
+		return &pc.BadRequest{Msg: fmt.Sprintf("%v", err)}
+	}
+
+	notification := &struct {
+		PackageName              string `json:"packageName"`
+		SubscriptionNotification *struct {
+			NotificationType int    `json:"notificationType"`
+			PurchaseToken    string `json:"purchaseToken"`
+			SubscriptionID   string `json:"subscriptionId"`
+		} `json:"subscriptionNotification"`
+	}{}
+	if err := json.Unmarshal(data, notification); err != nil {
+		return &pc.BadRequest{Msg: fmt.Sprintf("%v", err)}
+	}
+
+	// Test notifications and notifications for one-time products don't concern us
+	sn := notification.SubscriptionNotification
+	if sn == nil || notification.PackageName != h.PlayConfig.PackageName {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	var plan *PlayPlan
+
+	email, err := h.playPurchaseEmail(sn.PurchaseToken)
+	if err != nil {
+		return err
+	}
+
+	if email == "" {
+		// Upgrades, downgrades and resubscriptions come with a new purchase token, linked to the
+		// previous one, which tells us which account the purchase belongs to
+		if plan, err = h.Play.ValidatePurchase(sn.SubscriptionID, sn.PurchaseToken); err == ErrInvalidReceipt {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if plan.LinkedPurchaseToken != "" {
+			if email, err = h.playPurchaseEmail(plan.LinkedPurchaseToken); err != nil {
+				return err
+			}
+		}
+
+		// Otherwise the purchase hasn't been registered through the app yet. It will be validated then
+		if email == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+
+	h.LockAccount(email)
+	defer h.UnlockAccount(email)
+
+	acc, err := h.GetAccount(email)
+	if err != nil {
+		return err
+	}
+
+	if acc == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if plan == nil {
+		plan, err = h.Play.ValidatePurchase(sn.SubscriptionID, sn.PurchaseToken)
+	}
+
+	if err == ErrInvalidReceipt {
+		if acc.Plans.Play != nil && acc.Plans.Play.PurchaseToken == sn.PurchaseToken {
+			acc.Plans.Play = nil
+			if err := h.Storage.Put(acc); err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	} else if err := h.SetPlayPlan(acc, plan); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - play_hook - %s:%d", pc.FormatRequest(r), acc.Email, sn.NotificationType)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func init() {
+	pc.RegisterStorable(&PlayPurchase{}, "play-purchases")
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stand-in for the Play Developer API, serving the given purchases by token. Acknowledging a
+// purchase updates its `acknowledgementState`
+func newFakePlayApi(t *testing.T, packageName string, purchases map[string]map[string]interface{}) *httptest.Server {
+	var mutex sync.Mutex
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := fmt.Sprintf("/androidpublisher/v3/applications/%s/purchases/subscriptions/", packageName)
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if len(parts) != 3 || parts[1] != "tokens" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		token := strings.TrimSuffix(parts[2], ":acknowledge")
+		acknowledge := token != parts[2]
+
+		if token == "unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		purchase, ok := purchases[token]
+		if !ok {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		if acknowledge {
+			if r.Method != "POST" {
+				t.Errorf("Unexpected method for acknowledging purchase: %s", r.Method)
+			}
+			purchase["acknowledgementState"] = PlayAcknowledgementAcknowledged
+			return
+		}
+
+		json.NewEncoder(w).Encode(purchase)
+	}))
+}
+
+func playPurchaseResult(expires time.Time, linkedToken string) map[string]interface{} {
+	res := map[string]interface{}{
+		"expiryTimeMillis": fmt.Sprintf("%d", expires.UnixNano()/int64(time.Millisecond)),
+		"autoRenewing":     true,
+		"paymentState":     PlayPaymentStateReceived,
+		"orderId":          "GPA.1234",
+	}
+	if linkedToken != "" {
+		res["linkedPurchaseToken"] = linkedToken
+	}
+	return res
+}
+
+func TestPlayValidatePurchase(t *testing.T) {
+	expires := time.Now().Add(24 * time.Hour).Truncate(time.Millisecond)
+	api := newFakePlayApi(t, "com.example", map[string]map[string]interface{}{
+		"token": playPurchaseResult(expires, "previous"),
+	})
+	defer api.Close()
+
+	play := NewPlayServer(&PlayConfig{PackageName: "com.example", BaseUrl: api.URL})
+
+	plan, err := play.ValidatePurchase("monthly", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !plan.Expires.Equal(expires) || !plan.Active() {
+		t.Errorf("Expected plan to be active until %v, got %v", expires, plan.Expires)
+	}
+	if plan.SubscriptionID != "monthly" || plan.PurchaseToken != "token" || plan.OrderID != "GPA.1234" {
+		t.Errorf("Unexpected plan: %+v", plan)
+	}
+	if !plan.AutoRenewing || plan.PaymentState != PlayPaymentStateReceived {
+		t.Errorf("Unexpected plan: %+v", plan)
+	}
+	if plan.LinkedPurchaseToken != "previous" {
+		t.Errorf("Expected linked purchase token to be %q, got %q", "previous", plan.LinkedPurchaseToken)
+	}
+
+	if _, err := play.ValidatePurchase("monthly", "unknown"); err != ErrInvalidReceipt {
+		t.Errorf("Expected ErrInvalidReceipt for unknown token, got %v", err)
+	}
+
+	if _, err := play.ValidatePurchase("monthly", "unavailable"); err == nil || err == ErrInvalidReceipt {
+		t.Errorf("Expected server errors not to be treated as invalid receipts, got %v", err)
+	}
+}
+
+func TestSetPlayPlanRejectsForeignPurchases(t *testing.T) {
+	server := newTestServer(t)
+
+	alice, _ := server.CreateAccount("alice@example.com")
+	bob, _ := server.CreateAccount("bob@example.com")
+
+	plan := NewPlayPlan()
+	plan.PurchaseToken = "alice-token"
+	if err := server.SetPlayPlan(alice, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revalidating the same purchase is fine
+	if err := server.SetPlayPlan(alice, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.SetPlayPlan(bob, plan); err != ErrReceiptInUse {
+		t.Errorf("Expected ErrReceiptInUse, got %v", err)
+	}
+
+	linked := NewPlayPlan()
+	linked.PurchaseToken = "new-token"
+	linked.LinkedPurchaseToken = "alice-token"
+	if err := server.SetPlayPlan(bob, linked); err != ErrReceiptInUse {
+		t.Errorf("Expected ErrReceiptInUse for purchase linked to another account, got %v", err)
+	}
+
+	if email, _ := server.playPurchaseEmail("alice-token"); email != alice.Email {
+		t.Errorf("Expected purchase to still belong to %s, got %s", alice.Email, email)
+	}
+
+	if bob.Plans.Play != nil {
+		t.Error("Expected no plan to be attached to the other account")
+	}
+
+	if err := server.SetPlayPlan(alice, linked); err != nil {
+		t.Fatal(err)
+	}
+
+	if email, _ := server.playPurchaseEmail("new-token"); email != alice.Email {
+		t.Errorf("Expected new purchase to belong to %s, got %s", alice.Email, email)
+	}
+}
+
+func TestPlayHookLinkedPurchase(t *testing.T) {
+	server := newTestServer(t)
+
+	expires := time.Now().Add(30 * 24 * time.Hour)
+	api := newFakePlayApi(t, "com.example", map[string]map[string]interface{}{
+		"new-token": playPurchaseResult(expires, "old-token"),
+	})
+	defer api.Close()
+
+	server.PlayConfig = &PlayConfig{PackageName: "com.example", BaseUrl: api.URL, NotificationToken: "secret"}
+	server.Play = NewPlayServer(server.PlayConfig)
+
+	acc, _ := server.CreateAccount("alice@example.com")
+	old := NewPlayPlan()
+	old.PurchaseToken = "old-token"
+	old.SubscriptionID = "monthly"
+	if err := server.SetPlayPlan(acc, old); err != nil {
+		t.Fatal(err)
+	}
+
+	notify := func(token string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(map[string]interface{}{
+			"packageName": "com.example",
+			"subscriptionNotification": map[string]interface{}{
+				"notificationType": PlayNotificationPurchased,
+				"purchaseToken":    token,
+				"subscriptionId":   "yearly",
+			},
+		})
+		body, _ := json.Marshal(map[string]interface{}{
+			"message": map[string]interface{}{
+				"data":      base64.StdEncoding.EncodeToString(data),
+				"messageId": "1",
+			},
+		})
+		r := httptest.NewRequest("POST", "/playhook/?token=secret", strings.NewReader(string(body)))
+		w := httptest.NewRecorder()
+		if err := (&PlayHook{server}).Handle(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	// An upgrade is matched to the account of the purchase it replaces
+	if w := notify("new-token"); w.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+
+	acc, _ = server.GetAccount(acc.Email)
+	if p := acc.Plans.Play; p == nil || p.PurchaseToken != "new-token" || p.LinkedPurchaseToken != "old-token" || !p.Active() {
+		t.Fatalf("Expected upgraded plan to be attached to the account, got %+v", p)
+	}
+
+	if email, _ := server.playPurchaseEmail("new-token"); email != acc.Email {
+		t.Errorf("Expected new purchase to be linked to %s, got %q", acc.Email, email)
+	}
+
+	// Purchases without a known predecessor are left for the app to register
+	if w := notify("unknown-token"); w.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+	if email, _ := server.playPurchaseEmail("unknown-token"); email != "" {
+		t.Errorf("Expected unknown purchase not to be linked, got %s", email)
+	}
+}
+
+func TestSetPlayPlanAcknowledgesPurchases(t *testing.T) {
+	server := newTestServer(t)
+
+	expires := time.Now().Add(24 * time.Hour)
+	pending := playPurchaseResult(expires, "")
+	pending["paymentState"] = PlayPaymentStatePending
+	api := newFakePlayApi(t, "com.example", map[string]map[string]interface{}{
+		"token":   playPurchaseResult(expires, ""),
+		"pending": pending,
+	})
+	defer api.Close()
+
+	server.PlayConfig = &PlayConfig{PackageName: "com.example", BaseUrl: api.URL}
+	server.Play = NewPlayServer(server.PlayConfig)
+
+	alice, _ := server.CreateAccount("alice@example.com")
+	plan, err := server.Play.ValidatePurchase("monthly", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.AcknowledgementState != PlayAcknowledgementPending {
+		t.Fatalf("Expected new purchase not to be acknowledged, got %d", plan.AcknowledgementState)
+	}
+	if err := server.SetPlayPlan(alice, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	if plan, _ := server.Play.ValidatePurchase("monthly", "token"); plan.AcknowledgementState != PlayAcknowledgementAcknowledged {
+		t.Error("Expected purchase to be acknowledged")
+	}
+	if alice, _ = server.GetAccount(alice.Email); alice.Plans.Play.AcknowledgementState != PlayAcknowledgementAcknowledged {
+		t.Error("Expected acknowledgement to be stored with the plan")
+	}
+	if ent := alice.Entitlement(); ent == nil || ent.Source != EntitlementSourcePlay || ent.Tier != EntitlementTierPremium {
+		t.Errorf("Expected Play purchase to grant premium access, got %+v", ent)
+	}
+
+	// Purchases with a pending payment are neither acknowledged nor do they grant access
+	bob, _ := server.CreateAccount("bob@example.com")
+	if plan, err = server.Play.ValidatePurchase("monthly", "pending"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetPlayPlan(bob, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	if plan, _ := server.Play.ValidatePurchase("monthly", "pending"); plan.AcknowledgementState != PlayAcknowledgementPending {
+		t.Error("Expected pending purchase not to be acknowledged")
+	}
+	if ent := bob.Entitlement(); ent != nil && ent.Source == EntitlementSourcePlay {
+		t.Errorf("Expected pending purchase not to grant access, got %+v", ent)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/satori/go.uuid"
+)
+
+// Number of campaign emails sent per minute if not configured otherwise
+const defaultCampaignSendRate = 30
+
+// Placeholder in campaign email bodies that is replaced with the recipient's login link
+const campaignLinkPlaceholder = "{{link}}"
+
+type PromoConfig struct {
+	// Secret required for accessing admin endpoints like `/apply-promo/`. Admin endpoints are
+	// disabled if empty
+	AdminSecret string `yaml:"admin_secret"`
+	// Maximum number of campaign emails sent per minute. Defaults to 30
+	SendRate int `yaml:"send_rate"`
+}
+
+type CampaignRecipientStatus string
+
+const (
+	CampaignRecipientPending CampaignRecipientStatus = "pending"
+	CampaignRecipientSent    CampaignRecipientStatus = "sent"
+	CampaignRecipientSkipped CampaignRecipientStatus = "skipped"
+	CampaignRecipientFailed  CampaignRecipientStatus = "failed"
+)
+
+type CampaignRecipient struct {
+	Email  string                  `json:"email"`
+	Status CampaignRecipientStatus `json:"status"`
+	// Reason the recipient was skipped or the error that occurred while sending
+	Reason  string    `json:"reason,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// Email campaign announcing a promo to a list of accounts. Emails are sent in the background
+// by `SendCampaigns`
+type PromoCampaign struct {
+	ID      string
+	Coupon  string
+	Subject string
+	// Email body. Any `{{link}}` is replaced with the recipient's login link
+	Body       string
+	BaseUrl    string
+	Created    time.Time
+	Finished   time.Time
+	Recipients []*CampaignRecipient
+}
+
+func NewPromoCampaign(promo *Promo, baseUrl string) *PromoCampaign {
+	return &PromoCampaign{
+		ID:      uuid.NewV4().String(),
+		Coupon:  promo.Coupon.ID,
+		Subject: promo.Coupon.Metadata["emailSubject"],
+		Body:    promo.Coupon.Metadata["emailBody"],
+		BaseUrl: baseUrl,
+		Created: time.Now(),
+	}
+}
+
+// Implements the `Key` method of the `Storable` interface
+func (c *PromoCampaign) Key() []byte {
+	return []byte(c.ID)
+}
+
+// Implementation of the `Storable.Deserialize` method
+func (c *PromoCampaign) Deserialize(data []byte) error {
+	return json.Unmarshal(data, c)
+}
+
+// Implementation of the `Storable.Serialize` method
+func (c *PromoCampaign) Serialize() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func (c *PromoCampaign) AddRecipient(email string, status CampaignRecipientStatus, reason string) {
+	c.Recipients = append(c.Recipients, &CampaignRecipient{
+		Email:   email,
+		Status:  status,
+		Reason:  reason,
+		Updated: time.Now(),
+	})
+}
+
+// Number of recipients with the given status
+func (c *PromoCampaign) Count(status CampaignRecipientStatus) int {
+	n := 0
+	for _, rec := range c.Recipients {
+		if rec.Status == status {
+			n = n + 1
+		}
+	}
+	return n
+}
+
+// Progress report of the campaign
+func (c *PromoCampaign) ToMap() map[string]interface{} {
+	var finished interface{}
+	if !c.Finished.IsZero() {
+		finished = c.Finished
+	}
+
+	failures := make([]*CampaignRecipient, 0)
+	for _, rec := range c.Recipients {
+		if rec.Status == CampaignRecipientFailed {
+			failures = append(failures, rec)
+		}
+	}
+
+	return map[string]interface{}{
+		"id":       c.ID,
+		"coupon":   c.Coupon,
+		"created":  c.Created,
+		"finished": finished,
+		"total":    len(c.Recipients),
+		"pending":  c.Count(CampaignRecipientPending),
+		"sent":     c.Count(CampaignRecipientSent),
+		"skipped":  c.Count(CampaignRecipientSkipped),
+		"failed":   c.Count(CampaignRecipientFailed),
+		"failures": failures,
+	}
+}
+
+// Returns the tracking id of the account with the given email, assigning a new one if necessary.
+// Returns an empty string if the account doesn't exist (anymore)
+func (server *Server) campaignTrackingID(email string) (string, error) {
+	server.LockAccount(email)
+	defer server.UnlockAccount(email)
+
+	acc, err := server.GetAccount(email)
+	if err != nil || acc == nil {
+		return "", err
+	}
+
+	if acc.TrackingID == "" {
+		acc.TrackingID = uuid.NewV4().String()
+		if err := server.Storage.Put(acc); err != nil {
+			return "", err
+		}
+	}
+
+	return acc.TrackingID, nil
+}
+
+// Sends the campaign email to the given recipient and updates their status accordingly
+func (server *Server) sendCampaignEmail(c *PromoCampaign, rec *CampaignRecipient) {
+	rec.Updated = time.Now()
+
+	tid, err := server.campaignTrackingID(rec.Email)
+	if err == nil && tid == "" {
+		rec.Status = CampaignRecipientSkipped
+		rec.Reason = "account deleted"
+		return
+	}
+
+	var link string
+	if err == nil {
+		link, err = server.loginLink(c.BaseUrl, rec.Email, "/dashboard/?action=subscribe")
+	}
+
+	var body strings.Builder
+	if err == nil {
+		err = server.Templates.PromoCampaignEmail.Execute(&body, map[string]interface{}{
+			"body":   strings.Replace(c.Body, campaignLinkPlaceholder, link, -1),
+			"optout": fmt.Sprintf("%s/optout/?tid=%s", c.BaseUrl, tid),
+		})
+	}
+
+	if err == nil {
+		err = server.Sender.Send(rec.Email, c.Subject, body.String())
+	}
+
+	if err != nil {
+		rec.Status = CampaignRecipientFailed
+		rec.Reason = err.Error()
+	} else {
+		rec.Status = CampaignRecipientSent
+	}
+}
+
+// Sends pending campaign emails, throttled to the configured send rate. Progress is saved after
+// each email so campaigns can pick up where they left off after a restart
+func (server *Server) SendCampaigns() error {
+	rate := server.PromoConfig.SendRate
+	if rate <= 0 {
+		rate = defaultCampaignSendRate
+	}
+	interval := time.Minute / time.Duration(rate)
+
+	iter, err := server.Storage.Iterator(&PromoCampaign{})
+	if err != nil {
+		return err
+	}
+
+	var campaigns []*PromoCampaign
+	for iter.Next() {
+		c := &PromoCampaign{}
+		if err := iter.Get(c); err != nil {
+			iter.Release()
+			return err
+		}
+		if c.Finished.IsZero() {
+			campaigns = append(campaigns, c)
+		}
+	}
+	iter.Release()
+
+	sent := 0
+	for _, c := range campaigns {
+		for _, rec := range c.Recipients {
+			if sent >= rate {
+				return nil
+			}
+			if rec.Status != CampaignRecipientPending {
+				continue
+			}
+
+			server.sendCampaignEmail(c, rec)
+			sent = sent + 1
+
+			if err := server.Storage.Put(c); err != nil {
+				return err
+			}
+
+			time.Sleep(interval)
+		}
+
+		c.Finished = time.Now()
+		if err := server.Storage.Put(c); err != nil {
+			return err
+		}
+
+		server.Info.Printf("Finished promo campaign %s: %d sent, %d skipped, %d failed",
+			c.ID, c.Count(CampaignRecipientSent), c.Count(CampaignRecipientSkipped), c.Count(CampaignRecipientFailed))
+	}
+
+	return nil
+}
+
+type PromoCampaignStatus struct {
+	*Server
+}
+
+// Reports the progress of the campaign with the given id or of all campaigns if no id is provided
+func (h *PromoCampaignStatus) Handle(w http.ResponseWriter, r *http.Request, auth *pc.AuthToken) error {
+	var res interface{}
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		c := &PromoCampaign{ID: id}
+		if err := h.Storage.Get(c); err == pc.ErrNotFound {
+			return &pc.BadRequest{Msg: "No such campaign"}
+		} else if err != nil {
+			return err
+		}
+		res = c.ToMap()
+	} else {
+		iter, err := h.Storage.Iterator(&PromoCampaign{})
+		if err != nil {
+			return err
+		}
+		defer iter.Release()
+
+		campaigns := make([]map[string]interface{}, 0)
+		for iter.Next() {
+			c := &PromoCampaign{}
+			if err := iter.Get(c); err != nil {
+				return err
+			}
+			campaigns = append(campaigns, c.ToMap())
+		}
+		res = campaigns
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+
+	return nil
+}
+
+func init() {
+	pc.RegisterStorable(&PromoCampaign{}, "promo-campaigns")
+}
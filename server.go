@@ -1,16 +1,42 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	pc "github.com/padloc/padlock-cloud/padlockcloud"
 	"github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/plan"
+	"github.com/stripe/stripe-go/webhook"
+	t "html/template"
+	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// How long records of processed webhook events are kept around. Stripe retries failed
+// deliveries for up to three days, so anything older than that can safely be discarded
+const processedEventsRetention = 30 * 24 * time.Hour
+
 type StripeConfig struct {
 	SecretKey string `yaml:"stripe_secret_key"`
 	PublicKey string `yaml:"stripe_public_key"`
+	// Secret used for verifying the signatures of incoming webhook events
+	WebhookSecret string `yaml:"stripe_webhook_secret"`
+	// Maximum age of a webhook event signature in seconds. Defaults to 300
+	WebhookTolerance int `yaml:"stripe_webhook_tolerance"`
+}
+
+// Returns the maximum allowed age of webhook event signatures
+func (c *StripeConfig) WebhookToleranceDuration() time.Duration {
+	if c.WebhookTolerance <= 0 {
+		return webhook.DefaultTolerance
+	}
+	return time.Duration(c.WebhookTolerance) * time.Second
 }
 
 type MixpanelConfig struct {
@@ -20,17 +46,40 @@ type MixpanelConfig struct {
 type Server struct {
 	*pc.Server
 	Tracker
-	Templates      *Templates
-	StripeConfig   *StripeConfig
-	MixpanelConfig *MixpanelConfig
+	Billing         BillingProvider
+	Itunes          ItunesInterface
+	Play            PlayInterface
+	Templates       *Templates
+	StripeConfig    *StripeConfig
+	MixpanelConfig  *MixpanelConfig
+	TrackingConfig  *TrackingConfig
+	ItunesConfig    *ItunesConfig
+	PlayConfig      *PlayConfig
+	PricingConfig   *PricingConfig
+	PromoConfig     *PromoConfig
+	DeletionConfig  *DeletionConfig
+	cleanEvents     *pc.Job
+	revalidatePlans *pc.Job
+	resumeSubs      *pc.Job
+	sendCampaigns   *pc.Job
+	purgeAccounts   *pc.Job
+	groupMutex      sync.Mutex
+
+	stripeEventLocks  map[string]*stripeEventLock
+	stripeEventsMutex sync.Mutex
+
+	eventCatalog        *EventCatalog
+	trackingRateLimiter *TrackingRateLimiter
 }
 
 func (server *Server) CreateAccount(email string) (*Account, error) {
-	acc, err := NewAccount(email)
+	acc, err := NewAccount(email, server.Billing)
 	if err != nil {
 		return nil, err
 	}
 
+	server.TrackExposures(acc)
+
 	if err := server.Storage.Put(acc); err != nil {
 		return nil, err
 	}
@@ -39,7 +88,7 @@ func (server *Server) CreateAccount(email string) (*Account, error) {
 }
 
 func (server *Server) GetAccount(email string) (*Account, error) {
-	acc := &Account{Email: email}
+	acc := &Account{Email: email, billing: server.Billing}
 	if err := server.Storage.Get(acc); err != nil {
 		if err != pc.ErrNotFound {
 			return nil, err
@@ -47,6 +96,14 @@ func (server *Server) GetAccount(email string) (*Account, error) {
 			return nil, nil
 		}
 	}
+
+	if acc.GroupID != "" {
+		var err error
+		if acc.groupEntitlement, err = server.groupEntitlement(acc); err != nil {
+			return nil, err
+		}
+	}
+
 	return acc, nil
 }
 
@@ -64,6 +121,7 @@ func (server *Server) GetOrCreateAccount(email string) (*Account, error) {
 		if err := acc.UpdateCustomer(); err != nil {
 			return nil, err
 		}
+		server.TrackExposures(acc)
 		if err := server.Storage.Put(acc); err != nil {
 			return nil, err
 		}
@@ -72,6 +130,111 @@ func (server *Server) GetOrCreateAccount(email string) (*Account, error) {
 	return acc, nil
 }
 
+// Returns the email of the account locked by padlock-cloud's `LockAccount` middleware for the given
+// request, if any. Account locks aren't reentrant, so handlers must not lock that account again
+func lockedAccount(r *http.Request) string {
+	if t, _ := pc.AuthTokenFromRequest(r); t != nil {
+		return t.Email
+	}
+	return ""
+}
+
+// Locks the accounts with the given emails, always in the same order to avoid deadlocks. `held` is
+// an account the caller has already locked and is skipped. Returns a function releasing the locks
+func (server *Server) lockAccounts(held string, emails ...string) func() {
+	var locked []string
+	seen := map[string]bool{held: true}
+	for _, email := range emails {
+		if !seen[email] {
+			seen[email] = true
+			locked = append(locked, email)
+		}
+	}
+	sort.Strings(locked)
+
+	for _, email := range locked {
+		server.LockAccount(email)
+	}
+
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			server.UnlockAccount(locked[i])
+		}
+	}
+}
+
+// Creates a one-time login link for the given email address that redirects to `redirect` after
+// the user has been authenticated
+func (server *Server) LoginLink(r *http.Request, email string, redirect string) (string, error) {
+	return server.loginLink(server.BaseUrl(r), email, redirect)
+}
+
+// Same as `LoginLink` but for use outside of a request context, e.g. in background jobs
+func (server *Server) loginLink(baseUrl string, email string, redirect string) (string, error) {
+	authRequest, err := pc.NewAuthRequest(email, "web", "", nil)
+	if err != nil {
+		return "", err
+	}
+	authRequest.Redirect = redirect
+
+	// Save key-token pair to database for activating it later in a separate request
+	if err := server.Storage.Put(authRequest); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/a/?t=%s", baseUrl, authRequest.Token), nil
+}
+
+// Renders the given email template and sends the result to `rec` in the background. `r` may be nil
+// when sending emails outside of a request context, e.g. from background jobs
+func (server *Server) SendEmail(rec string, subject string, tmpl *t.Template, data map[string]interface{}, r *http.Request) error {
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := server.Sender.Send(rec, subject, body.String()); err != nil {
+			if r != nil {
+				server.LogError(err, r)
+			} else {
+				server.Error.Printf("Error while sending email to %s: %v", rec, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Deletes all records of processed webhook events older than `processedEventsRetention`
+func (server *Server) CleanProcessedEvents() error {
+	e := &ProcessedStripeEvent{}
+	iter, err := server.Storage.Iterator(e)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	n := 0
+	for iter.Next() {
+		if err := iter.Get(e); err != nil {
+			return err
+		}
+		if time.Since(e.Processed) > processedEventsRetention {
+			if err := server.Storage.Delete(e); err != nil {
+				return err
+			}
+			n = n + 1
+		}
+	}
+
+	if n > 0 {
+		server.Info.Printf("Deleted %d processed stripe events", n)
+	}
+
+	return nil
+}
+
 func (server *Server) InitEndpoints() {
 	store := server.Endpoints["/store/"]
 	store.Handlers["GET"] = (&CheckSubscription{server, false}).Wrap(store.Handlers["GET"])
@@ -88,6 +251,27 @@ func (server *Server) InitEndpoints() {
 		AuthType: "universal",
 	}
 
+	server.Server.Endpoints["/subscribe/preview/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"GET": &SubscribePreview{server},
+		},
+		AuthType: "universal",
+	}
+
+	server.Server.Endpoints["/subscription/pause/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"POST": &PauseSubscription{server},
+		},
+		AuthType: "universal",
+	}
+
+	server.Server.Endpoints["/subscription/resume/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"POST": &ResumeSubscription{server},
+		},
+		AuthType: "universal",
+	}
+
 	server.Server.Endpoints["/unsubscribe/"] = &pc.Endpoint{
 		Handlers: map[string]pc.Handler{
 			"POST": &Unsubscribe{server},
@@ -95,6 +279,13 @@ func (server *Server) InitEndpoints() {
 		AuthType: "universal",
 	}
 
+	server.Server.Endpoints["/unsubscribe/undo/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"POST": &UndoUnsubscribe{server},
+		},
+		AuthType: "universal",
+	}
+
 	server.Server.Endpoints["/billing/"] = &pc.Endpoint{
 		Handlers: map[string]pc.Handler{
 			"POST": &UpdateBilling{server},
@@ -114,6 +305,12 @@ func (server *Server) InitEndpoints() {
 		},
 	}
 
+	server.Server.Endpoints["/track/batch/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"POST": &TrackBatch{server},
+		},
+	}
+
 	server.Server.Endpoints["/invoices/"] = &pc.Endpoint{
 		Handlers: map[string]pc.Handler{
 			"GET": &Invoices{server},
@@ -136,8 +333,97 @@ func (server *Server) InitEndpoints() {
 
 	server.Server.Endpoints["/apply-promo/"] = &pc.Endpoint{
 		Handlers: map[string]pc.Handler{
-			"POST": &ApplyPromo{server},
+			"POST": (&RequireAdmin{server}).Wrap(&ApplyPromo{server}),
+		},
+	}
+
+	server.Server.Endpoints["/promo-campaign/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"GET": (&RequireAdmin{server}).Wrap(&PromoCampaignStatus{server}),
+		},
+	}
+
+	server.Server.Endpoints["/tracking-stats/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"GET": (&RequireAdmin{server}).Wrap(&TrackingStats{server}),
+		},
+	}
+
+	server.Server.Endpoints["/validatereceipt/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"POST": &ValidateReceipt{server},
+		},
+		AuthType: "universal",
+	}
+
+	server.Server.Endpoints["/playhook/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"POST": &PlayHook{server},
+		},
+	}
+
+	server.Server.Endpoints["/group/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"GET": &GroupInfo{server},
+		},
+		AuthType: "universal",
+	}
+
+	server.Server.Endpoints["/group/invite/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"POST": &InviteToGroup{server},
 		},
+		AuthType: "universal",
+	}
+
+	server.Server.Endpoints["/group/accept/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"GET":  &AcceptGroupInvite{server},
+			"POST": &AcceptGroupInvite{server},
+		},
+		AuthType: "universal",
+	}
+
+	server.Server.Endpoints["/group/leave/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"POST": &LeaveGroup{server},
+		},
+		AuthType: "universal",
+	}
+
+	server.Server.Endpoints["/group/remove/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"POST": &RemoveFromGroup{server},
+		},
+		AuthType: "universal",
+	}
+
+	server.Server.Endpoints["/export/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"GET": &ExportAccountData{server},
+		},
+		AuthType: "web",
+	}
+
+	server.Server.Endpoints["/changeemail/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"POST": &RequestEmailChange{server},
+		},
+		AuthType: "web",
+	}
+
+	server.Server.Endpoints["/confirmemailchange/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"GET": &ConfirmEmailChange{server},
+		},
+	}
+
+	server.Server.Endpoints["/restoreaccount/"] = &pc.Endpoint{
+		Handlers: map[string]pc.Handler{
+			"GET":  &RestoreAccount{server},
+			"POST": &RestoreAccount{server},
+		},
+		AuthType: "web",
 	}
 
 	server.Server.Endpoints["/deleteaccount/"] = &pc.Endpoint{
@@ -174,11 +460,18 @@ func (server *Server) Init() error {
 
 	stripe.Key = server.StripeConfig.SecretKey
 
-	i := plan.List(nil)
-	for i.Next() {
-		plan := i.Plan()
+	if server.Billing == nil {
+		server.Billing = NewStripeBilling(server.StripeConfig.SecretKey)
+	}
+
+	plans, err := server.Billing.ListPlans()
+	if err != nil {
+		return err
+	}
+
+	for _, plan := range plans {
 		if plan.Metadata["available"] == "true" && plan.Metadata["type"] == "1" {
-			AvailablePlans = append(AvailablePlans, i.Plan())
+			AvailablePlans = append(AvailablePlans, plan)
 		}
 	}
 
@@ -186,18 +479,191 @@ func (server *Server) Init() error {
 		return errors.New("No available plans found!")
 	}
 
+	InitPlanGroups()
+
+	if err := InitPricingExperiments(server.PricingConfig); err != nil {
+		return err
+	}
+
+	if server.StripeConfig.WebhookSecret == "" {
+		server.Info.Println("No Stripe webhook secret configured - all incoming webhook events will be rejected!")
+	}
+
+	server.cleanEvents = &pc.Job{
+		Action: func() {
+			if err := server.CleanProcessedEvents(); err != nil {
+				server.Error.Println("Error while cleaning processed stripe events:", err)
+			}
+		},
+	}
+
+	server.cleanEvents.Start(24 * time.Hour)
+
+	if server.Itunes == nil {
+		server.Itunes = NewItunesServer(server.ItunesConfig)
+	}
+
+	if server.Play == nil {
+		server.Play = NewPlayServer(server.PlayConfig)
+	}
+
+	server.revalidatePlans = &pc.Job{
+		Action: func() {
+			if err := server.RevalidatePlans(); err != nil {
+				server.Error.Println("Error while revalidating app store plans:", err)
+			}
+		},
+	}
+
+	server.revalidatePlans.Start(6 * time.Hour)
+
+	server.resumeSubs = &pc.Job{
+		Action: func() {
+			if err := server.ResumeDueSubscriptions(); err != nil {
+				server.Error.Println("Error while resuming paused subscriptions:", err)
+			}
+		},
+	}
+
+	server.resumeSubs.Start(time.Hour)
+
+	if server.PromoConfig.AdminSecret == "" {
+		server.Info.Println("No admin secret configured - all requests to admin endpoints will be rejected!")
+	}
+
+	server.sendCampaigns = &pc.Job{
+		Action: func() {
+			if err := server.SendCampaigns(); err != nil {
+				server.Error.Println("Error while sending promo campaign emails:", err)
+			}
+		},
+	}
+
+	server.sendCampaigns.Start(time.Minute)
+
+	server.purgeAccounts = &pc.Job{
+		Action: func() {
+			if err := server.PurgeDeletedAccounts(); err != nil {
+				server.Error.Println("Error while deleting accounts:", err)
+			}
+		},
+	}
+
+	server.purgeAccounts.Start(time.Hour)
+
 	// Set up tracking
-	server.Tracker = NewMixpanelTracker(server.MixpanelConfig.Token, server.Storage)
+	if server.Tracker, err = NewTracker(server.TrackingConfig, server.MixpanelConfig, server.Storage, server.Error); err != nil {
+		return err
+	}
+
+	server.eventCatalog = DefaultEventCatalog
+	if server.TrackingConfig.Catalog != "" {
+		if server.eventCatalog, err = LoadEventCatalog(server.TrackingConfig.Catalog); err != nil {
+			return err
+		}
+	}
+
+	perIP := server.TrackingConfig.RateLimitIP
+	if perIP <= 0 {
+		perIP = defaultTrackingRateLimitIP
+	}
+	perTrackingID := server.TrackingConfig.RateLimitTrackingID
+	if perTrackingID <= 0 {
+		perTrackingID = defaultTrackingRateLimitTrackingID
+	}
+	if server.trackingRateLimiter, err = NewTrackingRateLimiter(perIP, perTrackingID); err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func NewServer(pcServer *pc.Server, stripeConfig *StripeConfig, mixpanelConfig *MixpanelConfig) *Server {
+// Starts the server and blocks until it is shut down via SIGINT or SIGTERM. Shutdown happens in
+// order: in-flight requests are completed, background jobs stopped and pending tracking events
+// delivered before storage is closed
+func (server *Server) Start() error {
+	// The http server would otherwise handle signals itself and close storage right after the last
+	// request, leaving no chance to flush tracking events
+	server.NoSignalHandling = true
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			server.Info.Printf("Received %v, shutting down", sig)
+			server.Stop(server.Timeout)
+		case <-done:
+		}
+	}()
+
+	server.InitHandler()
+
+	port := server.Config.Port
+	tlsCert := server.Config.TLSCert
+	tlsKey := server.Config.TLSKey
+
+	server.Addr = fmt.Sprintf(":%d", port)
+
+	var err error
+	if tlsCert != "" && tlsKey != "" {
+		server.Info.Printf("Starting server with TLS on port %v", port)
+		server.Secure = true
+		err = server.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		server.Info.Printf("Starting server on port %v", port)
+		err = server.ListenAndServe()
+	}
+
+	server.shutdown()
+
+	return err
+}
+
+// Stops background jobs, delivers pending tracking events and closes storage
+func (server *Server) shutdown() {
+	for _, job := range []*pc.Job{
+		server.cleanEvents,
+		server.revalidatePlans,
+		server.resumeSubs,
+		server.sendCampaigns,
+		server.purgeAccounts,
+	} {
+		if job != nil {
+			job.Stop()
+		}
+	}
+
+	if server.Tracker != nil {
+		if err := CloseTracker(server.Tracker); err != nil {
+			server.Error.Println("Error while flushing tracking events:", err)
+		}
+	}
+
+	if err := server.CleanUp(); err != nil {
+		server.Error.Println("Error while closing storage:", err)
+	}
+
+	server.Info.Println("Server shut down")
+}
+
+func NewServer(pcServer *pc.Server, stripeConfig *StripeConfig, mixpanelConfig *MixpanelConfig, trackingConfig *TrackingConfig, itunesConfig *ItunesConfig, playConfig *PlayConfig, pricingConfig *PricingConfig, promoConfig *PromoConfig, deletionConfig *DeletionConfig) *Server {
 	// Initialize server instance
 	server := &Server{
 		Server:         pcServer,
 		StripeConfig:   stripeConfig,
 		MixpanelConfig: mixpanelConfig,
+		TrackingConfig: trackingConfig,
+		ItunesConfig:   itunesConfig,
+		PlayConfig:     playConfig,
+		PricingConfig:  pricingConfig,
+		PromoConfig:    promoConfig,
+		DeletionConfig: deletionConfig,
 	}
 	return server
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/webhook"
+)
+
+var testPlans = []*stripe.Plan{
+	{
+		ID:              "test-yearly",
+		Currency:        DefaultCurrency,
+		Active:          true,
+		Amount:          1200,
+		Interval:        "year",
+		IntervalCount:   1,
+		TrialPeriodDays: 30,
+	},
+}
+
+// Creates a server backed by in-memory storage and billing. Emails are recorded instead of sent
+func newTestServer(t *testing.T) *Server {
+	AvailablePlans = testPlans
+	InitPlanGroups()
+
+	pcs := pc.NewServer(
+		&pc.Log{Config: &pc.LogConfig{}},
+		&pc.MemoryStorage{},
+		&pc.RecordSender{},
+		&pc.ServerConfig{},
+	)
+	// None of the tests render padlock-cloud's own templates
+	pcs.Templates = &pc.Templates{}
+	if err := pcs.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Server{
+		Server:         pcs,
+		Tracker:        &noopTracker{},
+		Billing:        NewMemoryBilling(testPlans, nil),
+		StripeConfig:   &StripeConfig{},
+		PlayConfig:     &PlayConfig{},
+		ItunesConfig:   &ItunesConfig{},
+		PricingConfig:  &PricingConfig{},
+		PromoConfig:    &PromoConfig{},
+		DeletionConfig: &DeletionConfig{},
+	}
+}
+
+// Signs the payload the way Stripe does and delivers it to the webhook handler
+func deliverStripeEvent(server *Server, payload []byte, secret string, ts time.Time) error {
+	sig := hex.EncodeToString(webhook.ComputeSignature(ts, payload, secret))
+	r := httptest.NewRequest("POST", "/stripe/", bytes.NewReader(payload))
+	r.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", ts.Unix(), sig))
+	return (&StripeHook{server}).Handle(httptest.NewRecorder(), r, nil)
+}
+
+func customerUpdatedEvent(t *testing.T, id string, c *stripe.Customer) []byte {
+	obj, err := json.Marshal(map[string]interface{}{
+		"id":       c.ID,
+		"object":   "customer",
+		"email":    c.Email,
+		"metadata": c.Metadata,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":   id,
+		"type": "customer.updated",
+		"data": map[string]interface{}{"object": json.RawMessage(obj)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestStripeHook(t *testing.T) {
+	server := newTestServer(t)
+	secret := "whsec_test"
+	server.StripeConfig.WebhookSecret = secret
+
+	acc, err := server.GetOrCreateAccount("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	note := func() string {
+		acc, err := server.GetAccount("alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acc.Customer.Metadata["note"]
+	}
+
+	isProcessed := func(id string) bool {
+		err := server.Storage.Get(&ProcessedStripeEvent{ID: id})
+		if err != nil && err != pc.ErrNotFound {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	c := &stripe.Customer{ID: acc.Customer.ID, Email: acc.Email, Metadata: map[string]string{"note": "first"}}
+	payload := customerUpdatedEvent(t, "evt_1", c)
+
+	// Signed with the wrong secret
+	if err := deliverStripeEvent(server, payload, "whsec_other", time.Now()); err == nil {
+		t.Fatal("Expected event with bad signature to be rejected")
+	} else if _, ok := err.(*InvalidWebhookSignature); !ok {
+		t.Fatalf("Expected InvalidWebhookSignature, got %v", err)
+	}
+
+	// Correctly signed, but outside the tolerance window; Could be a replay of an intercepted delivery
+	stale := time.Now().Add(-2 * server.StripeConfig.WebhookToleranceDuration())
+	if err := deliverStripeEvent(server, payload, secret, stale); err == nil {
+		t.Fatal("Expected event with stale timestamp to be rejected")
+	} else if _, ok := err.(*InvalidWebhookSignature); !ok {
+		t.Fatalf("Expected InvalidWebhookSignature, got %v", err)
+	}
+
+	if note() != "" || isProcessed("evt_1") {
+		t.Fatal("Expected rejected events not to be applied")
+	}
+
+	if err := deliverStripeEvent(server, payload, secret, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := note(); n != "first" {
+		t.Fatalf("Expected customer update to be applied, got %q", n)
+	}
+	if !isProcessed("evt_1") {
+		t.Fatal("Expected event to be marked as processed")
+	}
+
+	// Redelivering an event that has already been processed is acknowledged but not applied again
+	c.Metadata["note"] = "second"
+	if err := deliverStripeEvent(server, customerUpdatedEvent(t, "evt_1", c), secret, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := note(); n != "first" {
+		t.Errorf("Expected duplicate event not to be applied, got %q", n)
+	}
+
+	// A new event with the same content goes through
+	if err := deliverStripeEvent(server, customerUpdatedEvent(t, "evt_2", c), secret, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := note(); n != "second" {
+		t.Errorf("Expected new event to be applied, got %q", n)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"sync"
+	"time"
+)
+
+// Record of a Stripe webhook event that has already been processed. Used for making sure that
+// events delivered more than once (e.g. because of retries) are only applied once
+type ProcessedStripeEvent struct {
+	ID        string
+	Type      string
+	Processed time.Time
+}
+
+// Implements the `Key` method of the `Storable` interface
+func (e *ProcessedStripeEvent) Key() []byte {
+	return []byte(e.ID)
+}
+
+// Implementation of the `Storable.Deserialize` method
+func (e *ProcessedStripeEvent) Deserialize(data []byte) error {
+	return json.Unmarshal(data, e)
+}
+
+// Implementation of the `Storable.Serialize` method
+func (e *ProcessedStripeEvent) Serialize() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+type stripeEventLock struct {
+	sync.Mutex
+	// Number of goroutines holding or waiting for the lock
+	refs int
+}
+
+// Locks the webhook event with the given id so that concurrent deliveries of the same event are
+// processed one after the other. Returns a function releasing the lock
+func (server *Server) lockStripeEvent(id string) func() {
+	server.stripeEventsMutex.Lock()
+	if server.stripeEventLocks == nil {
+		server.stripeEventLocks = make(map[string]*stripeEventLock)
+	}
+	l := server.stripeEventLocks[id]
+	if l == nil {
+		l = &stripeEventLock{}
+		server.stripeEventLocks[id] = l
+	}
+	l.refs = l.refs + 1
+	server.stripeEventsMutex.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		server.stripeEventsMutex.Lock()
+		l.refs = l.refs - 1
+		if l.refs == 0 {
+			delete(server.stripeEventLocks, id)
+		}
+		server.stripeEventsMutex.Unlock()
+	}
+}
+
+func init() {
+	pc.RegisterStorable(&ProcessedStripeEvent{}, "stripe-events")
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"fmt"
 	pc "github.com/padloc/padlock-cloud/padlockcloud"
 	"github.com/stripe/stripe-go"
 	t "html/template"
 	fp "path/filepath"
-	"strings"
 	"time"
 )
 
@@ -16,6 +14,38 @@ type Templates struct {
 	// Dashboard *t.Template
 	Invoice     *t.Template
 	InvoiceList *t.Template
+	// Email sent after a failed payment attempt
+	PaymentFailedEmail *t.Template
+	// Receipt sent after a successful payment
+	PaymentSucceededEmail *t.Template
+	// Reminder sent before a subscription is renewed
+	UpcomingInvoiceEmail *t.Template
+	// Email sent when the payment source on file is about to expire
+	SourceExpiringEmail *t.Template
+	// Invitation to join a group
+	GroupInviteEmail *t.Template
+	// Email announcing a promo, sent as part of a promo campaign
+	PromoCampaignEmail *t.Template
+	// Confirmation sent when an account is scheduled for deletion, with a link for restoring it
+	AccountDeletionEmail *t.Template
+	// Notification sent once an account has been deleted for good
+	AccountDeletedEmail *t.Template
+	// Confirmation link sent to both the old and the new address when changing the email address
+	EmailChangeEmail *t.Template
+}
+
+func formatTimeStamp(timestamp int64) string {
+	return time.Unix(timestamp, 0).Format("02 Jan 2006")
+}
+
+// Formats an amount in the given currency. Optionally takes the locale (e.g. the customer's country)
+// to format the amount for
+func formatCurrency(amount int64, currency stripe.Currency, locale ...string) string {
+	l := ""
+	if len(locale) != 0 {
+		l = locale[0]
+	}
+	return formatCurrencyLocale(amount, currency, l)
 }
 
 // Loads templates from given directory
@@ -30,11 +60,18 @@ func LoadTemplates(tt *Templates, p string) error {
 	// }
 
 	funcs := t.FuncMap{
-		"formatTimeStamp": func(timestamp int64) string {
-			return time.Unix(timestamp, 0).Format("02 Jan 2006")
+		"formatTimeStamp": formatTimeStamp,
+		"formatCurrency":  formatCurrency,
+		"lineDescription": invoiceLineDescription,
+		"taxPercent":      invoiceTaxPercent,
+		"addressLines":    billingAddressLines,
+		"vatID":           invoiceVATID,
+		"reverseCharge":   invoiceReverseCharge,
+		"reverseChargeNote": func() string {
+			return reverseChargeNote
 		},
-		"formatCurrency": func(amount int64, currency stripe.Currency) string {
-			return fmt.Sprintf("%.2f %s", float64(amount)/100.00, strings.ToUpper(string(currency)))
+		"invoiceIssuer": func() []string {
+			return invoiceIssuer
 		},
 	}
 
@@ -46,5 +83,41 @@ func LoadTemplates(tt *Templates, p string) error {
 		return err
 	}
 
+	if tt.PaymentFailedEmail, err = pc.ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/payment-failed.txt.tmpl")); err != nil {
+		return err
+	}
+
+	if tt.PaymentSucceededEmail, err = pc.ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/payment-succeeded.txt.tmpl")); err != nil {
+		return err
+	}
+
+	if tt.UpcomingInvoiceEmail, err = pc.ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/upcoming-invoice.txt.tmpl")); err != nil {
+		return err
+	}
+
+	if tt.SourceExpiringEmail, err = pc.ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/source-expiring.txt.tmpl")); err != nil {
+		return err
+	}
+
+	if tt.GroupInviteEmail, err = pc.ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/group-invite.txt.tmpl")); err != nil {
+		return err
+	}
+
+	if tt.PromoCampaignEmail, err = pc.ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/promo-campaign.txt.tmpl")); err != nil {
+		return err
+	}
+
+	if tt.AccountDeletionEmail, err = pc.ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/account-deletion.txt.tmpl")); err != nil {
+		return err
+	}
+
+	if tt.AccountDeletedEmail, err = pc.ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/account-deleted.txt.tmpl")); err != nil {
+		return err
+	}
+
+	if tt.EmailChangeEmail, err = pc.ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/email-change.txt.tmpl")); err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -33,6 +33,11 @@ type TrackingEvent struct {
 	Properties map[string]interface{} `json:"props"`
 	request    *http.Request
 	authToken  *pc.AuthToken
+	// Set by `prepareEvent` so that events can be prepared ahead of being sent to the backend
+	prepared           bool
+	account            *Account
+	originalTrackingID string
+	ip                 string
 }
 
 type Tracker interface {
@@ -54,10 +59,24 @@ func NewMixpanelTracker(token string, storage pc.Storage) Tracker {
 	}
 }
 
-func (t *mixpanelTracker) Track(event *TrackingEvent) error {
-	var ip string
+// Returns the ip address the event was sent from, if known
+func eventIP(event *TrackingEvent) string {
+	if event.ip != "" {
+		return event.ip
+	}
 	if event.request != nil {
-		ip = pc.IPFromRequest(event.request)
+		return pc.IPFromRequest(event.request)
+	}
+	return ""
+}
+
+// Prepares an event for being sent to a tracking backend. Makes sure the event has a tracking id,
+// links it to the authenticated account (if any) and adds device information. Returns the account
+// and the tracking id the event was originally sent with. Preparing an event more than once has
+// no effect
+func prepareEvent(storage pc.Storage, event *TrackingEvent) (*Account, string) {
+	if event.prepared {
+		return event.account, event.originalTrackingID
 	}
 
 	a := event.authToken
@@ -74,7 +93,7 @@ func (t *mixpanelTracker) Track(event *TrackingEvent) error {
 	var acc *Account
 	if a != nil {
 		_acc := &Account{Email: a.Email}
-		if err := t.storage.Get(_acc); err == nil {
+		if err := storage.Get(_acc); err == nil {
 			acc = _acc
 		}
 	}
@@ -82,21 +101,9 @@ func (t *mixpanelTracker) Track(event *TrackingEvent) error {
 	if acc != nil {
 		if acc.TrackingID == "" {
 			acc.TrackingID = event.TrackingID
-			t.storage.Put(acc)
+			storage.Put(acc)
 		} else {
 			event.TrackingID = acc.TrackingID
-
-			if originalTrackingID != "" && originalTrackingID != acc.TrackingID {
-				if err := t.mixpanel.Update(originalTrackingID, &mixpanel.Update{
-					IP:        ip,
-					Operation: "$set_once",
-					Properties: map[string]interface{}{
-						"Converted To": acc.TrackingID,
-					},
-				}); err != nil {
-					return err
-				}
-			}
 		}
 	}
 
@@ -125,6 +132,78 @@ func (t *mixpanelTracker) Track(event *TrackingEvent) error {
 	delete(props, "Email")
 	delete(props, "$email")
 
+	event.prepared = true
+	event.account = acc
+	event.originalTrackingID = originalTrackingID
+	event.ip = eventIP(event)
+
+	return acc, originalTrackingID
+}
+
+// Assigns a tracking id to the account if it doesn't have one yet
+func ensureTrackingID(storage pc.Storage, acc *Account) {
+	if acc.TrackingID == "" {
+		acc.TrackingID = uuid.NewV4().String()
+		storage.Put(acc)
+	}
+}
+
+// Returns the profile properties of the given account, merged with `props`. Assigns a tracking id
+// to the account if it doesn't have one yet
+func profileProperties(storage pc.Storage, acc *Account, props map[string]interface{}) map[string]interface{} {
+	ensureTrackingID(storage, acc)
+	return accountProfile(acc, props)
+}
+
+// Returns the profile properties of the given account, merged with `props`
+func accountProfile(acc *Account, props map[string]interface{}) map[string]interface{} {
+	subStatus, _ := acc.SubscriptionStatus()
+
+	source := ""
+	if ent := acc.Entitlement(); ent != nil {
+		source = string(ent.Source)
+	}
+
+	update := map[string]interface{}{
+		"Last Updated":        time.Now().UTC().Format(time.RFC3339),
+		"Plan":                acc.SubscriptionPlan(),
+		"Subscription Status": subStatus,
+		"Subscription Source": source,
+	}
+
+	for name, a := range acc.Experiments {
+		update["Experiment: "+name] = a.Variant
+	}
+
+	if props != nil {
+		for k, v := range props {
+			update[k] = v
+		}
+	}
+
+	return update
+}
+
+func (t *mixpanelTracker) Track(event *TrackingEvent) error {
+	ip := eventIP(event)
+	a := event.authToken
+
+	acc, originalTrackingID := prepareEvent(t.storage, event)
+
+	if acc != nil && originalTrackingID != "" && originalTrackingID != acc.TrackingID {
+		if err := t.mixpanel.Update(originalTrackingID, &mixpanel.Update{
+			IP:        ip,
+			Operation: "$set_once",
+			Properties: map[string]interface{}{
+				"Converted To": acc.TrackingID,
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	props := event.Properties
+
 	if err := t.mixpanel.Track(event.TrackingID, event.Name, &mixpanel.Event{
 		IP:         ip,
 		Properties: props,
@@ -151,35 +230,41 @@ func (t *mixpanelTracker) Track(event *TrackingEvent) error {
 			return err
 		}
 
-		nDevices := 0
-		platforms := make([]string, 0)
-		versions := make([]string, 0)
-		pMap := make(map[string]bool)
-		vMap := make(map[string]bool)
-		for _, token := range a.Account().AuthTokens {
-			if token.Type == "api" && !token.Expired() {
-				nDevices = nDevices + 1
-			}
-			if token.Device != nil && token.Device.Platform != "" && !pMap[token.Device.Platform] {
-				platforms = append(platforms, token.Device.Platform)
-				pMap[token.Device.Platform] = true
-			}
-			if token.Device != nil && token.Device.AppVersion != "" && !vMap[token.Device.AppVersion] {
-				versions = append(versions, token.Device.AppVersion)
-				vMap[token.Device.AppVersion] = true
+		update := map[string]interface{}{
+			"Last Sync":     props["Last Sync"],
+			"Last Rated":    props["Last Rated"],
+			"Rated Version": props["Rated Version"],
+			"Rating":        props["Rating"],
+			"Last Reviewed": props["Last Reviewed"],
+		}
+
+		// The auth token isn't available for events restored from the tracking spool
+		if a != nil {
+			nDevices := 0
+			platforms := make([]string, 0)
+			versions := make([]string, 0)
+			pMap := make(map[string]bool)
+			vMap := make(map[string]bool)
+			for _, token := range a.Account().AuthTokens {
+				if token.Type == "api" && !token.Expired() {
+					nDevices = nDevices + 1
+				}
+				if token.Device != nil && token.Device.Platform != "" && !pMap[token.Device.Platform] {
+					platforms = append(platforms, token.Device.Platform)
+					pMap[token.Device.Platform] = true
+				}
+				if token.Device != nil && token.Device.AppVersion != "" && !vMap[token.Device.AppVersion] {
+					versions = append(versions, token.Device.AppVersion)
+					vMap[token.Device.AppVersion] = true
+				}
 			}
+
+			update["Paired Devices"] = nDevices
+			update["Platforms"] = platforms
+			update["Versions"] = versions
 		}
 
-		if err := t.UpdateProfile(acc, map[string]interface{}{
-			"Last Sync":      props["Last Sync"],
-			"Last Rated":     props["Last Rated"],
-			"Rated Version":  props["Rated Version"],
-			"Rating":         props["Rating"],
-			"Last Reviewed":  props["Last Reviewed"],
-			"Paired Devices": nDevices,
-			"Platforms":      platforms,
-			"Versions":       versions,
-		}); err != nil {
+		if err := t.UpdateProfile(acc, update); err != nil {
 			return err
 		}
 
@@ -189,24 +274,7 @@ func (t *mixpanelTracker) Track(event *TrackingEvent) error {
 }
 
 func (t *mixpanelTracker) UpdateProfile(acc *Account, props map[string]interface{}) error {
-	if acc.TrackingID == "" {
-		acc.TrackingID = uuid.NewV4().String()
-		t.storage.Put(acc)
-	}
-
-	subStatus, _ := acc.SubscriptionStatus()
-
-	update := map[string]interface{}{
-		"Last Updated":        time.Now().UTC().Format(time.RFC3339),
-		"Plan":                acc.SubscriptionPlan(),
-		"Subscription Status": subStatus,
-	}
-
-	if props != nil {
-		for k, v := range props {
-			update[k] = v
-		}
-	}
+	update := profileProperties(t.storage, acc, props)
 
 	return t.mixpanel.Update(acc.TrackingID, &mixpanel.Update{
 		IP:         "0",
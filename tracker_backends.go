@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+)
+
+type TrackingConfig struct {
+	// Backends tracking events are sent to. Events are sent to all of them if more than one is
+	// given. Defaults to "mixpanel" if a Mixpanel token is configured and "noop" otherwise
+	Backends []string `yaml:"backends"`
+	// Path of the file the "file" backend appends events to, one JSON object per line
+	File string `yaml:"file"`
+	// Url the "http" backend posts events to
+	HttpUrl string `yaml:"http_url"`
+	// Optional bearer token the "http" backend authenticates with
+	HttpToken string `yaml:"http_token"`
+	// Settings of the queues events are delivered through
+	Queue TrackingQueueConfig `yaml:"queue"`
+	// Path of a YAML file describing the events accepted by the `/track/` endpoint. Defaults to
+	// the events sent by the official clients
+	Catalog string `yaml:"catalog"`
+	// Maximum number of events accepted per minute from a single IP address. Defaults to 120
+	RateLimitIP int `yaml:"rate_limit_ip"`
+	// Maximum number of events accepted per minute for a single tracking id. Defaults to 60
+	RateLimitTrackingID int `yaml:"rate_limit_tracking_id"`
+}
+
+// Returns the names of the configured backends, falling back to the default if none are configured
+func (c *TrackingConfig) BackendNames(mixpanelConfig *MixpanelConfig) []string {
+	var names []string
+	for _, name := range c.Backends {
+		// Allow passing a comma-separated list via flags or environment variables
+		for _, n := range strings.Split(name, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				names = append(names, n)
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		if mixpanelConfig.Token != "" {
+			names = []string{"mixpanel"}
+		} else {
+			names = []string{"noop"}
+		}
+	}
+
+	return names
+}
+
+// Whether events are sent to the backend with the given name
+func (c *TrackingConfig) UsesBackend(name string, mixpanelConfig *MixpanelConfig) bool {
+	for _, n := range c.BackendNames(mixpanelConfig) {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates a tracker backend from the given configuration
+type TrackerBackend func(config *TrackingConfig, mixpanelConfig *MixpanelConfig, storage pc.Storage) (Tracker, error)
+
+var trackerBackends = map[string]TrackerBackend{
+	"mixpanel": func(config *TrackingConfig, mixpanelConfig *MixpanelConfig, storage pc.Storage) (Tracker, error) {
+		if mixpanelConfig.Token == "" {
+			return nil, errors.New("The mixpanel tracking backend requires a Mixpanel token")
+		}
+		return NewMixpanelTracker(mixpanelConfig.Token, storage), nil
+	},
+	"noop": func(config *TrackingConfig, mixpanelConfig *MixpanelConfig, storage pc.Storage) (Tracker, error) {
+		return &noopTracker{}, nil
+	},
+	"file": func(config *TrackingConfig, mixpanelConfig *MixpanelConfig, storage pc.Storage) (Tracker, error) {
+		return NewFileTracker(config.File, storage)
+	},
+	"http": func(config *TrackingConfig, mixpanelConfig *MixpanelConfig, storage pc.Storage) (Tracker, error) {
+		return NewHttpTracker(config.HttpUrl, config.HttpToken, storage)
+	},
+}
+
+// Makes a tracking backend available under the given name
+func RegisterTrackerBackend(name string, backend TrackerBackend) {
+	trackerBackends[name] = backend
+}
+
+// Creates the tracker for the configured backends. Events are delivered to each backend through
+// its own queue and fanned out to all of them if more than one backend is configured
+func NewTracker(config *TrackingConfig, mixpanelConfig *MixpanelConfig, storage pc.Storage, logger *log.Logger) (Tracker, error) {
+	var trackers []Tracker
+	for _, name := range config.BackendNames(mixpanelConfig) {
+		backend, ok := trackerBackends[name]
+		if !ok {
+			var available []string
+			for n := range trackerBackends {
+				available = append(available, n)
+			}
+			sort.Strings(available)
+			return nil, fmt.Errorf("Unknown tracking backend: %s (available: %s)", name, strings.Join(available, ", "))
+		}
+
+		tracker, err := backend(config, mixpanelConfig, storage)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, noop := tracker.(*noopTracker); !noop {
+			if tracker, err = NewTrackingQueue(name, tracker, storage, &config.Queue, logger); err != nil {
+				return nil, err
+			}
+		}
+
+		trackers = append(trackers, tracker)
+	}
+
+	if len(trackers) == 1 {
+		return trackers[0], nil
+	}
+
+	return multiTracker(trackers), nil
+}
+
+// Tracker that simply discards all events
+type noopTracker struct{}
+
+func (t *noopTracker) Track(event *TrackingEvent) error {
+	return nil
+}
+
+func (t *noopTracker) DeleteProfile(acc *Account) error {
+	return nil
+}
+
+func (t *noopTracker) UpdateProfile(acc *Account, props map[string]interface{}) error {
+	return nil
+}
+
+func (t *noopTracker) UnsubscribeProfile(tid string) error {
+	return nil
+}
+
+// Sends events to multiple trackers. All trackers are called even if some of them fail, in which
+// case the first error is returned
+type multiTracker []Tracker
+
+func (t multiTracker) each(fn func(Tracker) error) error {
+	var firstErr error
+	for _, tracker := range t {
+		if err := fn(tracker); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (t multiTracker) Track(event *TrackingEvent) error {
+	src := event
+	return t.each(func(tracker Tracker) error {
+		// Trackers modify the event, so each of them gets its own copy
+		e := *src
+		e.Properties = make(map[string]interface{}, len(src.Properties))
+		for k, v := range src.Properties {
+			e.Properties[k] = v
+		}
+		err := tracker.Track(&e)
+		// Once prepared, the event has its final tracking id and doesn't need to be prepared again
+		if e.prepared {
+			src = &e
+		}
+		return err
+	})
+}
+
+func (t multiTracker) DeleteProfile(acc *Account) error {
+	return t.each(func(tracker Tracker) error {
+		return tracker.DeleteProfile(acc)
+	})
+}
+
+func (t multiTracker) UpdateProfile(acc *Account, props map[string]interface{}) error {
+	return t.each(func(tracker Tracker) error {
+		return tracker.UpdateProfile(acc, props)
+	})
+}
+
+func (t multiTracker) UnsubscribeProfile(tid string) error {
+	return t.each(func(tracker Tracker) error {
+		return tracker.UnsubscribeProfile(tid)
+	})
+}
+
+// Record written by the "file" and "http" backends
+type trackingRecord struct {
+	// One of "event", "profile", "delete" and "unsubscribe"
+	Type       string                 `json:"type"`
+	Time       time.Time              `json:"time"`
+	TrackingID string                 `json:"trackingID"`
+	Event      string                 `json:"event,omitempty"`
+	IP         string                 `json:"ip,omitempty"`
+	Properties map[string]interface{} `json:"props,omitempty"`
+}
+
+// Common implementation of trackers that hand records to a `write` function. Unlike the
+// Mixpanel tracker, profiles never include the email address
+type recordTracker struct {
+	storage pc.Storage
+	write   func(recs []*trackingRecord) error
+}
+
+func (t *recordTracker) Track(event *TrackingEvent) error {
+	return t.TrackBatch([]*TrackingEvent{event})
+}
+
+// Implements the `batchTracker` interface
+func (t *recordTracker) TrackBatch(events []*TrackingEvent) error {
+	recs := make([]*trackingRecord, len(events))
+	for i, event := range events {
+		prepareEvent(t.storage, event)
+		recs[i] = &trackingRecord{
+			Type:       "event",
+			Time:       time.Now().UTC(),
+			TrackingID: event.TrackingID,
+			Event:      event.Name,
+			IP:         eventIP(event),
+			Properties: event.Properties,
+		}
+	}
+
+	return t.write(recs)
+}
+
+func (t *recordTracker) UpdateProfile(acc *Account, props map[string]interface{}) error {
+	update := profileProperties(t.storage, acc, props)
+
+	return t.write([]*trackingRecord{{
+		Type:       "profile",
+		Time:       time.Now().UTC(),
+		TrackingID: acc.TrackingID,
+		Properties: update,
+	}})
+}
+
+func (t *recordTracker) DeleteProfile(acc *Account) error {
+	if acc.TrackingID == "" {
+		return nil
+	}
+
+	return t.write([]*trackingRecord{{
+		Type:       "delete",
+		Time:       time.Now().UTC(),
+		TrackingID: acc.TrackingID,
+	}})
+}
+
+func (t *recordTracker) UnsubscribeProfile(tid string) error {
+	return t.write([]*trackingRecord{{
+		Type:       "unsubscribe",
+		Time:       time.Now().UTC(),
+		TrackingID: tid,
+	}})
+}
+
+// Creates a tracker that appends events to the file at `path` as JSON lines. Meant for self-hosted
+// deployments that want to keep tracking data to themselves
+func NewFileTracker(path string, storage pc.Storage) (Tracker, error) {
+	if path == "" {
+		return nil, errors.New("The file tracking backend requires a file path")
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var mutex sync.Mutex
+
+	return &recordTracker{
+		storage: storage,
+		write: func(recs []*trackingRecord) error {
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			for _, rec := range recs {
+				if err := enc.Encode(rec); err != nil {
+					return err
+				}
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			_, err := f.Write(buf.Bytes())
+			return err
+		},
+	}, nil
+}
+
+// Creates a tracker that posts events to the given url as a JSON array of records
+func NewHttpTracker(url string, token string, storage pc.Storage) (Tracker, error) {
+	if url == "" {
+		return nil, errors.New("The http tracking backend requires a url")
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	return &recordTracker{
+		storage: storage,
+		write: func(recs []*trackingRecord) error {
+			body, err := json.Marshal(recs)
+			if err != nil {
+				return err
+			}
+
+			req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			res, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode < 200 || res.StatusCode >= 300 {
+				err := fmt.Errorf("Tracking collector responded with status %d", res.StatusCode)
+				// Client errors mean the collector won't accept the records no matter how often we
+				// retry. Timeouts and rate limiting are the exception
+				if res.StatusCode >= 400 && res.StatusCode < 500 &&
+					res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests {
+					return &TrackingRejectedError{err}
+				}
+				return err
+			}
+
+			return nil
+		},
+	}, nil
+}
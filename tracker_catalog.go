@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"gopkg.in/throttled/throttled.v2"
+	"gopkg.in/throttled/throttled.v2/store/memstore"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultTrackingRateLimitIP         = 120
+	defaultTrackingRateLimitTrackingID = 60
+	maxTrackingIDLength                = 64
+)
+
+// Types of event properties
+const (
+	PropertyTypeString = "string"
+	PropertyTypeNumber = "number"
+	PropertyTypeBool   = "bool"
+	PropertyTypeAny    = "any"
+)
+
+// Describes the events clients may send to the `/track/` endpoint
+type EventCatalog struct {
+	// Maximum size of a request body in bytes
+	MaxBodySize int64 `yaml:"max_body_size"`
+	// Maximum number of events in a single batch
+	MaxBatchSize int `yaml:"max_batch_size"`
+	// Maximum number of properties per event
+	MaxProperties int `yaml:"max_properties"`
+	// Maximum length of string property values
+	MaxStringLength int `yaml:"max_string_length"`
+	// Properties allowed on all events, mapped to their types
+	Properties map[string]string `yaml:"properties"`
+	// Allowed event names, mapped to the properties specific to that event and their types
+	Events map[string]map[string]string `yaml:"events"`
+}
+
+// Catalog of the events sent by the official clients, used unless a custom catalog is configured
+var DefaultEventCatalog = &EventCatalog{
+	MaxBodySize:     64 * 1024,
+	MaxBatchSize:    50,
+	MaxProperties:   50,
+	MaxStringLength: 1000,
+	Properties: map[string]string{
+		"First Launch":  PropertyTypeString,
+		"Launch Count":  PropertyTypeNumber,
+		"Custom Server": PropertyTypeAny,
+		"Email":         PropertyTypeString,
+		"Last Sync":     PropertyTypeString,
+		"Last Rated":    PropertyTypeString,
+		"Rated Version": PropertyTypeString,
+		"Rating":        PropertyTypeNumber,
+		"Last Reviewed": PropertyTypeString,
+		"Source":        PropertyTypeString,
+	},
+	Events: map[string]map[string]string{
+		"Install": {},
+		"Update": {
+			"From Version": PropertyTypeString,
+		},
+		"Dashboard: Finish Loading": {},
+		"Dashboard: Back":           {},
+		"Payment Dialog: Open": {
+			"Plan": PropertyTypeString,
+		},
+		"Payment Dialog: Submit": {
+			"Plan":          PropertyTypeString,
+			"Coupon":        PropertyTypeString,
+			"Success":       PropertyTypeBool,
+			"Token Created": PropertyTypeBool,
+			"Error Code":    PropertyTypeString,
+			"Error Type":    PropertyTypeString,
+			"Error Message": PropertyTypeString,
+		},
+	},
+}
+
+// Loads an event catalog from the YAML file at the given path. Limits that aren't set are taken
+// from the default catalog
+func LoadEventCatalog(path string) (*EventCatalog, error) {
+	yamlData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &EventCatalog{}
+	if err := yaml.Unmarshal(yamlData, c); err != nil {
+		return nil, err
+	}
+
+	if c.MaxBodySize <= 0 {
+		c.MaxBodySize = DefaultEventCatalog.MaxBodySize
+	}
+	if c.MaxBatchSize <= 0 {
+		c.MaxBatchSize = DefaultEventCatalog.MaxBatchSize
+	}
+	if c.MaxProperties <= 0 {
+		c.MaxProperties = DefaultEventCatalog.MaxProperties
+	}
+	if c.MaxStringLength <= 0 {
+		c.MaxStringLength = DefaultEventCatalog.MaxStringLength
+	}
+
+	check := func(props map[string]string) error {
+		for name, typ := range props {
+			switch typ {
+			case PropertyTypeString, PropertyTypeNumber, PropertyTypeBool, PropertyTypeAny:
+			default:
+				return fmt.Errorf("Invalid type for event property %s: %s", name, typ)
+			}
+		}
+		return nil
+	}
+
+	if err := check(c.Properties); err != nil {
+		return nil, err
+	}
+	for _, props := range c.Events {
+		if err := check(props); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Returns the type of the given property of the given event, or an empty string if the property
+// isn't allowed
+func (c *EventCatalog) propertyType(event string, prop string) string {
+	if typ, ok := c.Events[event][prop]; ok {
+		return typ
+	}
+	return c.Properties[prop]
+}
+
+// Checks whether the given event is part of the catalog and its properties are valid
+func (c *EventCatalog) Validate(event *TrackingEvent) error {
+	if len(event.TrackingID) > maxTrackingIDLength {
+		return &pc.BadRequest{Msg: "Invalid tracking id"}
+	}
+
+	if _, ok := c.Events[event.Name]; !ok {
+		return &pc.BadRequest{Msg: fmt.Sprintf("Unknown event: %q", event.Name)}
+	}
+
+	if len(event.Properties) > c.MaxProperties {
+		return &pc.BadRequest{Msg: fmt.Sprintf("Too many properties for event %q", event.Name)}
+	}
+
+	for prop, val := range event.Properties {
+		typ := c.propertyType(event.Name, prop)
+
+		var valid bool
+		switch v := val.(type) {
+		case nil:
+			valid = typ != ""
+		case string:
+			valid = (typ == PropertyTypeString || typ == PropertyTypeAny) && len(v) <= c.MaxStringLength
+		case float64:
+			valid = typ == PropertyTypeNumber || typ == PropertyTypeAny
+		case bool:
+			valid = typ == PropertyTypeBool || typ == PropertyTypeAny
+		default:
+			// Nested objects and lists aren't supported
+			valid = false
+		}
+
+		if !valid {
+			return &pc.BadRequest{Msg: fmt.Sprintf("Invalid property %q for event %q", prop, event.Name)}
+		}
+	}
+
+	return nil
+}
+
+// Reads the body of a tracking request, enforcing the catalog's size limit
+func (c *EventCatalog) ReadBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, c.MaxBodySize))
+	if err != nil {
+		return nil, &pc.BadRequest{Msg: "Request body too large"}
+	}
+	return body, nil
+}
+
+// Limits the number of events accepted per IP address and per tracking id
+type TrackingRateLimiter struct {
+	ipRateLimiter         throttled.RateLimiter
+	trackingIDRateLimiter throttled.RateLimiter
+}
+
+// Creates a rate limiter allowing the given number of events per minute per IP address and per
+// tracking id
+func NewTrackingRateLimiter(perIP int, perTrackingID int) (*TrackingRateLimiter, error) {
+	newLimiter := func(perMin int) (throttled.RateLimiter, error) {
+		store, err := memstore.New(65536)
+		if err != nil {
+			return nil, err
+		}
+		return throttled.NewGCRARateLimiter(store, throttled.RateQuota{
+			MaxRate:  throttled.PerMin(perMin),
+			MaxBurst: perMin,
+		})
+	}
+
+	ipRateLimiter, err := newLimiter(perIP)
+	if err != nil {
+		return nil, err
+	}
+
+	trackingIDRateLimiter, err := newLimiter(perTrackingID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TrackingRateLimiter{ipRateLimiter, trackingIDRateLimiter}, nil
+}
+
+// Returns a `RateLimitExceeded` error if accepting the given events would exceed any of the limits
+func (l *TrackingRateLimiter) Limit(r *http.Request, events []*TrackingEvent) error {
+	if limited, _, err := l.ipRateLimiter.RateLimit(pc.IPFromRequest(r), len(events)); err != nil {
+		return err
+	} else if limited {
+		return &pc.RateLimitExceeded{}
+	}
+
+	counts := make(map[string]int)
+	for _, e := range events {
+		// Events without a tracking id come from new clients and are only limited by IP
+		if e.TrackingID != "" {
+			counts[e.TrackingID] = counts[e.TrackingID] + 1
+		}
+	}
+
+	for tid, n := range counts {
+		if limited, _, err := l.trackingIDRateLimiter.RateLimit(tid, n); err != nil {
+			return err
+		} else if limited {
+			return &pc.RateLimitExceeded{}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dukex/mixpanel"
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+)
+
+const (
+	defaultTrackingQueueSize  = 1000
+	defaultTrackingBatchSize  = 50
+	defaultTrackingMaxRetries = 5
+	// Delay before the first retry. Doubles with each subsequent attempt
+	trackingRetryBaseDelay = time.Second
+	trackingRetryMaxDelay  = time.Minute
+	// How often delivery of spooled events is attempted
+	trackingSpoolInterval = time.Minute
+	// Maximum time spent delivering pending events on shutdown. Remaining events are spooled
+	trackingFlushTimeout = 10 * time.Second
+	// Spooled events that still couldn't be delivered after this long are dropped
+	trackingSpoolMaxAge = 7 * 24 * time.Hour
+)
+
+// Returned by tracking backends that rejected events for good, e.g. because they are malformed.
+// Rejected events are dropped instead of being retried
+type TrackingRejectedError struct {
+	Err error
+}
+
+func (e *TrackingRejectedError) Error() string {
+	return e.Err.Error()
+}
+
+// Whether the given delivery error means that retrying won't help
+func isTrackingRejection(err error) bool {
+	switch e := err.(type) {
+	case *TrackingRejectedError:
+		return true
+	case *mixpanel.MixpanelError:
+		// Mixpanel responds with "0" for events it doesn't accept
+		_, ok := e.Err.(*mixpanel.ErrTrackFailed)
+		return ok
+	default:
+		return false
+	}
+}
+
+type TrackingQueueConfig struct {
+	// Maximum number of events waiting to be delivered. Defaults to 1000
+	Size int `yaml:"size"`
+	// Maximum number of events delivered at once. Defaults to 50
+	BatchSize int `yaml:"batch_size"`
+	// Number of retries before an event is spooled to disk or dropped. Defaults to 5
+	MaxRetries int `yaml:"max_retries"`
+	// Directory for spooling events that can't be delivered right away. Such events are dropped
+	// if not set
+	SpoolDir string `yaml:"spool_dir"`
+}
+
+type trackingJobType string
+
+const (
+	trackingJobEvent       trackingJobType = "event"
+	trackingJobProfile     trackingJobType = "profile"
+	trackingJobDelete      trackingJobType = "delete"
+	trackingJobUnsubscribe trackingJobType = "unsubscribe"
+)
+
+// A call to one of the `Tracker` methods, queued for delivery. Jobs are self-contained so they
+// can be written to and restored from the spool. Accounts are never written to the spool; profile
+// jobs only hold the tracking id along with the profile properties computed when the job was created
+type trackingJob struct {
+	Type       trackingJobType        `json:"type"`
+	Event      *TrackingEvent         `json:"event,omitempty"`
+	Properties map[string]interface{} `json:"props,omitempty"`
+	TrackingID string                 `json:"trackingID,omitempty"`
+	// Preparation state of the event, which isn't serialized as part of the event itself. The
+	// account the event is linked to is reloaded from storage when restoring the event
+	Email              string `json:"email,omitempty"`
+	OriginalTrackingID string `json:"originalTrackingID,omitempty"`
+	IP                 string `json:"ip,omitempty"`
+	// Time the job was first written to the spool
+	Spooled time.Time `json:"spooled"`
+	// Number of failed delivery attempts and time of the next one
+	attempts int
+	retryAt  time.Time
+}
+
+// Restores the preparation state of an event read from the spool
+func (job *trackingJob) restore(storage pc.Storage) {
+	if job.Event != nil {
+		job.Event.prepared = true
+		job.Event.originalTrackingID = job.OriginalTrackingID
+		job.Event.ip = job.IP
+		if job.Email != "" {
+			acc := &Account{Email: job.Email}
+			if err := storage.Get(acc); err == nil {
+				job.Event.account = acc
+			}
+		}
+	}
+}
+
+type TrackingQueueStats struct {
+	Backend string `json:"backend"`
+	// Number of events waiting to be delivered
+	Depth int `json:"depth"`
+	// Number of events waiting in the spool
+	SpoolDepth int   `json:"spoolDepth"`
+	Enqueued   int64 `json:"enqueued"`
+	Delivered  int64 `json:"delivered"`
+	Retried    int64 `json:"retried"`
+	Spooled    int64 `json:"spooled"`
+	Dropped    int64 `json:"dropped"`
+}
+
+// Implemented by trackers that deliver events asynchronously
+type queuedTracker interface {
+	Tracker
+	// Returns the state of the queue(s) used by the tracker
+	QueueStats() []*TrackingQueueStats
+	// Delivers all pending events and stops accepting new ones
+	Close() error
+}
+
+// Implemented by backends that can deliver multiple events at once
+type batchTracker interface {
+	TrackBatch(events []*TrackingEvent) error
+}
+
+// Returns the state of the tracker's queues, if any
+func TrackerStats(t Tracker) []*TrackingQueueStats {
+	if qt, ok := t.(queuedTracker); ok {
+		return qt.QueueStats()
+	}
+	return []*TrackingQueueStats{}
+}
+
+// Delivers any events still pending in the tracker's queues. Should be called before shutting down
+func CloseTracker(t Tracker) error {
+	if qt, ok := t.(queuedTracker); ok {
+		return qt.Close()
+	}
+	return nil
+}
+
+// Tracker that delivers events to a backend in the background. Events are prepared synchronously
+// (so tracking ids are available right away), then queued and delivered in batches. Failed
+// deliveries are retried with exponential backoff and eventually written to a spool on disk,
+// from where they are retried periodically
+type trackingQueue struct {
+	// Counters, accessed atomically
+	enqueued  int64
+	delivered int64
+	retried   int64
+	spooled   int64
+	dropped   int64
+
+	name    string
+	backend Tracker
+	storage pc.Storage
+	config  TrackingQueueConfig
+	log     *log.Logger
+	jobs    chan *trackingJob
+	stop    chan struct{}
+	done    chan struct{}
+	// Guards `closed`
+	mutex  sync.RWMutex
+	closed bool
+	// Guards the spool file and `spoolDepth`
+	spoolMutex sync.Mutex
+	spoolDepth int
+	// Jobs waiting to be retried. Only accessed by the worker
+	retries []*trackingJob
+}
+
+func NewTrackingQueue(name string, backend Tracker, storage pc.Storage, config *TrackingQueueConfig, logger *log.Logger) (Tracker, error) {
+	q := &trackingQueue{
+		name:    name,
+		backend: backend,
+		storage: storage,
+		config:  *config,
+		log:     logger,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if q.config.Size <= 0 {
+		q.config.Size = defaultTrackingQueueSize
+	}
+	if q.config.BatchSize <= 0 {
+		q.config.BatchSize = defaultTrackingBatchSize
+	}
+	if q.config.MaxRetries <= 0 {
+		q.config.MaxRetries = defaultTrackingMaxRetries
+	}
+
+	if q.config.SpoolDir != "" {
+		if err := os.MkdirAll(q.config.SpoolDir, 0700); err != nil {
+			return nil, err
+		}
+		jobs, err := q.readSpool()
+		if err != nil {
+			return nil, err
+		}
+		q.spoolDepth = len(jobs)
+	}
+
+	q.jobs = make(chan *trackingJob, q.config.Size)
+
+	go q.run()
+
+	return q, nil
+}
+
+func (q *trackingQueue) spoolPath() string {
+	return filepath.Join(q.config.SpoolDir, q.name+".jsonl")
+}
+
+// Reads all jobs from the spool. Needs to be called with `spoolMutex` held (or before the worker
+// has been started)
+func (q *trackingQueue) readSpool() ([]*trackingJob, error) {
+	f, err := os.Open(q.spoolPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var jobs []*trackingJob
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		job := &trackingJob{}
+		if err := json.Unmarshal(scanner.Bytes(), job); err != nil {
+			q.log.Printf("Skipping invalid entry in tracking spool %s: %v", q.spoolPath(), err)
+			continue
+		}
+		// Entries written before spool times were recorded start their clock now
+		if job.Spooled.IsZero() {
+			job.Spooled = time.Now()
+		}
+		job.restore(q.storage)
+		jobs = append(jobs, job)
+	}
+
+	return jobs, scanner.Err()
+}
+
+// Appends the given jobs to the spool or drops them if no spool is configured
+func (q *trackingQueue) spool(jobs []*trackingJob) error {
+	if q.config.SpoolDir == "" {
+		atomic.AddInt64(&q.dropped, int64(len(jobs)))
+		return fmt.Errorf("Dropped %d events for tracking backend %s", len(jobs), q.name)
+	}
+
+	now := time.Now()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, job := range jobs {
+		if job.Spooled.IsZero() {
+			job.Spooled = now
+		}
+		if err := enc.Encode(job); err != nil {
+			return err
+		}
+	}
+
+	q.spoolMutex.Lock()
+	defer q.spoolMutex.Unlock()
+
+	f, err := os.OpenFile(q.spoolPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		atomic.AddInt64(&q.dropped, int64(len(jobs)))
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		atomic.AddInt64(&q.dropped, int64(len(jobs)))
+		return err
+	}
+
+	q.spoolDepth = q.spoolDepth + len(jobs)
+	atomic.AddInt64(&q.spooled, int64(len(jobs)))
+
+	return nil
+}
+
+func (q *trackingQueue) enqueue(job *trackingJob) error {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	atomic.AddInt64(&q.enqueued, 1)
+
+	if !q.closed {
+		select {
+		case q.jobs <- job:
+			return nil
+		default:
+		}
+	}
+
+	// Queue is full or shutting down
+	err := q.spool([]*trackingJob{job})
+	if err != nil {
+		q.log.Printf("Error while queueing tracking event: %v", err)
+	}
+	return err
+}
+
+func (q *trackingQueue) Track(event *TrackingEvent) error {
+	acc, originalTrackingID := prepareEvent(q.storage, event)
+
+	job := &trackingJob{
+		Type:               trackingJobEvent,
+		Event:              event,
+		OriginalTrackingID: originalTrackingID,
+		IP:                 event.ip,
+	}
+	if acc != nil {
+		job.Email = acc.Email
+	}
+
+	return q.enqueue(job)
+}
+
+func (q *trackingQueue) UpdateProfile(acc *Account, props map[string]interface{}) error {
+	// Compute the profile right away, since the account may still be modified by the caller. This
+	// also assigns the tracking id so backends don't need to update the account later
+	return q.enqueue(&trackingJob{
+		Type:       trackingJobProfile,
+		TrackingID: acc.TrackingID,
+		Properties: profileProperties(q.storage, acc, props),
+	})
+}
+
+func (q *trackingQueue) DeleteProfile(acc *Account) error {
+	if acc.TrackingID == "" {
+		return nil
+	}
+
+	return q.enqueue(&trackingJob{
+		Type:       trackingJobDelete,
+		TrackingID: acc.TrackingID,
+	})
+}
+
+func (q *trackingQueue) UnsubscribeProfile(tid string) error {
+	return q.enqueue(&trackingJob{
+		Type:       trackingJobUnsubscribe,
+		TrackingID: tid,
+	})
+}
+
+func (q *trackingQueue) QueueStats() []*TrackingQueueStats {
+	q.spoolMutex.Lock()
+	spoolDepth := q.spoolDepth
+	q.spoolMutex.Unlock()
+
+	return []*TrackingQueueStats{{
+		Backend:    q.name,
+		Depth:      len(q.jobs),
+		SpoolDepth: spoolDepth,
+		Enqueued:   atomic.LoadInt64(&q.enqueued),
+		Delivered:  atomic.LoadInt64(&q.delivered),
+		Retried:    atomic.LoadInt64(&q.retried),
+		Spooled:    atomic.LoadInt64(&q.spooled),
+		Dropped:    atomic.LoadInt64(&q.dropped),
+	}}
+}
+
+func (q *trackingQueue) Close() error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.stop)
+	q.mutex.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-time.After(2 * trackingFlushTimeout):
+		return fmt.Errorf("Timed out while flushing tracking backend %s", q.name)
+	}
+}
+
+func (q *trackingQueue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(trackingSpoolInterval)
+	defer ticker.Stop()
+
+	retryTicker := time.NewTicker(trackingRetryBaseDelay)
+	defer retryTicker.Stop()
+
+	q.replaySpool()
+
+	for {
+		select {
+		case job := <-q.jobs:
+			q.deliver(q.collect(job))
+		case <-retryTicker.C:
+			q.retry()
+		case <-ticker.C:
+			q.replaySpool()
+		case <-q.stop:
+			q.flush()
+			return
+		}
+	}
+}
+
+// Collects a batch of jobs, starting with `first`, without waiting for new ones
+func (q *trackingQueue) collect(first *trackingJob) []*trackingJob {
+	batch := []*trackingJob{first}
+	for len(batch) < q.config.BatchSize {
+		select {
+		case job := <-q.jobs:
+			batch = append(batch, job)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// Delivers a batch of jobs, scheduling failed ones for a retry
+func (q *trackingQueue) deliver(batch []*trackingJob) {
+	q.scheduleRetries(q.send(batch))
+}
+
+// Schedules the given failed jobs for another attempt with exponential backoff. Jobs that have run
+// out of retries are spooled. Retries happen in between delivering new jobs, so a failing job
+// doesn't hold up the rest of the queue
+func (q *trackingQueue) scheduleRetries(failed []*trackingJob) {
+	var exhausted []*trackingJob
+	for _, job := range failed {
+		if job.attempts >= q.config.MaxRetries {
+			exhausted = append(exhausted, job)
+			continue
+		}
+
+		delay := trackingRetryBaseDelay << uint(job.attempts)
+		if delay > trackingRetryMaxDelay || delay <= 0 {
+			delay = trackingRetryMaxDelay
+		}
+
+		job.attempts = job.attempts + 1
+		job.retryAt = time.Now().Add(delay)
+		q.retries = append(q.retries, job)
+	}
+
+	if len(exhausted) != 0 {
+		if err := q.spool(exhausted); err != nil {
+			q.log.Println("Error while spooling tracking events:", err)
+		}
+	}
+}
+
+// Retries all jobs that are due
+func (q *trackingQueue) retry() {
+	var due []*trackingJob
+	pending := q.retries[:0]
+	now := time.Now()
+	for _, job := range q.retries {
+		if job.retryAt.After(now) {
+			pending = append(pending, job)
+		} else {
+			due = append(due, job)
+		}
+	}
+	q.retries = pending
+
+	for i := 0; i < len(due); i += q.config.BatchSize {
+		end := i + q.config.BatchSize
+		if end > len(due) {
+			end = len(due)
+		}
+
+		atomic.AddInt64(&q.retried, int64(end-i))
+		q.scheduleRetries(q.send(due[i:end]))
+	}
+}
+
+// Sends the given jobs to the backend and returns the ones that failed and are worth retrying. Jobs
+// the backend rejected for good are dropped
+func (q *trackingQueue) send(batch []*trackingJob) []*trackingJob {
+	var failed []*trackingJob
+	var lastErr error
+	rejected := 0
+
+	result := func(jobs []*trackingJob, err error) {
+		if err == nil {
+			atomic.AddInt64(&q.delivered, int64(len(jobs)))
+		} else if isTrackingRejection(err) {
+			atomic.AddInt64(&q.dropped, int64(len(jobs)))
+			rejected = rejected + len(jobs)
+			lastErr = err
+		} else {
+			failed = append(failed, jobs...)
+			lastErr = err
+		}
+	}
+
+	var events []*TrackingEvent
+	var eventJobs []*trackingJob
+	bt, canBatch := q.backend.(batchTracker)
+
+	for _, job := range batch {
+		if job.Type == trackingJobEvent && canBatch {
+			events = append(events, job.Event)
+			eventJobs = append(eventJobs, job)
+			continue
+		}
+
+		result([]*trackingJob{job}, q.dispatch(job))
+	}
+
+	if len(events) != 0 {
+		if err := bt.TrackBatch(events); err != nil && isTrackingRejection(err) && len(events) > 1 {
+			// Send the events one by one so that only the ones actually rejected get dropped
+			for _, job := range eventJobs {
+				result([]*trackingJob{job}, q.dispatch(job))
+			}
+		} else {
+			result(eventJobs, err)
+		}
+	}
+
+	if lastErr != nil {
+		q.log.Printf("Failed to deliver %d of %d events to tracking backend %s (%d rejected): %v",
+			len(failed)+rejected, len(batch), q.name, rejected, lastErr)
+	}
+
+	return failed
+}
+
+func (q *trackingQueue) dispatch(job *trackingJob) error {
+	switch job.Type {
+	case trackingJobEvent:
+		return q.backend.Track(job.Event)
+	case trackingJobProfile:
+		// The properties already make up the complete profile, so the backend only needs the
+		// tracking id of the account
+		return q.backend.UpdateProfile(&Account{TrackingID: job.TrackingID}, job.Properties)
+	case trackingJobDelete:
+		return q.backend.DeleteProfile(&Account{TrackingID: job.TrackingID})
+	case trackingJobUnsubscribe:
+		return q.backend.UnsubscribeProfile(job.TrackingID)
+	default:
+		return fmt.Errorf("Unknown tracking job type: %s", job.Type)
+	}
+}
+
+// Attempts to deliver spooled jobs. Jobs are put back into the spool if the backend is still
+// unreachable
+func (q *trackingQueue) replaySpool() {
+	if q.config.SpoolDir == "" {
+		return
+	}
+
+	q.spoolMutex.Lock()
+	jobs, err := q.readSpool()
+	if err == nil && len(jobs) != 0 {
+		err = os.Remove(q.spoolPath())
+	}
+	if err == nil {
+		q.spoolDepth = 0
+	}
+	q.spoolMutex.Unlock()
+
+	if err != nil {
+		q.log.Println("Error while reading tracking spool:", err)
+		return
+	}
+
+	for i := 0; i < len(jobs); i += q.config.BatchSize {
+		end := i + q.config.BatchSize
+		if end > len(jobs) {
+			end = len(jobs)
+		}
+
+		// Don't bother retrying here - if the backend is still unreachable, try again later
+		if failed := q.send(jobs[i:end]); len(failed) != 0 {
+			if err := q.spool(q.dropExpired(append(failed, jobs[end:]...))); err != nil {
+				q.log.Println("Error while spooling tracking events:", err)
+			}
+			return
+		}
+	}
+}
+
+// Drops spooled jobs that have been waiting for longer than `trackingSpoolMaxAge`
+func (q *trackingQueue) dropExpired(jobs []*trackingJob) []*trackingJob {
+	var remaining []*trackingJob
+	for _, job := range jobs {
+		if time.Since(job.Spooled) < trackingSpoolMaxAge {
+			remaining = append(remaining, job)
+		}
+	}
+
+	if n := len(jobs) - len(remaining); n != 0 {
+		atomic.AddInt64(&q.dropped, int64(n))
+		q.log.Printf("Dropped %d spooled events for tracking backend %s after %v", n, q.name, trackingSpoolMaxAge)
+	}
+
+	return remaining
+}
+
+// Delivers all remaining jobs on shutdown, spooling whatever can't be delivered in time. Jobs
+// waiting for a retry get one last attempt
+func (q *trackingQueue) flush() {
+	deadline := time.Now().Add(trackingFlushTimeout)
+
+	retries := q.retries
+	q.retries = nil
+
+	for {
+		var batch []*trackingJob
+		select {
+		case job := <-q.jobs:
+			batch = q.collect(job)
+		default:
+			if len(retries) == 0 {
+				return
+			}
+			batch = retries
+			if len(batch) > q.config.BatchSize {
+				batch = batch[:q.config.BatchSize]
+			}
+			retries = retries[len(batch):]
+		}
+
+		failed := batch
+		if time.Now().Before(deadline) {
+			failed = q.send(batch)
+		}
+
+		if len(failed) != 0 {
+			if err := q.spool(failed); err != nil {
+				q.log.Println("Error while spooling tracking events:", err)
+			}
+		}
+	}
+}
+
+func (t multiTracker) QueueStats() []*TrackingQueueStats {
+	stats := make([]*TrackingQueueStats, 0)
+	for _, tracker := range t {
+		stats = append(stats, TrackerStats(tracker)...)
+	}
+	return stats
+}
+
+func (t multiTracker) Close() error {
+	return t.each(CloseTracker)
+}
+
+type TrackingStats struct {
+	*Server
+}
+
+// Reports queue depths and delivery counters of all tracking backends
+func (h *TrackingStats) Handle(w http.ResponseWriter, r *http.Request, auth *pc.AuthToken) error {
+	b, err := json.Marshal(TrackerStats(h.Tracker))
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+
+	return nil
+}
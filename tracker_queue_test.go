@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+)
+
+// Creates a queue that isn't running, so tests can drive delivery themselves. Events named "bad"
+// are rejected by the backend and events named "down" fail as if the backend was unreachable
+func newTestTrackingQueue(spoolDir string) (*trackingQueue, *[]string) {
+	var delivered []string
+	backend := &recordTracker{
+		storage: &pc.MemoryStorage{},
+		write: func(recs []*trackingRecord) error {
+			for _, rec := range recs {
+				switch rec.Event {
+				case "bad":
+					return &TrackingRejectedError{errors.New("Invalid event")}
+				case "down":
+					return errors.New("Connection refused")
+				}
+			}
+			for _, rec := range recs {
+				delivered = append(delivered, rec.Event)
+			}
+			return nil
+		},
+	}
+
+	return &trackingQueue{
+		name:    "test",
+		backend: backend,
+		storage: &pc.MemoryStorage{},
+		config:  TrackingQueueConfig{BatchSize: 10, SpoolDir: spoolDir},
+		log:     log.New(ioutil.Discard, "", 0),
+	}, &delivered
+}
+
+func testTrackingJob(name string) *trackingJob {
+	return &trackingJob{Type: trackingJobEvent, Event: &TrackingEvent{Name: name, prepared: true}}
+}
+
+func TestReplaySpoolDropsRejectedEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracking-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, delivered := newTestTrackingQueue(dir)
+
+	if err := q.spool([]*trackingJob{testTrackingJob("bad"), testTrackingJob("first"), testTrackingJob("second")}); err != nil {
+		t.Fatal(err)
+	}
+
+	q.replaySpool()
+
+	if len(*delivered) != 2 || (*delivered)[0] != "first" || (*delivered)[1] != "second" {
+		t.Errorf("Expected events behind the rejected one to be delivered, got %v", *delivered)
+	}
+	if jobs, _ := q.readSpool(); len(jobs) != 0 {
+		t.Errorf("Expected rejected event not to be spooled again, got %d jobs", len(jobs))
+	}
+	if q.dropped != 1 {
+		t.Errorf("Expected 1 dropped event, got %d", q.dropped)
+	}
+}
+
+func TestReplaySpoolDropsExpiredEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracking-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, _ := newTestTrackingQueue(dir)
+
+	old := testTrackingJob("down")
+	old.Spooled = time.Now().Add(-trackingSpoolMaxAge - time.Hour)
+	recent := testTrackingJob("down")
+	recent.Spooled = time.Now().Add(-time.Hour)
+	if err := q.spool([]*trackingJob{old, recent}); err != nil {
+		t.Fatal(err)
+	}
+
+	q.replaySpool()
+
+	jobs, err := q.readSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || !jobs[0].Spooled.Equal(recent.Spooled) {
+		t.Errorf("Expected only the recent event to be spooled again, got %d jobs", len(jobs))
+	}
+}
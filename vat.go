@@ -0,0 +1,245 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	pc "github.com/padloc/padlock-cloud/padlockcloud"
+	"github.com/stripe/stripe-go"
+)
+
+// Country we're based in. Customers here are always charged VAT, even with a VAT ID
+const sellerCountry = "DE"
+
+// Standard VAT rates of the EU member states in percent. Needs to be kept up to date manually
+var euVATRates = map[string]float64{
+	"AT": 20,
+	"BE": 21,
+	"BG": 20,
+	"CY": 19,
+	"CZ": 21,
+	"DE": 19,
+	"DK": 25,
+	"EE": 24,
+	"ES": 21,
+	"FI": 25.5,
+	"FR": 20,
+	"GR": 24,
+	"HR": 25,
+	"HU": 27,
+	"IE": 23,
+	"IT": 22,
+	"LT": 21,
+	"LU": 17,
+	"LV": 21,
+	"MT": 18,
+	"NL": 21,
+	"PL": 23,
+	"PT": 23,
+	"RO": 21,
+	"SE": 25,
+	"SI": 22,
+	"SK": 23,
+}
+
+// Formats of the VAT identification numbers of each EU member state, including the prefix
+var euVATIDFormats = map[string]*regexp.Regexp{
+	"AT": regexp.MustCompile(`^ATU\d{8}$`),
+	"BE": regexp.MustCompile(`^BE[01]\d{9}$`),
+	"BG": regexp.MustCompile(`^BG\d{9,10}$`),
+	"CY": regexp.MustCompile(`^CY\d{8}[A-Z]$`),
+	"CZ": regexp.MustCompile(`^CZ\d{8,10}$`),
+	"DE": regexp.MustCompile(`^DE\d{9}$`),
+	"DK": regexp.MustCompile(`^DK\d{8}$`),
+	"EE": regexp.MustCompile(`^EE\d{9}$`),
+	"ES": regexp.MustCompile(`^ES[A-Z0-9]\d{7}[A-Z0-9]$`),
+	"FI": regexp.MustCompile(`^FI\d{8}$`),
+	"FR": regexp.MustCompile(`^FR[A-HJ-NP-Z0-9]{2}\d{9}$`),
+	"GR": regexp.MustCompile(`^EL\d{9}$`),
+	"HR": regexp.MustCompile(`^HR\d{11}$`),
+	"HU": regexp.MustCompile(`^HU\d{8}$`),
+	"IE": regexp.MustCompile(`^IE(\d{7}[A-W][A-I]?|\d[A-Z+*]\d{5}[A-W])$`),
+	"IT": regexp.MustCompile(`^IT\d{11}$`),
+	"LT": regexp.MustCompile(`^LT(\d{9}|\d{12})$`),
+	"LU": regexp.MustCompile(`^LU\d{8}$`),
+	"LV": regexp.MustCompile(`^LV\d{11}$`),
+	"MT": regexp.MustCompile(`^MT\d{8}$`),
+	"NL": regexp.MustCompile(`^NL\d{9}B\d{2}$`),
+	"PL": regexp.MustCompile(`^PL\d{10}$`),
+	"PT": regexp.MustCompile(`^PT\d{9}$`),
+	"RO": regexp.MustCompile(`^RO\d{2,10}$`),
+	"SE": regexp.MustCompile(`^SE\d{12}$`),
+	"SI": regexp.MustCompile(`^SI\d{8}$`),
+	"SK": regexp.MustCompile(`^SK\d{10}$`),
+}
+
+func isEUCountry(country string) bool {
+	_, ok := euVATRates[country]
+	return ok
+}
+
+// Returns the prefix of VAT IDs issued by the given country. This is the country code except
+// for Greece, which uses "EL"
+func vatIDPrefix(country string) string {
+	if country == "GR" {
+		return "EL"
+	}
+	return country
+}
+
+var vatIDSeparators = strings.NewReplacer(" ", "", ".", "", "-", "")
+
+// Normalizes the given VAT ID and checks whether it is valid for the given billing country.
+// The country prefix may be omitted
+func NormalizeVATID(vatID string, country string) (string, error) {
+	format, ok := euVATIDFormats[country]
+	if !ok {
+		return "", &pc.BadRequest{Msg: "VAT IDs are only supported for billing addresses within the EU"}
+	}
+
+	vatID = strings.ToUpper(vatIDSeparators.Replace(vatID))
+	prefix := vatIDPrefix(country)
+	if !strings.HasPrefix(vatID, prefix) {
+		vatID = prefix + vatID
+	}
+
+	if !format.MatchString(vatID) {
+		return "", &pc.BadRequest{Msg: "Invalid VAT ID for the selected country"}
+	}
+
+	return vatID, nil
+}
+
+// Returns the VAT ID stored with the customer or an empty string if there is none
+func customerVATID(c *stripe.Customer) string {
+	if c == nil || c.TaxIDs == nil {
+		return ""
+	}
+	for _, id := range c.TaxIDs.Data {
+		if id.Type == stripe.TaxIDTypeEUVAT {
+			return id.Value
+		}
+	}
+	return ""
+}
+
+// Whether a customer in the given country with the given VAT ID is a business in another EU
+// member state, in which case the reverse-charge mechanism applies and no VAT is charged
+func isReverseCharge(country string, vatID string) bool {
+	return vatID != "" && country != sellerCountry && isEUCountry(country)
+}
+
+// Returns the VAT rate in percent applying to customers in the given country with the given
+// (possibly empty) VAT ID. Customers outside the EU are not charged any VAT
+func vatRate(country string, vatID string) float64 {
+	if !isEUCountry(country) || isReverseCharge(country, vatID) {
+		return 0
+	}
+	return euVATRates[country]
+}
+
+// Returns the id of the tax rate for the given country and percentage, creating it if it
+// doesn't exist yet
+func (server *Server) taxRateID(country string, percentage float64) (string, error) {
+	rates, err := server.Billing.ListTaxRates()
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range rates {
+		if r.Active && !r.Inclusive && r.Jurisdiction == country && r.Percentage == percentage {
+			return r.ID, nil
+		}
+	}
+
+	name := "VAT"
+	inclusive := false
+	rate, err := server.Billing.CreateTaxRate(&stripe.TaxRateParams{
+		DisplayName:  &name,
+		Jurisdiction: &country,
+		Percentage:   &percentage,
+		Inclusive:    &inclusive,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return rate.ID, nil
+}
+
+// Sets the tax rates for the account's billing country on the given subscription parameters
+func (server *Server) setTaxRates(acc *Account, params *stripe.SubscriptionParams) error {
+	country := acc.BillingInfo()["country"]
+	rate := vatRate(country, customerVATID(acc.Customer))
+
+	if rate == 0 {
+		// An empty list is omitted when encoding the parameters, so the rates have to be cleared explicitly
+		params.DefaultTaxRates = []*string{}
+		params.AddExtra("default_tax_rates", "")
+		return nil
+	}
+
+	id, err := server.taxRateID(country, rate)
+	if err != nil {
+		return err
+	}
+	params.DefaultTaxRates = []*string{&id}
+
+	return nil
+}
+
+// Updates the customer's VAT ID and applies the tax rate for their billing country to the
+// subscription. Pass an empty `vatID` to remove the existing one
+func (server *Server) UpdateTax(acc *Account, vatID string) error {
+	c := acc.Customer
+
+	if vatID != customerVATID(c) {
+		if c.TaxIDs != nil {
+			for _, id := range c.TaxIDs.Data {
+				if id.Type == stripe.TaxIDTypeEUVAT {
+					if err := server.Billing.DeleteTaxID(c.ID, id.ID); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if vatID != "" {
+			typ := string(stripe.TaxIDTypeEUVAT)
+			if _, err := server.Billing.CreateTaxID(&stripe.TaxIDParams{
+				Customer: &c.ID,
+				Type:     &typ,
+				Value:    &vatID,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	exempt := string(stripe.CustomerTaxExemptNone)
+	if isReverseCharge(acc.BillingInfo()["country"], vatID) {
+		exempt = string(stripe.CustomerTaxExemptReverse)
+	}
+
+	if customer, err := server.Billing.UpdateCustomer(c.ID, &stripe.CustomerParams{
+		TaxExempt: &exempt,
+	}); err != nil {
+		return err
+	} else {
+		acc.SetCustomer(customer)
+	}
+
+	if s := acc.Subscription(); s != nil {
+		params := &stripe.SubscriptionParams{}
+		if err := server.setTaxRates(acc, params); err != nil {
+			return err
+		}
+		if s_, err := server.Billing.UpdateSubscription(s.ID, params); err != nil {
+			return err
+		} else {
+			*s = *s_
+		}
+	}
+
+	return nil
+}